@@ -2,12 +2,14 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,10 +20,14 @@ type VisitSummary struct {
 	DisplayName    string
 	FullName       string
 	MemberType     string
+	Plan           plan
 	Count          int
-	HighlightRed   bool // 未払いあり
-	HighlightGreen bool // 全て支払い済み
+	Expected       int  // その月の請求額
+	Balance        int  // その月の未収
+	HighlightRed   bool // 未収あり
+	HighlightGreen bool // 請求分を全て受け取り済み
 	PosterID       string
+	InsideNow      bool // 在館中（本日一覧のみ）
 }
 
 var funcMap = template.FuncMap{
@@ -61,38 +67,40 @@ var adminVisitsDayTmpl = mustParseAdminTemplate("admin_visits_day.html")
 func getMonthlySummaries(year int, month int, filterText, filterType string) ([]VisitSummary, error) {
 	ym := fmt.Sprintf("%04d-%02d", year, month)
 
+	// 明細が残っている来店と、集計に移した古い月（visit_archive.go）を合わせて数える。
+	// 集計に移した月は、移した時点のプランで扱う。
 	baseSQL := `
 	SELECT 
 	  v.line_user_id,
   IFNULL(m.display_name, ''),
   IFNULL(m.full_name, ''), 
-  IFNULL(m.member_type, 'general'),
+  COALESCE(MAX(v.member_type), m.member_type, ` + defaultPlanCodeSQL + `),
   IFNULL(m.poster_id, ''),
-  COUNT(v.id) as cnt
-	FROM visits v
+  SUM(v.cnt) as cnt,
+  IFNULL(MAX(t.received), 0),
+  IFNULL(MAX(t.ticket_visits), 0),
+  IFNULL(MAX(t.settled_visits), 0)
+	FROM (
+	  SELECT line_user_id, NULL AS member_type, COUNT(*) AS cnt
+	    FROM visits
+	   WHERE strftime('%Y-%m', visited_at) = ?
+	   GROUP BY line_user_id
+	  UNION ALL
+	  SELECT line_user_id, member_type, visit_count
+	    FROM visit_monthly_rollups
+	   WHERE month = ?
+	) v
 	LEFT JOIN members m ON m.line_user_id = v.line_user_id
-	WHERE strftime('%Y-%m', v.visited_at) = ?
+	LEFT JOIN (` + memberMonthTotalsSQL + `) t ON t.line_user_id = v.line_user_id
+	WHERE 1 = 1
 	`
-	args := []interface{}{ym}
-	var where []string
-
-	// 会員種別フィルタ（general / 1day）
-	if filterType == "general" || filterType == "1day" {
-		where = append(where, "m.member_type = ?")
-		args = append(args, filterType)
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return nil, err
 	}
 
-	// 名前 / フルネーム / PosterID / LINE ID でのキーワード検索
-	if filterText != "" {
-		like := "%" + filterText + "%"
-		where = append(where,
-			"(IFNULL(m.display_name,'') LIKE ? OR "+
-				"IFNULL(m.full_name,'') LIKE ? OR "+
-				"IFNULL(m.poster_id,'') LIKE ? OR "+
-				"v.line_user_id LIKE ?)",
-		)
-		args = append(args, like, like, like, like)
-	}
+	where, filterArgs := memberFilterConditions(plans, filterText, filterType, "v.line_user_id")
+	args := append([]interface{}{ym, ym, ym, ym, ym}, filterArgs...)
 
 	if len(where) > 0 {
 		baseSQL += " AND " + strings.Join(where, " AND ")
@@ -111,7 +119,10 @@ func getMonthlySummaries(year int, month int, filterText, filterType string) ([]
 
 	var list []VisitSummary
 	for rows.Next() {
-		var s VisitSummary
+		var (
+			s      VisitSummary
+			totals memberMonthTotals
+		)
 		if err := rows.Scan(
 			&s.LineUserID,
 			&s.DisplayName,
@@ -119,26 +130,15 @@ func getMonthlySummaries(year int, month int, filterText, filterType string) ([]
 			&s.MemberType,
 			&s.PosterID,
 			&s.Count,
+			&totals.Received,
+			&totals.TicketVisits,
+			&totals.SettledVisits,
 		); err != nil {
 			return nil, err
 		}
 
-		// デフォルトは色なし
-		s.HighlightRed = false
-		s.HighlightGreen = false
-
-		// ライトプラン かつ 今月5回以上なら支払い状況をチェック
-		threshold := 5
-		if s.MemberType == "1day" && s.Count >= threshold {
-			allPaid, err := isAllDueVisitsPaid(s.LineUserID, ym, threshold)
-			if err != nil {
-				log.Println("isAllDueVisitsPaid error:", err)
-			} else if allPaid {
-				s.HighlightGreen = true
-			} else {
-				s.HighlightRed = true
-			}
-		}
+		s.Plan = plans.lookup(s.MemberType)
+		highlightBalance(&s, totals)
 
 		list = append(list, s)
 	}
@@ -146,8 +146,60 @@ func getMonthlySummaries(year int, month int, filterText, filterType string) ([]
 	return list, rows.Err()
 }
 
+// 一覧画面とエクスポートで共通の絞り込み（q / member_type）。
+// members は m、LINE ID の列は lineUserIDColumn で参照する。条件は AND でつなぐ。
+func memberFilterConditions(plans planCatalog, filterText, filterType, lineUserIDColumn string) ([]string, []interface{}) {
+	var (
+		where []string
+		args  []interface{}
+	)
+
+	// 会員種別（プラン）フィルタ
+	if plans.has(filterType) {
+		where = append(where, "m.member_type = ?")
+		args = append(args, filterType)
+	}
+
+	// 名前 / フルネーム / ふりがな / PosterID / LINE ID でのキーワード検索
+	if filterText != "" {
+		like := "%" + filterText + "%"
+		kanaLike := "%" + toHiragana(filterText) + "%"
+		where = append(where,
+			"(IFNULL(m.display_name,'') LIKE ? OR "+
+				"IFNULL(m.full_name,'') LIKE ? OR "+
+				"IFNULL(m.full_name_kana,'') LIKE ? OR "+
+				"IFNULL(m.poster_id,'') LIKE ? OR "+
+				lineUserIDColumn+" LIKE ?)",
+		)
+		args = append(args, like, like, kanaLike, like, like)
+	}
+	return where, args
+}
+
+// その月の請求額と入金の差（未収）で色を付ける。請求が無ければ色なし。
+// プランに料金が設定されていない（プランを作った直後の移行分など）ときは、金額では比べられないので
+// 以前と同じく込み回数を超えた来店に支払いチェックが付いているかで色を付ける。
+func highlightBalance(s *VisitSummary, t memberMonthTotals) {
+	st := newMemberStatement(s.Plan, s.Count, t.TicketVisits, t.Received)
+	s.Expected = st.Expected
+	s.Balance = st.Balance
+	if s.Plan.hasPrices() {
+		s.HighlightRed = st.Outstanding()
+		s.HighlightGreen = st.Settled()
+		return
+	}
+	// 支払いチェックは込み回数を超えた来店にしか付けられないので、数で比べれば足りる
+	s.HighlightRed = st.BillableVisits > 0 && t.SettledVisits < st.BillableVisits
+	s.HighlightGreen = st.BillableVisits > 0 && !s.HighlightRed
+}
+
 // 今日分の集計を取得
 func getTodaySummaries() ([]VisitSummary, error) {
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return nil, err
+	}
+
 	now := jstNow()
 	monthKey := formatJSTMonth(now)
 	todayDate := formatJSTDate(now)
@@ -165,14 +217,19 @@ SELECT
   v.line_user_id,
   IFNULL(m.display_name, ''),
   IFNULL(m.full_name, ''),
-  IFNULL(m.member_type, 'general'),
+  IFNULL(m.member_type, `+defaultPlanCodeSQL+`),
   IFNULL(m.poster_id, ''),
-  COALESCE(monthly.monthly_cnt, 0) AS cnt
+  COALESCE(monthly.monthly_cnt, 0) AS cnt,
+  IFNULL(t.received, 0),
+  IFNULL(t.ticket_visits, 0),
+  IFNULL(t.settled_visits, 0)
 FROM visits v
 LEFT JOIN members m
   ON m.line_user_id = v.line_user_id
 LEFT JOIN monthly
   ON monthly.line_user_id = v.line_user_id
+LEFT JOIN (`+memberMonthTotalsSQL+`) t
+  ON t.line_user_id = v.line_user_id
 WHERE date(v.visited_at) = ?
 GROUP BY
   v.line_user_id,
@@ -180,20 +237,28 @@ GROUP BY
   m.full_name,
   m.member_type,
   m.poster_id,
-  monthly.monthly_cnt
+  monthly.monthly_cnt,
+  t.received,
+  t.ticket_visits,
+  t.settled_visits
 ORDER BY
   cnt DESC,
   m.full_name,
   m.display_name;
-	`, monthKey, todayDate)
+	`, monthKey, monthKey, monthKey, monthKey, todayDate)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	inside := getCheckedInSnapshot()
+
 	var list []VisitSummary
 	for rows.Next() {
-		var s VisitSummary
+		var (
+			s      VisitSummary
+			totals memberMonthTotals
+		)
 		if err := rows.Scan(
 			&s.LineUserID,
 			&s.DisplayName,
@@ -201,25 +266,16 @@ ORDER BY
 			&s.MemberType,
 			&s.PosterID,
 			&s.Count,
+			&totals.Received,
+			&totals.TicketVisits,
+			&totals.SettledVisits,
 		); err != nil {
 			return nil, err
 		}
+		_, s.InsideNow = inside[s.LineUserID]
 
-		s.HighlightRed = false
-		s.HighlightGreen = false
-
-		ym := monthKey
-		threshold := 5
-		if s.MemberType == "1day" && s.Count >= threshold {
-			allPaid, err := isAllDueVisitsPaid(s.LineUserID, ym, threshold)
-			if err != nil {
-				log.Println("isAllDueVisitsPaid error:", err)
-			} else if allPaid {
-				s.HighlightGreen = true
-			} else {
-				s.HighlightRed = true
-			}
-		}
+		s.Plan = plans.lookup(s.MemberType)
+		highlightBalance(&s, totals)
 
 		list = append(list, s)
 	}
@@ -227,13 +283,20 @@ ORDER BY
 }
 
 type CalendarDay struct {
-	Day       int
-	DateISO   string
-	Count     int
-	InMonth   bool
-	Weekday   int
-	IsToday   bool
-	DetailURL string
+	Day         int
+	DateISO     string
+	Count       int
+	AverageStay string // その日の平均滞在時間。分からなければ空
+	InMonth     bool
+	Weekday     int
+	IsToday     bool
+	DetailURL   string
+
+	// 営業時間のカレンダー（BUSINESS_HOURS_FILE）があるときだけ入る
+	Closed      bool
+	ClosedNote  string // 定休日・臨時休業の理由
+	HolidayName string
+	HoursLabel  string // 営業日の営業時間
 }
 
 type CalendarWeek struct {
@@ -245,9 +308,17 @@ type DailyVisitor struct {
 	DisplayName  string
 	FullName     string
 	MemberType   string
+	Plan         plan
 	PosterID     string
 	FirstVisitAt string
 	MonthlyCount int
+	StayStr      string // その日の滞在時間（合計）
+	AverageStay  string // その月の平均滞在時間
+	InsideNow    bool
+
+	// API 用の秒数。分からなければ 0
+	StaySeconds        int
+	AverageStaySeconds int
 }
 
 func getCalendarBaseMonth(mode string) time.Time {
@@ -298,7 +369,35 @@ WHERE strftime('%Y-%m', v.visited_at) = ?;
 	return counts, monthlyTotal, nil
 }
 
-func buildCalendarWeeks(base time.Time, dailyCounts map[int]int, isPrev bool) []CalendarWeek {
+// 日ごとの平均滞在秒数（滞在時間が分かる来店のみ）
+func getMonthlyDailyAverageStay(monthKey string) (map[int]int, error) {
+	rows, err := db.Query(`
+SELECT
+  CAST(strftime('%d', v.visited_at) AS INTEGER) AS day_num,
+  CAST(AVG(v.duration_seconds) AS INTEGER)
+FROM visits v
+WHERE strftime('%Y-%m', v.visited_at) = ?
+  AND v.duration_seconds IS NOT NULL
+  AND v.checkout_reason IN `+measuredCheckoutReasonsSQL+`
+GROUP BY day_num;
+`, monthKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	averages := make(map[int]int)
+	for rows.Next() {
+		var day, avg int
+		if err := rows.Scan(&day, &avg); err != nil {
+			return nil, err
+		}
+		averages[day] = avg
+	}
+	return averages, rows.Err()
+}
+
+func buildCalendarWeeks(base time.Time, dailyCounts, dailyAverageStay map[int]int, isPrev bool) []CalendarWeek {
 	year, month, _ := base.Date()
 	firstDay := time.Date(year, month, 1, 0, 0, 0, 0, jst)
 	startOffset := int(firstDay.Weekday()) // Sunday=0
@@ -319,7 +418,7 @@ func buildCalendarWeeks(base time.Time, dailyCounts map[int]int, isPrev bool) []
 			detailURL += "&mode=prev"
 		}
 
-		cells = append(cells, CalendarDay{
+		cell := CalendarDay{
 			Day:       day,
 			DateISO:   dateISO,
 			Count:     dailyCounts[day],
@@ -327,7 +426,20 @@ func buildCalendarWeeks(base time.Time, dailyCounts map[int]int, isPrev bool) []
 			Weekday:   int(date.Weekday()),
 			IsToday:   date.Year() == today.Year() && date.Month() == today.Month() && date.Day() == today.Day(),
 			DetailURL: detailURL,
-		})
+		}
+		if avg, ok := dailyAverageStay[day]; ok {
+			cell.AverageStay = formatStayDuration(avg)
+		}
+		if businessHours != nil {
+			bd := businessHours.day(date)
+			cell.Closed = bd.Hours.Closed
+			cell.ClosedNote = bd.Note
+			cell.HolidayName = bd.HolidayName
+			if !bd.Hours.Closed {
+				cell.HoursLabel = bd.Hours.Label()
+			}
+		}
+		cells = append(cells, cell)
 	}
 
 	for len(cells)%7 != 0 {
@@ -363,22 +475,44 @@ func handleAdminVisitsCalendar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dailyAverageStay, err := getMonthlyDailyAverageStay(monthKey)
+	if err != nil {
+		log.Println("getMonthlyDailyAverageStay error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	data := struct {
 		MonthLabel   string
 		MonthKey     string
 		Mode         string
 		IsPrev       bool
 		ActivePage   string
+		Admin        *adminUser
+		CSRFToken    string
 		MonthlyTotal int
 		Weeks        []CalendarWeek
+
+		HasBusinessHours bool
+		WeeklyHours      []string // 日曜始まり
+		HolidayHours     string
+		Closures         []businessClosure
 	}{
 		MonthLabel:   monthLabel,
 		MonthKey:     monthKey,
 		Mode:         mode,
 		IsPrev:       mode == "prev",
 		ActivePage:   "calendar",
+		Admin:        adminUserFromContext(r.Context()),
+		CSRFToken:    csrfTokenFromContext(r.Context()),
 		MonthlyTotal: monthlyTotal,
-		Weeks:        buildCalendarWeeks(base, dailyCounts, mode == "prev"),
+		Weeks:        buildCalendarWeeks(base, dailyCounts, dailyAverageStay, mode == "prev"),
+	}
+	if businessHours != nil {
+		data.HasBusinessHours = true
+		data.WeeklyHours = businessHours.weeklyLabels()
+		data.HolidayHours = businessHours.holidayLabel()
+		data.Closures = businessHours.upcomingClosures(jstNow())
 	}
 
 	if err := adminVisitsCalendarTmpl.Execute(w, data); err != nil {
@@ -396,12 +530,17 @@ func isAllowedCalendarDate(target time.Time) bool {
 }
 
 func getDailyVisitors(dateISO, monthKey string) ([]DailyVisitor, error) {
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return nil, err
+	}
+
 	rows, err := db.Query(`
 SELECT
   v.line_user_id,
   IFNULL(m.display_name, ''),
   IFNULL(m.full_name, ''),
-  IFNULL(m.member_type, 'general'),
+  IFNULL(m.member_type, `+defaultPlanCodeSQL+`),
   IFNULL(m.poster_id, ''),
   MIN(strftime('%H:%M', v.visited_at)) AS first_visit_at,
   (
@@ -409,7 +548,16 @@ SELECT
     FROM visits vm
     WHERE vm.line_user_id = v.line_user_id
       AND strftime('%Y-%m', vm.visited_at) = ?
-  ) AS monthly_count
+  ) AS monthly_count,
+  SUM(v.duration_seconds) AS stay_seconds,
+  (
+    SELECT CAST(AVG(va.duration_seconds) AS INTEGER)
+    FROM visits va
+    WHERE va.line_user_id = v.line_user_id
+      AND strftime('%Y-%m', va.visited_at) = ?
+      AND va.duration_seconds IS NOT NULL
+      AND va.checkout_reason IN `+measuredCheckoutReasonsSQL+`
+  ) AS avg_stay_seconds
 FROM visits v
 LEFT JOIN members m ON m.line_user_id = v.line_user_id
 WHERE date(v.visited_at) = ?
@@ -420,15 +568,22 @@ GROUP BY
   m.member_type,
   m.poster_id
 ORDER BY first_visit_at ASC, m.full_name, m.display_name;
-`, monthKey, dateISO)
+`, monthKey, monthKey, dateISO)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	// 当日分だけ「在館中」を出す
+	var inside map[string]time.Time
+	if dateISO == formatJSTDate(jstNow()) {
+		inside = getCheckedInSnapshot()
+	}
+
 	var visitors []DailyVisitor
 	for rows.Next() {
 		var v DailyVisitor
+		var stay, avgStay sql.NullInt64
 		if err := rows.Scan(
 			&v.LineUserID,
 			&v.DisplayName,
@@ -437,9 +592,22 @@ ORDER BY first_visit_at ASC, m.full_name, m.display_name;
 			&v.PosterID,
 			&v.FirstVisitAt,
 			&v.MonthlyCount,
+			&stay,
+			&avgStay,
 		); err != nil {
 			return nil, err
 		}
+		_, v.InsideNow = inside[v.LineUserID]
+		v.Plan = plans.lookup(v.MemberType)
+		v.StayStr = "-"
+		if stay.Valid {
+			v.StaySeconds = int(stay.Int64)
+			v.StayStr = formatStayDuration(v.StaySeconds)
+		}
+		if avgStay.Valid {
+			v.AverageStaySeconds = int(avgStay.Int64)
+			v.AverageStay = formatStayDuration(v.AverageStaySeconds)
+		}
 		visitors = append(visitors, v)
 	}
 	return visitors, rows.Err()
@@ -490,6 +658,8 @@ func handleAdminVisitsDay(w http.ResponseWriter, r *http.Request) {
 		Mode       string
 		IsPrev     bool
 		ActivePage string
+		Admin      *adminUser
+		CSRFToken  string
 		BackURL    string
 		TotalUsers int
 		Visitors   []DailyVisitor
@@ -500,6 +670,8 @@ func handleAdminVisitsDay(w http.ResponseWriter, r *http.Request) {
 		Mode:       mode,
 		IsPrev:     mode == "prev",
 		ActivePage: "calendar",
+		Admin:      adminUserFromContext(r.Context()),
+		CSRFToken:  csrfTokenFromContext(r.Context()),
 		BackURL:    backURL,
 		TotalUsers: len(visitors),
 		Visitors:   visitors,
@@ -514,13 +686,25 @@ func handleAdminVisitsDay(w http.ResponseWriter, r *http.Request) {
 func handleAdminVisits(w http.ResponseWriter, r *http.Request) {
 	mode := r.URL.Query().Get("mode")
 	q := r.URL.Query().Get("q")                    // フィルタ文字列
-	memberType := r.URL.Query().Get("member_type") // "general" / "1day" / ""
+	memberType := r.URL.Query().Get("member_type") // plans.code。空ならすべて
 
 	base := monthStart(jstNow())
 	if mode == "prev" {
 		base = base.AddDate(0, -1, 0)
 	}
 
+	// それより前の月は ?month=YYYY-MM で見る（明細を集計に移した月も含む）
+	month := r.URL.Query().Get("month")
+	if month != "" {
+		t, err := time.ParseInLocation("2006-01", month, jst)
+		if err != nil || !t.Before(monthStart(jstNow())) {
+			http.Error(w, "bad month", http.StatusBadRequest)
+			return
+		}
+		base = t
+		mode = ""
+	}
+
 	// この月のラベル & キー
 	monthLabel := base.Format("2006年1月") // 例: 2025年10月
 	monthKey := base.Format("2006-01")   // 例: 2025-10（SQL用）
@@ -533,35 +717,66 @@ func handleAdminVisits(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		log.Println("loadPlanCatalog error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !plans.has(memberType) {
+		memberType = ""
+	}
+
 	successMsg := r.URL.Query().Get("success_msg")
 
-	isFiltered := strings.TrimSpace(q) != "" ||
-		memberType == "general" || memberType == "1day"
+	isFiltered := strings.TrimSpace(q) != "" || memberType != ""
+
+	mu.Lock()
+	retentionDays := currentSettings.VisitsRetentionDays
+	mu.Unlock()
 
 	data := struct {
 		Summaries        []VisitSummary
+		Plans            []plan
+		MemberTypeName   string
 		MonthLabel       string
 		MonthKey         string
 		Mode             string
+		Month            string // ?month= で指定した月
+		MaxMonth         string // 選べる一番新しい月（前月）
 		IsPrev           bool
 		IsCurrent        bool
+		IsArchived       bool // 明細を集計に移した月
 		ActivePage       string
+		Admin            *adminUser
+		CSRFToken        string
 		SuccessMsg       string
 		Q                string
 		MemberTypeFilter string
 		IsFiltered       bool
+		ExportFrom       string // 来店履歴エクスポートの既定の期間（表示中の月）
+		ExportTo         string
 	}{
 		Summaries:        summaries,
+		Plans:            plans.all(),
+		MemberTypeName:   plans.lookup(memberType).Name,
 		MonthLabel:       monthLabel,
 		MonthKey:         monthKey,
 		Mode:             mode,
+		Month:            month,
+		MaxMonth:         formatJSTMonth(relativeMonthStart(jstNow(), -1)),
 		IsPrev:           mode == "prev",
-		IsCurrent:        mode != "prev",
+		IsCurrent:        mode != "prev" && month == "",
+		IsArchived:       base.Before(visitsArchiveCutoff(jstNow(), retentionDays)),
 		ActivePage:       "visits",
+		Admin:            adminUserFromContext(r.Context()),
+		CSRFToken:        csrfTokenFromContext(r.Context()),
 		SuccessMsg:       successMsg,
 		Q:                q,
 		MemberTypeFilter: memberType,
 		IsFiltered:       isFiltered,
+		ExportFrom:       formatJSTDate(base),
+		ExportTo:         formatJSTDate(base.AddDate(0, 1, -1)),
 	}
 
 	if err := adminVisitsTmpl.Execute(w, data); err != nil {
@@ -584,13 +799,19 @@ func handleAdminVisitsToday(w http.ResponseWriter, r *http.Request) {
 
 	data := struct {
 		Summaries  []VisitSummary
+		Waitlist   []waitlistEntry
 		DateLabel  string
 		ActivePage string
+		Admin      *adminUser
+		CSRFToken  string
 		SuccessMsg string
 	}{
 		Summaries:  summaries,
+		Waitlist:   getWaitlistSnapshot(),
 		DateLabel:  dateLabel,
 		ActivePage: "today",
+		Admin:      adminUserFromContext(r.Context()),
+		CSRFToken:  csrfTokenFromContext(r.Context()),
 		SuccessMsg: successMsg,
 	}
 
@@ -599,6 +820,53 @@ func handleAdminVisitsToday(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// POST /admin/visits/checkout
+func handleAdminVisitCheckout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	lineUserID := r.FormValue("line_user_id")
+	if lineUserID == "" {
+		http.Error(w, "line_user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	count, err := adminCheckout(r, lineUserID)
+	if err != nil {
+		log.Println("admin checkout error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ADMIN] checkout: user=%s count_after=%d\n", lineUserID, count)
+
+	msg := "チェックアウトしました。"
+	http.Redirect(w, r, "/admin/visits/today?success_msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+// 管理者の操作でチェックアウトさせる。退館後の在館人数を返す。
+func adminCheckout(r *http.Request, lineUserID string) (int, error) {
+	wasInside := isCheckedIn(lineUserID)
+	count, err := removeCheckin(lineUserID, checkoutReasonAdmin)
+	if err != nil {
+		return 0, err
+	}
+	recordAuditLog(r, auditEntry{
+		Action:     auditActionVisitCheckout,
+		LineUserID: lineUserID,
+		Before:     map[string]bool{"inside": wasInside},
+		After:      map[string]bool{"inside": false},
+	})
+	return count, nil
+}
+
 // POST /admin/member/type
 func handleAdminUpdateMemberType(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -614,16 +882,20 @@ func handleAdminUpdateMemberType(w http.ResponseWriter, r *http.Request) {
 	lineUserID := r.FormValue("line_user_id")
 	newType := r.FormValue("member_type")
 
-	if lineUserID == "" || (newType != "general" && newType != "1day") {
+	if lineUserID == "" {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	// DB更新
-	_, err := db.Exec(
-		`UPDATE members SET member_type = ? WHERE line_user_id = ?`,
-		newType, lineUserID,
-	)
+	err := updateMemberType(r, lineUserID, newType)
+	if err == errPlanNotFound {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "member not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Println("update member_type error:", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
@@ -636,6 +908,39 @@ func handleAdminUpdateMemberType(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin/members", http.StatusSeeOther)
 }
 
+// 会員のプランを変える。プランが無ければ errPlanNotFound、会員が居なければ sql.ErrNoRows。
+func updateMemberType(r *http.Request, lineUserID, newType string) error {
+	if _, err := getPlan(newType); err != nil {
+		return err
+	}
+	return runAuditedTx(func(tx *sql.Tx) error {
+		return updateMemberTypeTx(tx, r, lineUserID, newType)
+	})
+}
+
+// updateMemberType のトランザクションの中身（プランの存在は呼び出し側で確かめる）
+func updateMemberTypeTx(tx *sql.Tx, r *http.Request, lineUserID, newType string) error {
+	var before string
+	if err := tx.QueryRow(
+		`SELECT IFNULL(member_type, `+defaultPlanCodeSQL+`) FROM members WHERE line_user_id = ?`,
+		lineUserID,
+	).Scan(&before); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`UPDATE members SET member_type = ? WHERE line_user_id = ?`,
+		newType, lineUserID,
+	); err != nil {
+		return err
+	}
+	return writeAuditLog(tx, r, auditEntry{
+		Action:     auditActionMemberType,
+		LineUserID: lineUserID,
+		Before:     map[string]string{"member_type": before},
+		After:      map[string]string{"member_type": newType},
+	})
+}
+
 // POST /admin/member/poster-id
 func handleAdminUpdatePosterID(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -656,21 +961,11 @@ func handleAdminUpdatePosterID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 表示名を取っておく（メッセージ用）
-	var displayName string
-	err := db.QueryRow(
-		`SELECT IFNULL(display_name, '') FROM members WHERE line_user_id = ?`,
-		lineUserID,
-	).Scan(&displayName)
-	if err != nil {
-		log.Println("select display_name error:", err)
+	displayName, err := updateMemberPosterID(r, lineUserID, posterID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "member not found", http.StatusNotFound)
+		return
 	}
-
-	// 空文字も許容（クリアしたい場合もあるので）
-	_, err = db.Exec(
-		`UPDATE members SET poster_id = ? WHERE line_user_id = ?`,
-		posterID, lineUserID,
-	)
 	if err != nil {
 		log.Println("update poster_id error:", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
@@ -698,12 +993,59 @@ func handleAdminUpdatePosterID(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
 }
 
+// 会員の PosterID を変える（空文字でクリア）。メッセージ用に表示名を返す。
+func updateMemberPosterID(r *http.Request, lineUserID, posterID string) (displayName string, err error) {
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		displayName, err = updateMemberPosterIDTx(tx, r, lineUserID, posterID)
+		return err
+	})
+	return displayName, err
+}
+
+// updateMemberPosterID のトランザクションの中身
+func updateMemberPosterIDTx(tx *sql.Tx, r *http.Request, lineUserID, posterID string) (displayName string, err error) {
+	var before string
+	if err := tx.QueryRow(
+		`SELECT IFNULL(display_name, ''), IFNULL(poster_id, '') FROM members WHERE line_user_id = ?`,
+		lineUserID,
+	).Scan(&displayName, &before); err != nil {
+		return "", err
+	}
+
+	// 空文字も許容（クリアしたい場合もあるので）
+	if _, err := tx.Exec(
+		`UPDATE members SET poster_id = ? WHERE line_user_id = ?`,
+		posterID, lineUserID,
+	); err != nil {
+		return "", err
+	}
+	return displayName, writeAuditLog(tx, r, auditEntry{
+		Action:     auditActionMemberPosterID,
+		LineUserID: lineUserID,
+		Before:     map[string]string{"poster_id": before},
+		After:      map[string]string{"poster_id": posterID},
+	})
+}
+
 // あるユーザーの「今月の来店履歴」を取得
 type VisitRecord struct {
-	ID          int
-	TimeStr     string
-	NeedPayment bool
-	Paid        bool
+	ID             int
+	TimeStr        string
+	NeedPayment    bool
+	Paid           bool
+	Payment        *payment // この来店に紐づく入金
+	TicketUsed     bool     // 回数券で払った
+	CheckoutStr    string   // 退館時刻（HH:MM）。未チェックアウトなら空
+	CheckoutReason string   // 終了方法の表示名
+	StayStr        string   // 滞在時間の表示名
+	Source         string   // どこからの来店か（表示名）。記録していない古い来店は空
+
+	// API 用の値。日時は DB の形式（JST "2006-01-02 15:04:05"）
+	VisitedAt          string
+	CheckedOutAt       string // 未チェックアウトなら空
+	CheckoutReasonCode string // checkoutReason* の値
+	StaySeconds        int    // 分からなければ 0
+	SourceCode         string // visitSource* の値
 }
 
 type VisitDetail struct {
@@ -711,13 +1053,25 @@ type VisitDetail struct {
 	PosterID    string
 	DisplayName string
 	FullName    string
+	LineLinked  bool // false ならスタッフ端末で受付する LINE なしの会員
 	MemberType  string
+	Plan        plan
 	MonthLabel  string
 	MonthKey    string
 	IsPrev      bool
 	ActivePage  string
+	Admin       *adminUser
+	CSRFToken   string
 	Count       int
+	AverageStay string // 滞在時間が分かる来店の平均。無ければ空
 	Visits      []VisitRecord
+	Rollup      *visitRollup // 明細を集計に移した月なら、その集計
+
+	Statement   memberStatement
+	Methods     []paymentMethodOption
+	TicketPacks []ticketPack
+	Products    []ticketProduct // 販売中の回数券
+	SuccessMsg  string
 }
 
 // ym: "2025-11" のような "YYYY-MM" 形式。空文字なら「今月」
@@ -742,11 +1096,17 @@ func getUserMonthlyVisitDetail(lineUserID, ym string) (*VisitDetail, error) {
 	prev := relativeMonthStart(jstNow(), -1)
 	isPrev := base.Year() == prev.Year() && base.Month() == prev.Month()
 
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return nil, err
+	}
+
 	detail := &VisitDetail{
 		LineUserID: lineUserID,
 		MonthLabel: monthLabel,
 		MonthKey:   monthKey,
 		IsPrev:     isPrev,
+		LineLinked: true,
 		ActivePage: "visits",
 	}
 
@@ -755,10 +1115,18 @@ func getUserMonthlyVisitDetail(lineUserID, ym string) (*VisitDetail, error) {
           v.id,
           IFNULL(m.display_name, ''),
           IFNULL(m.full_name, ''),
-          IFNULL(m.member_type, 'general'),
+          IFNULL(m.line_linked, 1),
+          IFNULL(m.member_type, `+defaultPlanCodeSQL+`),
           IFNULL(m.poster_id, ''), 
 	          strftime('%Y/%m/%d %H:%M', v.visited_at) AS visited_local,
-          IFNULL(v.paid, 0)
+          IFNULL(v.paid, 0),
+          IFNULL(strftime('%H:%M', v.checked_out_at), ''),
+          IFNULL(v.checkout_reason, ''),
+          v.duration_seconds,
+          v.ticket_pack_id IS NOT NULL,
+          strftime('%Y-%m-%d %H:%M:%S', v.visited_at),
+          IFNULL(strftime('%Y-%m-%d %H:%M:%S', v.checked_out_at), ''),
+          IFNULL(v.source, '')
         FROM visits v
         LEFT JOIN members m ON m.line_user_id = v.line_user_id
         WHERE v.line_user_id = ?
@@ -771,17 +1139,29 @@ func getUserMonthlyVisitDetail(lineUserID, ym string) (*VisitDetail, error) {
 	defer rows.Close()
 
 	i := 0
+	ticketVisits := 0
+	measuredCount := 0
+	measuredTotal := 0
 	for rows.Next() {
 		var (
-			id           int
-			name         string
-			fullName     string
-			memberType   string
-			posterID     string
-			visitedAtStr string
-			paidInt      int
+			id             int
+			name           string
+			fullName       string
+			lineLinked     bool
+			memberType     string
+			posterID       string
+			visitedAtStr   string
+			paidInt        int
+			checkoutStr    string
+			checkoutReason string
+			duration       sql.NullInt64
+			ticketUsed     bool
+			visitedAt      string
+			checkedOutAt   string
+			source         string
 		)
-		if err := rows.Scan(&id, &name, &fullName, &memberType, &posterID, &visitedAtStr, &paidInt); err != nil {
+		if err := rows.Scan(&id, &name, &fullName, &lineLinked, &memberType, &posterID, &visitedAtStr, &paidInt,
+			&checkoutStr, &checkoutReason, &duration, &ticketUsed, &visitedAt, &checkedOutAt, &source); err != nil {
 			return nil, err
 		}
 
@@ -789,15 +1169,39 @@ func getUserMonthlyVisitDetail(lineUserID, ym string) (*VisitDetail, error) {
 		if detail.DisplayName == "" {
 			detail.DisplayName = name
 			detail.FullName = fullName
+			detail.LineLinked = lineLinked
 			detail.MemberType = memberType
+			detail.Plan = plans.lookup(memberType)
 			detail.PosterID = posterID
 		}
 
 		rec := VisitRecord{
-			ID:          id,
-			TimeStr:     visitedAtStr,
-			Paid:        paidInt != 0,
-			NeedPayment: (memberType == "1day" && i >= 5),
+			ID:                 id,
+			TimeStr:            visitedAtStr,
+			Paid:               paidInt != 0,
+			NeedPayment:        detail.Plan.isBillableVisit(i),
+			TicketUsed:         ticketUsed,
+			CheckoutStr:        checkoutStr,
+			CheckoutReason:     checkoutReasonLabel(checkoutReason),
+			StayStr:            "-",
+			VisitedAt:          visitedAt,
+			CheckedOutAt:       checkedOutAt,
+			CheckoutReasonCode: checkoutReason,
+			SourceCode:         source,
+		}
+		if source != "" {
+			rec.Source = visitSourceLabel(source)
+		}
+		if duration.Valid {
+			rec.StaySeconds = int(duration.Int64)
+			rec.StayStr = formatStayDuration(rec.StaySeconds)
+			if isMeasuredCheckoutReason(checkoutReason) {
+				measuredCount++
+				measuredTotal += int(duration.Int64)
+			}
+		}
+		if ticketUsed {
+			ticketVisits++
 		}
 		detail.Visits = append(detail.Visits, rec)
 	}
@@ -806,6 +1210,60 @@ func getUserMonthlyVisitDetail(lineUserID, ym string) (*VisitDetail, error) {
 	}
 
 	detail.Count = len(detail.Visits)
+	if measuredCount > 0 {
+		detail.AverageStay = formatStayDuration(measuredTotal / measuredCount)
+	}
+
+	// 来店が無い月でも月額の明細は出す
+	if detail.Count == 0 {
+		err := db.QueryRow(`
+SELECT IFNULL(display_name, ''), IFNULL(full_name, ''), line_linked, IFNULL(member_type, `+defaultPlanCodeSQL+`), IFNULL(poster_id, '')
+  FROM members
+ WHERE line_user_id = ?`, lineUserID).Scan(&detail.DisplayName, &detail.FullName, &detail.LineLinked, &detail.MemberType, &detail.PosterID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil {
+			detail.Plan = plans.lookup(detail.MemberType)
+		}
+
+		// 明細を集計に移した月は、回数と移した時点のプランで明細を出す
+		rollup, err := getVisitRollup(db, lineUserID, monthKey)
+		if err != nil {
+			return nil, err
+		}
+		if rollup != nil {
+			detail.Rollup = rollup
+			detail.Count = rollup.VisitCount
+			detail.MemberType = rollup.MemberType
+			detail.Plan = plans.lookup(rollup.MemberType)
+			ticketVisits = rollup.TicketCount
+			if rollup.StayCount > 0 {
+				detail.AverageStay = formatStayDuration(rollup.AverageStaySeconds())
+			}
+		}
+	}
+
+	payments, err := listMemberPayments(lineUserID, monthKey)
+	if err != nil {
+		return nil, err
+	}
+	byVisit := make(map[int64]payment, len(payments))
+	received := 0
+	for _, p := range payments {
+		received += p.Amount
+		if p.VisitID != 0 {
+			byVisit[p.VisitID] = p
+		}
+	}
+	for i := range detail.Visits {
+		if p, ok := byVisit[int64(detail.Visits[i].ID)]; ok {
+			detail.Visits[i].Payment = &p
+		}
+	}
+	detail.Statement = newMemberStatement(detail.Plan, detail.Count, ticketVisits, received)
+	detail.Statement.Payments = payments
+	detail.Methods = paymentMethodOptions
 	return detail, nil
 }
 
@@ -825,46 +1283,94 @@ func handleAdminVisitDetail(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
+	if detail.TicketPacks, err = listMemberTicketPacks(lineUserID); err != nil {
+		log.Println("listMemberTicketPacks error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if detail.Products, err = listTicketProducts(true); err != nil {
+		log.Println("listTicketProducts error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	detail.Admin = adminUserFromContext(r.Context())
+	detail.CSRFToken = csrfTokenFromContext(r.Context())
+	detail.SuccessMsg = r.URL.Query().Get("success_msg")
 
 	if err := adminVisitDetailTmpl.Execute(w, detail); err != nil {
 		log.Println("template execute error:", err)
 	}
 }
 
-// 指定月(ym="YYYY-MM") の threshold回目以降が全て paid=1 かどうか
-func isAllDueVisitsPaid(lineUserID, ym string, threshold int) (bool, error) {
-	rows, err := db.Query(`
-SELECT IFNULL(v.paid, 0)
-FROM visits v
-WHERE v.line_user_id = ?
-	  AND strftime('%Y-%m', v.visited_at) = ?
-ORDER BY v.visited_at ASC;
-`, lineUserID, ym)
-	if err != nil {
-		return false, err
+// POST /admin/visits/pay
+//
+// 入金を台帳に記録する。visit_id があれば、その来店（追加1回分）の支払いとして扱う。
+func handleAdminVisitPay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	defer rows.Close()
 
-	i := 0
-	for rows.Next() {
-		i++
-		var paidInt int
-		if err := rows.Scan(&paidInt); err != nil {
-			return false, err
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	lineUserID := r.FormValue("line_user_id")
+	month := r.FormValue("month")
+	amount, err := strconv.Atoi(strings.TrimSpace(r.FormValue("amount")))
+	if err != nil || amount < 0 || lineUserID == "" || !isValidPaymentMethod(r.FormValue("method")) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	p := payment{
+		LineUserID: lineUserID,
+		Month:      month,
+		Amount:     amount,
+		Method:     r.FormValue("method"),
+		Note:       strings.TrimSpace(r.FormValue("note")),
+	}
+	if v := r.FormValue("visit_id"); v != "" {
+		p.VisitID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
 		}
-		// threshold回目以降で未払いが1件でもあれば NG
-		if i >= threshold && paidInt == 0 {
-			return false, nil
+	}
+	if p.VisitID == 0 {
+		if _, err := time.ParseInLocation("2006-01", month, jst); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
 		}
 	}
-	if err := rows.Err(); err != nil {
-		return false, err
+
+	p, err = recordPayment(r, p)
+	if err == errMemberNotFound {
+		http.Error(w, "member not found", http.StatusNotFound)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "visit not found", http.StatusNotFound)
+		return
+	}
+	if err == errVisitAlreadyPaid {
+		http.Error(w, "visit already paid", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("insert payment error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
-	return true, nil
+
+	log.Printf("[ADMIN] add payment: id=%d user=%s visit=%d amount=%d method=%s\n",
+		p.ID, lineUserID, p.VisitID, p.Amount, p.Method)
+	redirectVisitDetail(w, r, lineUserID, p.Month, fmt.Sprintf("%d円（%s）の入金を記録しました。", p.Amount, p.MethodLabel()))
 }
 
-// POST /admin/visits/pay
-func handleAdminVisitPay(w http.ResponseWriter, r *http.Request) {
+// POST /admin/payments/delete
+func handleAdminPaymentDelete(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -875,35 +1381,115 @@ func handleAdminVisitPay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	visitID := r.FormValue("visit_id")
-	lineUserID := r.FormValue("line_user_id")
-	month := r.FormValue("month")
-
-	if visitID == "" || lineUserID == "" {
+	paymentID, err := strconv.ParseInt(r.FormValue("payment_id"), 10, 64)
+	if err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	// チェックされていれば "1"、外されていれば ""（そもそもキーが来ない）
-	paid := 0
-	if r.FormValue("paid") == "1" {
-		paid = 1
+	before, err := cancelPayment(r, paymentID)
+	if err == errPaymentNotFound {
+		http.Error(w, "payment not found", http.StatusNotFound)
+		return
 	}
-
-	_, err := db.Exec(`UPDATE visits SET paid = ? WHERE id = ?`, paid, visitID)
 	if err != nil {
-		log.Println("update paid error:", err)
+		log.Println("delete payment error:", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// 詳細画面に戻す
-	redirectTo := "/admin/visits/user?line_user_id=" + url.QueryEscape(lineUserID)
-	if month != "" {
-		redirectTo += "&month=" + url.QueryEscape(month)
+	log.Printf("[ADMIN] delete payment: id=%d user=%s amount=%d\n", before.ID, before.LineUserID, before.Amount)
+	redirectVisitDetail(w, r, before.LineUserID, before.Month, fmt.Sprintf("%d円（%s）の入金を取り消しました。", before.Amount, before.MethodLabel()))
+}
+
+// 入金を記録する。来店に紐づく入金は来店の月に計上する（別会員の来店なら sql.ErrNoRows）。
+func recordPayment(r *http.Request, p payment) (payment, error) {
+	admin := adminUserFromContext(r.Context())
+	err := runAuditedTx(func(tx *sql.Tx) error {
+		// 打ち間違えた LINE ID の入金は、明細にも会員ページにも出ないので受け付けない
+		var exists int
+		err := tx.QueryRow(`SELECT 1 FROM members WHERE line_user_id = ?`, p.LineUserID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return errMemberNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if p.VisitID != 0 {
+			var owner string
+			if err := tx.QueryRow(
+				`SELECT line_user_id, strftime('%Y-%m', visited_at) FROM visits WHERE id = ?`,
+				p.VisitID,
+			).Scan(&owner, &p.Month); err != nil {
+				return err
+			}
+			if owner != p.LineUserID {
+				return sql.ErrNoRows
+			}
+		}
+		id, err := insertPayment(tx, p, admin.ID)
+		if err != nil {
+			return err
+		}
+		p.ID = id
+		p.ReceivedBy = admin.Username
+		if err := tx.QueryRow(
+			`SELECT strftime('%Y/%m/%d %H:%M', received_at) FROM payments WHERE id = ?`, id,
+		).Scan(&p.ReceivedAt); err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{
+			Action:     auditActionPaymentAdd,
+			LineUserID: p.LineUserID,
+			VisitID:    p.VisitID,
+			After:      paymentAuditValue(p),
+		})
+	})
+	return p, err
+}
+
+// 入金を取り消す。取り消した入金を返す。
+func cancelPayment(r *http.Request, paymentID int64) (payment, error) {
+	var before payment
+	err := runAuditedTx(func(tx *sql.Tx) error {
+		var err error
+		before, err = deletePayment(tx, paymentID)
+		if err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{
+			Action:     auditActionPaymentDelete,
+			LineUserID: before.LineUserID,
+			VisitID:    before.VisitID,
+			Before:     paymentAuditValue(before),
+		})
+	})
+	return before, err
+}
+
+// 監査ログに残す形
+func paymentAuditValue(p payment) map[string]interface{} {
+	return map[string]interface{}{
+		"payment_id": p.ID,
+		"month":      p.Month,
+		"amount":     p.Amount,
+		"method":     p.Method,
+		"note":       p.Note,
 	}
+}
 
-	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+// 来店詳細画面に戻す
+func redirectVisitDetail(w http.ResponseWriter, r *http.Request, lineUserID, month, successMsg string) {
+	q := url.Values{}
+	q.Set("line_user_id", lineUserID)
+	if month != "" {
+		q.Set("month", month)
+	}
+	if successMsg != "" {
+		q.Set("success_msg", successMsg)
+	}
+	http.Redirect(w, r, "/admin/visits/user?"+q.Encode(), http.StatusSeeOther)
 }
 
 // 会員一覧 1行分
@@ -911,7 +1497,10 @@ type MemberSummary struct {
 	LineUserID   string
 	DisplayName  string
 	FullName     string
+	FullNameKana string
+	LineLinked   bool // false なら LINE なしの会員（LineUserID は内部 ID）
 	MemberType   string
+	Plan         plan
 	PosterID     string
 	MonthlyCount int
 }
@@ -920,12 +1509,19 @@ var adminMembersTmpl = mustParseAdminTemplate("admin_members.html")
 
 // 会員一覧 + 月間の来店回数（フィルタ付き）
 func getMemberSummaries(filterText, filterType string) ([]MemberSummary, error) {
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return nil, err
+	}
+
 	baseSQL := `
 SELECT
   m.line_user_id,
   IFNULL(m.display_name, ''),
   IFNULL(m.full_name, ''),
-  IFNULL(m.member_type, 'general'),
+  IFNULL(m.full_name_kana, ''),
+  m.line_linked,
+  IFNULL(m.member_type, ` + defaultPlanCodeSQL + `),
   IFNULL(m.poster_id, ''),
   SUM(
     CASE
@@ -938,26 +1534,8 @@ SELECT
 FROM members m
 LEFT JOIN visits v ON v.line_user_id = m.line_user_id
 `
-	var where []string
-	args := []interface{}{formatJSTMonth(jstNow())}
-
-	// 会員種別フィルタ
-	if filterType == "general" || filterType == "1day" {
-		where = append(where, "m.member_type = ?")
-		args = append(args, filterType)
-	}
-
-	// キーワード（display_name / full_name / poster_id / line_user_id）
-	if filterText != "" {
-		like := "%" + filterText + "%"
-		where = append(where,
-			"(IFNULL(m.display_name,'') LIKE ? OR "+
-				"IFNULL(m.full_name,'') LIKE ? OR "+
-				"IFNULL(m.poster_id,'') LIKE ? OR "+
-				"m.line_user_id LIKE ?)",
-		)
-		args = append(args, like, like, like, like)
-	}
+	where, filterArgs := memberFilterConditions(plans, filterText, filterType, "m.line_user_id")
+	args := append([]interface{}{formatJSTMonth(jstNow())}, filterArgs...)
 
 	if len(where) > 0 {
 		baseSQL += " WHERE " + strings.Join(where, " AND ")
@@ -968,6 +1546,8 @@ GROUP BY
   m.line_user_id,
   m.display_name,
   m.full_name,
+  m.full_name_kana,
+  m.line_linked,
   m.member_type,
   m.poster_id
 ORDER BY
@@ -987,12 +1567,15 @@ ORDER BY
 			&s.LineUserID,
 			&s.DisplayName,
 			&s.FullName,
+			&s.FullNameKana,
+			&s.LineLinked,
 			&s.MemberType,
 			&s.PosterID,
 			&s.MonthlyCount,
 		); err != nil {
 			return nil, err
 		}
+		s.Plan = plans.lookup(s.MemberType)
 		list = append(list, s)
 	}
 	return list, rows.Err()
@@ -1010,22 +1593,42 @@ func handleAdminMembers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		log.Println("loadPlanCatalog error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !plans.has(memberType) {
+		memberType = ""
+	}
+
 	successMsg := r.URL.Query().Get("success_msg")
+	errorMsg := r.URL.Query().Get("error_msg")
 
-	isFiltered := strings.TrimSpace(q) != "" ||
-		memberType == "general" || memberType == "1day"
+	isFiltered := strings.TrimSpace(q) != "" || memberType != ""
 
 	data := struct {
 		Members          []MemberSummary
+		Plans            []plan
+		MemberTypeName   string
 		ActivePage       string
+		Admin            *adminUser
+		CSRFToken        string
 		SuccessMsg       string
+		ErrorMsg         string
 		Q                string
 		MemberTypeFilter string
 		IsFiltered       bool
 	}{
 		Members:          members,
+		Plans:            plans.all(),
+		MemberTypeName:   plans.lookup(memberType).Name,
 		ActivePage:       "members",
+		Admin:            adminUserFromContext(r.Context()),
+		CSRFToken:        csrfTokenFromContext(r.Context()),
 		SuccessMsg:       successMsg,
+		ErrorMsg:         errorMsg,
 		Q:                q,
 		MemberTypeFilter: memberType,
 		IsFiltered:       isFiltered,
@@ -1055,19 +1658,7 @@ func handleAdminVisitAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 本日分の来店を1件追加（支払い済みフラグは 0）
-	now := jstNow()
-	visitedAt := formatJSTDateTime(now)
-
-	log.Printf("[ADMIN] add manual visit: user=%s at %s\n", lineUserID, visitedAt)
-
-	_, err := db.Exec(
-		`INSERT INTO visits (line_user_id, visited_at, paid)
-			VALUES (?, ?, 0)`,
-		lineUserID,
-		visitedAt,
-	)
-	if err != nil {
+	if _, err := addManualVisit(r, lineUserID); err != nil {
 		log.Println("insert visit error:", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
@@ -1078,6 +1669,41 @@ func handleAdminVisitAdd(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
 }
 
+// 本日分の来店を1件追加する（支払い済みフラグは 0）
+func addManualVisit(r *http.Request, lineUserID string) (visitID int64, err error) {
+	visitedAt := formatJSTDateTime(jstNow())
+	source := visitSourceAdmin
+	if apiTokenFromContext(r.Context()) != nil {
+		source = visitSourceAPI
+	}
+
+	log.Printf("[ADMIN] add manual visit: user=%s at %s\n", lineUserID, visitedAt)
+
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			`INSERT INTO visits (line_user_id, visited_at, paid, source)
+			VALUES (?, ?, 0, ?)`,
+			lineUserID,
+			visitedAt,
+			source,
+		)
+		if err != nil {
+			return err
+		}
+		visitID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{
+			Action:     auditActionVisitAdd,
+			LineUserID: lineUserID,
+			VisitID:    visitID,
+			After:      map[string]interface{}{"visited_at": visitedAt, "paid": 0, "source": source},
+		})
+	})
+	return visitID, err
+}
+
 // POST /admin/visits/delete
 func handleAdminVisitDelete(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -1090,23 +1716,69 @@ func handleAdminVisitDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	visitID := r.FormValue("visit_id")
+	visitID, err := strconv.ParseInt(r.FormValue("visit_id"), 10, 64)
 	lineUserID := r.FormValue("line_user_id")
 	month := r.FormValue("month")
 
-	if visitID == "" || lineUserID == "" {
+	if err != nil || lineUserID == "" {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	// その visit だけ削除
-	_, err := db.Exec(`DELETE FROM visits WHERE id = ?`, visitID)
+	// その visit だけ削除（削除前の内容を監査ログに残す）
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		var (
+			owner          string
+			visitedAt      string
+			paid           int
+			checkedOutAt   sql.NullString
+			checkoutReason sql.NullString
+		)
+		if err := tx.QueryRow(
+			`SELECT line_user_id,
+			        strftime('%Y-%m-%d %H:%M:%S', visited_at),
+			        IFNULL(paid, 0),
+			        strftime('%Y-%m-%d %H:%M:%S', checked_out_at),
+			        checkout_reason
+			   FROM visits
+			  WHERE id = ?`,
+			visitID,
+		).Scan(&owner, &visitedAt, &paid, &checkedOutAt, &checkoutReason); err != nil {
+			return err
+		}
+		// 回数券を使った来店なら1回分戻す
+		ticketPackID, err := restoreTicketForVisit(tx, visitID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM visits WHERE id = ?`, visitID); err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{
+			Action:     auditActionVisitDelete,
+			LineUserID: owner,
+			VisitID:    visitID,
+			Before: map[string]interface{}{
+				"visited_at":      visitedAt,
+				"paid":            paid,
+				"checked_out_at":  checkedOutAt.String,
+				"checkout_reason": checkoutReason.String,
+				"ticket_pack_id":  ticketPackID,
+			},
+		})
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "visit not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Println("delete visit error:", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	log.Printf("[ADMIN] delete visit: visit=%d user=%s\n", visitID, lineUserID)
+
 	redirectTo := "/admin/visits/user?line_user_id=" + url.QueryEscape(lineUserID)
 	if month != "" {
 		redirectTo += "&month=" + url.QueryEscape(month)
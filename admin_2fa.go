@@ -0,0 +1,270 @@
+// admin_2fa.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// 管理者ごとの2段階認証（TOTP）とリカバリーコード。
+// totp_secret があって totp_enabled_at が NULL の間は「登録中」（QR を読み込んで確認コード待ち）。
+
+const (
+	recoveryCodeCount = 10
+	// ログイン時、パスワードの後に2段階目を入力するまでの猶予
+	adminMFAPendingTTL = 5 * time.Minute
+
+	settingKeyAdminRequire2FA = "admin_require_2fa"
+)
+
+type adminTOTPState struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func getAdminTOTPState(adminUserID int64) (adminTOTPState, error) {
+	var (
+		st     adminTOTPState
+		secret sql.NullString
+	)
+	err := db.QueryRow(
+		`SELECT totp_secret, totp_enabled_at IS NOT NULL, totp_last_step
+           FROM admin_users
+          WHERE id = ?`,
+		adminUserID,
+	).Scan(&secret, &st.Enabled, &st.LastStep)
+	if err == sql.ErrNoRows {
+		return st, errAdminUserNotFound
+	}
+	st.Secret = secret.String
+	return st, err
+}
+
+// 登録を始める（または登録中のシークレットを作り直す）。有効化済みなら何もしない。
+func startAdminTOTPEnrollment(adminUserID int64) (string, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		`UPDATE admin_users
+            SET totp_secret = ?, totp_last_step = 0
+          WHERE id = ? AND totp_enabled_at IS NULL`,
+		secret, adminUserID,
+	)
+	return secret, err
+}
+
+// 登録中のシークレットに対する確認コードが合えば有効化し、リカバリーコードを返す
+func confirmAdminTOTPEnrollment(adminUserID int64, code string) ([]string, bool, error) {
+	st, err := getAdminTOTPState(adminUserID)
+	if err != nil {
+		return nil, false, err
+	}
+	if st.Enabled || st.Secret == "" {
+		return nil, false, nil
+	}
+	step, ok := verifyTOTP(st.Secret, code, time.Now(), 0)
+	if !ok {
+		return nil, false, nil
+	}
+
+	if _, err := db.Exec(
+		`UPDATE admin_users
+            SET totp_enabled_at = ?, totp_last_step = ?
+          WHERE id = ?`,
+		formatJSTDateTime(jstNow()), step, adminUserID,
+	); err != nil {
+		return nil, false, err
+	}
+
+	codes, err := regenerateRecoveryCodes(adminUserID)
+	if err != nil {
+		return nil, false, err
+	}
+	return codes, true, nil
+}
+
+func disableAdminTOTP(adminUserID int64) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(
+		`UPDATE admin_users
+            SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+          WHERE id = ?`,
+		adminUserID,
+	); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM admin_recovery_codes WHERE admin_user_id = ?`, adminUserID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 2段階目の確認。TOTP のコードかリカバリーコードのどちらかが合えば true。
+// 使ったコードは二度と使えないようにする。
+func verifyAdminSecondFactor(adminUserID int64, code string) (ok, usedRecovery bool, err error) {
+	st, err := getAdminTOTPState(adminUserID)
+	if err != nil {
+		return false, false, err
+	}
+	if !st.Enabled {
+		return false, false, nil
+	}
+
+	if step, ok := verifyTOTP(st.Secret, code, time.Now(), st.LastStep); ok {
+		// 同時に同じコードが送られても片方しか通さない
+		res, err := db.Exec(
+			`UPDATE admin_users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`,
+			step, adminUserID, step,
+		)
+		if err != nil {
+			return false, false, err
+		}
+		n, err := res.RowsAffected()
+		return n == 1, false, err
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return false, false, nil
+	}
+	res, err := db.Exec(
+		`UPDATE admin_recovery_codes
+            SET used_at = ?
+          WHERE admin_user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		formatJSTDateTime(jstNow()), adminUserID, hashRecoveryCode(normalized),
+	)
+	if err != nil {
+		return false, false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, n == 1, err
+}
+
+// 古いリカバリーコードを捨てて新しく作る。平文を返すのはこのときだけ。
+func regenerateRecoveryCodes(adminUserID int64) (codes []string, err error) {
+	codes = make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(`DELETE FROM admin_recovery_codes WHERE admin_user_id = ?`, adminUserID); err != nil {
+		return nil, err
+	}
+	createdAt := formatJSTDateTime(jstNow())
+	for _, code := range codes {
+		if _, err = tx.Exec(
+			`INSERT INTO admin_recovery_codes(admin_user_id, code_hash, created_at)
+             VALUES(?, ?, ?)`,
+			adminUserID, hashRecoveryCode(normalizeRecoveryCode(code)), createdAt,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func countUnusedRecoveryCodes(adminUserID int64) (int, error) {
+	var n int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM admin_recovery_codes WHERE admin_user_id = ? AND used_at IS NULL`,
+		adminUserID,
+	).Scan(&n)
+	return n, err
+}
+
+// "abcde-fghij" 形式（紛らわしい文字を除いた英小文字と数字）
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// 1文字ずつ rand.Int で選ぶ（バイトの剰余だと先頭の文字が出やすくなる）
+func newRecoveryCode() (string, error) {
+	n := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	var sb strings.Builder
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			sb.WriteByte('-')
+		}
+		k, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(recoveryCodeAlphabet[k.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// 入力ゆれ（大文字・ハイフン・空白）をならす。形式が違えば空文字。
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code))
+	if len(code) != 10 {
+		return ""
+	}
+	return code
+}
+
+func hashRecoveryCode(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// オーナーが「全員に2段階認証を必須にする」を有効にしているか
+func isAdmin2FARequired() (bool, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM settings WHERE key = ?`, settingKeyAdminRequire2FA).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return value == "1", nil
+}
+
+func setAdmin2FARequired(required bool) error {
+	value := "0"
+	if required {
+		value = "1"
+	}
+	_, err := db.Exec(
+		`INSERT INTO settings(key, value, updated_at)
+         VALUES(?, ?, ?)
+         ON CONFLICT(key)
+         DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		settingKeyAdminRequire2FA, value, formatJSTDateTime(jstNow()),
+	)
+	return err
+}
@@ -0,0 +1,231 @@
+// admin_2fa_page.go
+package main
+
+import (
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"rsc.io/qr"
+)
+
+var admin2FATmpl = mustParseAdminTemplate("admin_2fa.html")
+
+// GET /admin/2fa
+// POST /admin/2fa
+//
+// 自分の2段階認証の設定。QR コードは外部サービスを使わずサーバーで PNG にして埋め込む。
+func handleAdmin2FA(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdmin2FA(w, r, admin2FAView{SuccessMsg: r.URL.Query().Get("success_msg")})
+	case http.MethodPost:
+		handleAdmin2FAPost(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST の結果として一度だけ出すもの
+type admin2FAView struct {
+	RecoveryCodes []string
+	SuccessMsg    string
+	ErrorMsg      string
+}
+
+func handleAdmin2FAPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	current := adminUserFromContext(r.Context())
+	action := r.FormValue("action")
+	code := r.FormValue("code")
+
+	switch action {
+	case "start":
+		if current.TOTPEnabled {
+			redirectAdmin2FA(w, r, "既に設定済みです。")
+			return
+		}
+		if _, err := startAdminTOTPEnrollment(current.ID); err != nil {
+			log.Println("startAdminTOTPEnrollment error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/admin/2fa", http.StatusSeeOther)
+
+	case "confirm":
+		codes, ok, err := confirmAdminTOTPEnrollment(current.ID, code)
+		if err != nil {
+			log.Println("confirmAdminTOTPEnrollment error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			renderAdmin2FA(w, r, admin2FAView{ErrorMsg: "確認コードが正しくありません。端末の時刻が合っているかも確かめてください。"})
+			return
+		}
+		recordAuditLog(r, auditEntry{
+			Action: auditActionAdmin2FA,
+			After:  map[string]string{"username": current.Username, "change": "enable"},
+		})
+		log.Printf("[ADMIN] enable 2fa username=%s\n", current.Username)
+
+		current.TOTPEnabled = true
+		renderAdmin2FA(w, r, admin2FAView{
+			RecoveryCodes: codes,
+			SuccessMsg:    "2段階認証を有効にしました。",
+		})
+
+	case "disable", "regenerate":
+		if !current.TOTPEnabled {
+			redirectAdmin2FA(w, r, "2段階認証は設定されていません。")
+			return
+		}
+		if action == "disable" {
+			required, err := isAdmin2FARequired()
+			if err != nil {
+				log.Println("isAdmin2FARequired error:", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			if required {
+				renderAdmin2FA(w, r, admin2FAView{ErrorMsg: "2段階認証が必須になっているため、無効にできません。"})
+				return
+			}
+		}
+
+		// 本人の操作であることをコードで確かめる
+		ok, _, err := verifyAdminSecondFactor(current.ID, code)
+		if err != nil {
+			log.Println("verifyAdminSecondFactor error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			fields := eventFieldsFromRequest(r)
+			fields["admin_user"] = current.Username
+			fields["action"] = action
+			appLog.warn("admin_2fa_failed", fields)
+			renderAdmin2FA(w, r, admin2FAView{ErrorMsg: "確認コードが正しくありません。"})
+			return
+		}
+
+		if action == "disable" {
+			if err := disableAdminTOTP(current.ID); err != nil {
+				log.Println("disableAdminTOTP error:", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			recordAuditLog(r, auditEntry{
+				Action: auditActionAdmin2FA,
+				After:  map[string]string{"username": current.Username, "change": "disable"},
+			})
+			log.Printf("[ADMIN] disable 2fa username=%s\n", current.Username)
+			redirectAdmin2FA(w, r, "2段階認証を無効にしました。")
+			return
+		}
+
+		codes, err := regenerateRecoveryCodes(current.ID)
+		if err != nil {
+			log.Println("regenerateRecoveryCodes error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		recordAuditLog(r, auditEntry{
+			Action: auditActionAdmin2FA,
+			After:  map[string]string{"username": current.Username, "change": "regenerate_recovery_codes"},
+		})
+		log.Printf("[ADMIN] regenerate recovery codes username=%s\n", current.Username)
+		renderAdmin2FA(w, r, admin2FAView{
+			RecoveryCodes: codes,
+			SuccessMsg:    "リカバリーコードを作り直しました。以前のコードは使えなくなります。",
+		})
+
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+func redirectAdmin2FA(w http.ResponseWriter, r *http.Request, successMsg string) {
+	http.Redirect(w, r, "/admin/2fa?success_msg="+url.QueryEscape(successMsg), http.StatusSeeOther)
+}
+
+func renderAdmin2FA(w http.ResponseWriter, r *http.Request, view admin2FAView) {
+	current := adminUserFromContext(r.Context())
+
+	state, err := getAdminTOTPState(current.ID)
+	if err != nil {
+		log.Println("getAdminTOTPState error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	required, err := isAdmin2FARequired()
+	if err != nil {
+		log.Println("isAdmin2FARequired error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		recoveryLeft int
+		enrolling    bool
+		secret       string
+		qrImage      template.URL
+	)
+	if state.Enabled {
+		recoveryLeft, err = countUnusedRecoveryCodes(current.ID)
+		if err != nil {
+			log.Println("countUnusedRecoveryCodes error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	} else if state.Secret != "" {
+		// 登録中だけシークレットを見せる（QR を読めない端末では手入力する）
+		enrolling = true
+		secret = state.Secret
+		png, err := qr.Encode(totpProvisioningURI(current.Username, state.Secret), qr.M)
+		if err != nil {
+			log.Println("qr encode error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		qrImage = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png.PNG()))
+	}
+
+	data := struct {
+		Enabled       bool
+		Required      bool
+		Enrolling     bool
+		Secret        string
+		QRImage       template.URL
+		RecoveryLeft  int
+		RecoveryCodes []string
+		ActivePage    string
+		Admin         *adminUser
+		CSRFToken     string
+		SuccessMsg    string
+		ErrorMsg      string
+	}{
+		Enabled:       state.Enabled,
+		Required:      required,
+		Enrolling:     enrolling,
+		Secret:        secret,
+		QRImage:       qrImage,
+		RecoveryLeft:  recoveryLeft,
+		RecoveryCodes: view.RecoveryCodes,
+		ActivePage:    "2fa",
+		Admin:         current,
+		CSRFToken:     csrfTokenFromContext(r.Context()),
+		SuccessMsg:    view.SuccessMsg,
+		ErrorMsg:      view.ErrorMsg,
+	}
+
+	if err := admin2FATmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
@@ -0,0 +1,177 @@
+// admin_api_tokens.go
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var adminAPITokensTmpl = mustParseAdminTemplate("admin_api_tokens.html")
+
+// 発行時に選べる有効期限（日）。0 は無期限
+var apiTokenExpiryOptions = []int{30, 90, 365, 0}
+
+// GET  /admin/api-tokens
+// POST /admin/api-tokens  action=create|revoke
+func handleAdminAPITokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminAPITokens(w, r, "", r.URL.Query().Get("success_msg"), "")
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("action") {
+		case "create":
+			handleAdminAPITokenCreate(w, r)
+		case "revoke":
+			handleAdminAPITokenRevoke(w, r)
+		default:
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// newToken は発行した直後だけ画面に出す生のトークン
+func renderAdminAPITokens(w http.ResponseWriter, r *http.Request, errorMsg, successMsg, newToken string) {
+	tokens, err := listAPITokens()
+	if err != nil {
+		log.Println("listAPITokens error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Tokens        []apiToken
+		ScopeOptions  []apiScopeOption
+		ExpiryOptions []int
+		NewToken      string
+		ActivePage    string
+		Admin         *adminUser
+		CSRFToken     string
+		SuccessMsg    string
+		ErrorMsg      string
+	}{
+		Tokens:        tokens,
+		ScopeOptions:  apiScopeOptions,
+		ExpiryOptions: apiTokenExpiryOptions,
+		NewToken:      newToken,
+		ActivePage:    "api_tokens",
+		Admin:         adminUserFromContext(r.Context()),
+		CSRFToken:     csrfTokenFromContext(r.Context()),
+		SuccessMsg:    successMsg,
+		ErrorMsg:      errorMsg,
+	}
+
+	if err := adminAPITokensTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
+
+func apiTokenAuditValue(t *apiToken) map[string]interface{} {
+	return map[string]interface{}{
+		"api_token_id": t.ID,
+		"name":         t.Name,
+		"prefix":       t.Prefix,
+		"scopes":       t.ScopesLabel(),
+		"expires_at":   t.ExpiresAt,
+	}
+}
+
+func handleAdminAPITokenCreate(w http.ResponseWriter, r *http.Request) {
+	admin := adminUserFromContext(r.Context())
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		renderAdminAPITokens(w, r, "名前を入力してください。", "", "")
+		return
+	}
+
+	var scopes []apiScope
+	for _, v := range r.Form["scopes"] {
+		if !isValidAPIScope(v) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		s := apiScope(v)
+		// 自分に無い権限のトークンは作れない
+		if !admin.Can(s.permission()) {
+			renderAdminAPITokens(w, r, "あなたの権限では「"+v+"」のトークンは発行できません。", "", "")
+			return
+		}
+		scopes = append(scopes, s)
+	}
+	if len(scopes) == 0 {
+		renderAdminAPITokens(w, r, "権限を1つ以上選んでください。", "", "")
+		return
+	}
+
+	days, err := strconv.Atoi(r.FormValue("expires_days"))
+	if err != nil || days < 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var raw string
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		var (
+			t   *apiToken
+			err error
+		)
+		raw, t, err = createAPIToken(tx, name, scopes, admin.ID, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{Action: auditActionAPITokenCreate, After: apiTokenAuditValue(t)})
+	})
+	if err != nil {
+		log.Println("create api token error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ADMIN] create api token: name=%s by=%s\n", name, admin.Username)
+	// 生のトークンはこの画面でしか見られないので、リダイレクトせずにそのまま出す
+	renderAdminAPITokens(w, r, "", "APIトークン「"+name+"」を発行しました。", raw)
+}
+
+func handleAdminAPITokenRevoke(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.FormValue("token_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var name string
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		before, err := getAPIToken(id)
+		if err != nil {
+			return err
+		}
+		name = before.Name
+		if err := revokeAPIToken(tx, id); err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{Action: auditActionAPITokenRevoke, Before: apiTokenAuditValue(before)})
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "api token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("revoke api token error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ADMIN] revoke api token: id=%d name=%s\n", id, name)
+	http.Redirect(w, r, "/admin/api-tokens?success_msg="+url.QueryEscape("APIトークン「"+name+"」を取り消しました。"), http.StatusSeeOther)
+}
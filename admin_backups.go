@@ -0,0 +1,75 @@
+// admin_backups.go
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+)
+
+var adminBackupsTmpl = mustParseAdminTemplate("admin_backups.html")
+
+// GET  /admin/backups
+// POST /admin/backups  （今すぐバックアップを取る）
+func handleAdminBackups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminBackups(w, r, "", r.URL.Query().Get("success_msg"))
+	case http.MethodPost:
+		path, err := backups.run("manual")
+		if err == errBackupRunning {
+			renderAdminBackups(w, r, "バックアップを取っている途中です。しばらくしてから画面を更新してください。", "")
+			return
+		}
+		if err != nil {
+			log.Println("backup error:", err)
+			renderAdminBackups(w, r, "バックアップに失敗しました: "+err.Error(), "")
+			return
+		}
+
+		recordAuditLog(r, auditEntry{
+			Action: auditActionBackupRun,
+			After:  map[string]interface{}{"file": filepath.Base(path)},
+		})
+		log.Printf("[ADMIN] backup: %s\n", path)
+		http.Redirect(w, r, "/admin/backups?success_msg="+url.QueryEscape("バックアップを取りました（"+filepath.Base(path)+"）。"), http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func renderAdminBackups(w http.ResponseWriter, r *http.Request, errorMsg, successMsg string) {
+	files, err := listBackupFiles(backups.cfg.Dir)
+	if err != nil {
+		log.Println("listBackupFiles error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Config        backupConfig
+		IntervalHours int
+		Status        backupStatus
+		Files         []backupFile
+		ActivePage    string
+		Admin         *adminUser
+		CSRFToken     string
+		SuccessMsg    string
+		ErrorMsg      string
+	}{
+		Config:        backups.cfg,
+		IntervalHours: int(backups.cfg.Interval.Hours()),
+		Status:        backups.snapshot(),
+		Files:         files,
+		ActivePage:    "backups",
+		Admin:         adminUserFromContext(r.Context()),
+		CSRFToken:     csrfTokenFromContext(r.Context()),
+		SuccessMsg:    successMsg,
+		ErrorMsg:      errorMsg,
+	}
+
+	if err := adminBackupsTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
@@ -0,0 +1,56 @@
+// admin_kiosk.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+var adminKioskTmpl = mustParseAdminTemplate("admin_kiosk.html")
+
+// GET /admin/kiosk （受付の端末で開いたままにする QR コードの画面）
+func handleAdminKiosk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := struct {
+		ActivePage string
+		Admin      *adminUser
+		CSRFToken  string
+		Required   bool
+		PeriodSec  int
+	}{
+		ActivePage: "kiosk",
+		Admin:      adminUserFromContext(r.Context()),
+		CSRFToken:  csrfTokenFromContext(r.Context()),
+		Required:   kioskQR.Required,
+		PeriodSec:  int(kioskQRPeriod / time.Second),
+	}
+	if err := adminKioskTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
+
+// GET /admin/kiosk/token （今表示する QR コードの中身）
+func handleAdminKioskToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := jstNow()
+	token, expiresAt := kioskQR.tokenAt(now)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"payload":   kioskQR.payload(token),
+		"expiresAt": expiresAt.Format(time.RFC3339),
+		"expiresIn": int(expiresAt.Sub(now).Milliseconds()),
+	}); err != nil {
+		log.Println("encode error:", err)
+	}
+}
@@ -0,0 +1,142 @@
+// admin_kiosk_devices.go
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var adminKioskDevicesTmpl = mustParseAdminTemplate("admin_kiosk_devices.html")
+
+// GET  /admin/kiosk-devices
+// POST /admin/kiosk-devices  action=create|revoke
+func handleAdminKioskDevices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminKioskDevices(w, r, "", r.URL.Query().Get("success_msg"), "")
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("action") {
+		case "create":
+			handleAdminKioskDeviceCreate(w, r)
+		case "revoke":
+			handleAdminKioskDeviceRevoke(w, r)
+		default:
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// newToken は登録した直後だけ画面に出す生のトークン
+func renderAdminKioskDevices(w http.ResponseWriter, r *http.Request, errorMsg, successMsg, newToken string) {
+	devices, err := listKioskDevices()
+	if err != nil {
+		log.Println("listKioskDevices error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Devices    []kioskDevice
+		NewToken   string
+		ActivePage string
+		Admin      *adminUser
+		CSRFToken  string
+		SuccessMsg string
+		ErrorMsg   string
+	}{
+		Devices:    devices,
+		NewToken:   newToken,
+		ActivePage: "kiosk_devices",
+		Admin:      adminUserFromContext(r.Context()),
+		CSRFToken:  csrfTokenFromContext(r.Context()),
+		SuccessMsg: successMsg,
+		ErrorMsg:   errorMsg,
+	}
+
+	if err := adminKioskDevicesTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
+
+func kioskDeviceAuditValue(d *kioskDevice) map[string]interface{} {
+	return map[string]interface{}{
+		"kiosk_device_id": d.ID,
+		"name":            d.Name,
+		"prefix":          d.Prefix,
+	}
+}
+
+func handleAdminKioskDeviceCreate(w http.ResponseWriter, r *http.Request) {
+	admin := adminUserFromContext(r.Context())
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		renderAdminKioskDevices(w, r, "端末の名前を入力してください。", "", "")
+		return
+	}
+
+	var raw string
+	err := runAuditedTx(func(tx *sql.Tx) error {
+		var (
+			d   *kioskDevice
+			err error
+		)
+		raw, d, err = createKioskDevice(tx, name, admin.ID)
+		if err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{Action: auditActionKioskDeviceAdd, After: kioskDeviceAuditValue(d)})
+	})
+	if err != nil {
+		log.Println("create kiosk device error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ADMIN] create kiosk device: name=%s by=%s\n", name, admin.Username)
+	// 生のトークンはこの画面でしか見られないので、リダイレクトせずにそのまま出す
+	renderAdminKioskDevices(w, r, "", "スタッフ端末「"+name+"」を登録しました。", raw)
+}
+
+func handleAdminKioskDeviceRevoke(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.FormValue("device_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var name string
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		before, err := getKioskDevice(id)
+		if err != nil {
+			return err
+		}
+		name = before.Name
+		if err := revokeKioskDevice(tx, id); err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{Action: auditActionKioskDeviceDel, Before: kioskDeviceAuditValue(before)})
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "kiosk device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("revoke kiosk device error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ADMIN] revoke kiosk device: id=%d name=%s\n", id, name)
+	http.Redirect(w, r, "/admin/kiosk-devices?success_msg="+url.QueryEscape("スタッフ端末「"+name+"」を取り消しました。"), http.StatusSeeOther)
+}
@@ -0,0 +1,55 @@
+// admin_location_flags.go
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+var adminLocationFlagsTmpl = mustParseAdminTemplate("admin_location_flags.html")
+
+const locationFlagsPageLimit = 200
+
+// GET /admin/location-flags?result=flagged|refused
+func handleAdminLocationFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := r.URL.Query().Get("result")
+	if result != "" && result != geofenceResultFlagged && result != geofenceResultRefused {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	flags, err := listLocationFlags(result, locationFlagsPageLimit)
+	if err != nil {
+		log.Println("listLocationFlags error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Flags      []locationFlag
+		Result     string
+		Limit      int
+		Geofence   geofenceConfig
+		Enabled    bool
+		ActivePage string
+		Admin      *adminUser
+		CSRFToken  string
+	}{
+		Flags:      flags,
+		Result:     result,
+		Limit:      locationFlagsPageLimit,
+		Geofence:   geofence,
+		Enabled:    geofence.enabled(),
+		ActivePage: "location_flags",
+		Admin:      adminUserFromContext(r.Context()),
+		CSRFToken:  csrfTokenFromContext(r.Context()),
+	}
+	if err := adminLocationFlagsTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
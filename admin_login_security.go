@@ -0,0 +1,103 @@
+// admin_login_security.go
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+)
+
+var adminLoginSecurityTmpl = mustParseAdminTemplate("admin_login_security.html")
+
+// GET /admin/login-attempts
+// POST /admin/login-attempts （action=unlock でロック解除）
+func handleAdminLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminLoginAttempts(w, r)
+	case http.MethodPost:
+		handleAdminLoginAttemptsPost(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAdminLoginAttemptsPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	scope := r.FormValue("scope")
+	key := r.FormValue("key")
+	if r.FormValue("action") != "unlock" || key == "" ||
+		(scope != loginScopeIP && scope != loginScopeUsername) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if err := clearLoginLock(scope, key); err != nil {
+		log.Println("clear login lock error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	current := adminUserFromContext(r.Context())
+	fields := eventFieldsFromRequest(r)
+	fields["scope"] = scope
+	fields["key"] = key
+	fields["admin_user"] = current.Username
+	appLog.info("admin_login_unlocked", fields)
+	log.Printf("[ADMIN] unlock login: %s=%s by=%s\n", scope, key, current.Username)
+
+	msg := loginScopeLabel(scope) + "「" + key + "」のロックを解除しました。"
+	http.Redirect(w, r, "/admin/login-attempts?success_msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+func loginScopeLabel(scope string) string {
+	if scope == loginScopeIP {
+		return "IPアドレス"
+	}
+	return "ユーザー名"
+}
+
+func renderAdminLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	locks, err := getLoginLocks(jstNow())
+	if err != nil {
+		log.Println("getLoginLocks error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	failures, err := getRecentLoginFailures()
+	if err != nil {
+		log.Println("getRecentLoginFailures error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Locks        []LoginLockRow
+		Failures     []LoginAttemptRow
+		Limit        int
+		FreeUsername int
+		FreeIP       int
+		ActivePage   string
+		Admin        *adminUser
+		CSRFToken    string
+		SuccessMsg   string
+	}{
+		Locks:        locks,
+		Failures:     failures,
+		Limit:        loginAttemptsPageLimit,
+		FreeUsername: loginFreeFailuresUsername,
+		FreeIP:       loginFreeFailuresIP,
+		ActivePage:   "login_attempts",
+		Admin:        adminUserFromContext(r.Context()),
+		CSRFToken:    csrfTokenFromContext(r.Context()),
+		SuccessMsg:   r.URL.Query().Get("success_msg"),
+	}
+
+	if err := adminLoginSecurityTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
@@ -0,0 +1,132 @@
+// admin_member_import.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var adminMemberImportTmpl = mustParseAdminTemplate("admin_member_import.html")
+
+const memberImportMaxUploadBytes = 2 << 20
+
+// GET  /admin/members/import
+// POST /admin/members/import  action=preview（ファイルを送る）| apply（確認画面の内容を反映）
+func handleAdminMemberImport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminMemberImport(w, r, "", "", nil, false)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseMultipartForm(memberImportMaxUploadBytes); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	opts := memberImportOptions{AllowUnknown: r.FormValue("allow_unknown") == "1"}
+
+	// 確認画面では、反映のときに同じ内容を送り直せるように CSV をそのまま埋め込む
+	var csvData string
+	switch r.FormValue("action") {
+	case "preview":
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			renderAdminMemberImport(w, r, "CSV ファイルを選んでください。", "", nil, opts.AllowUnknown)
+			return
+		}
+		defer file.Close()
+		if header.Size > memberImportMaxUploadBytes {
+			renderAdminMemberImport(w, r, "ファイルが大きすぎます（2MB まで）。", "", nil, opts.AllowUnknown)
+			return
+		}
+		b, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		csvData = string(b)
+	case "apply":
+		csvData = r.FormValue("csv_data")
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := parseMemberImportCSV(strings.NewReader(csvData))
+	var inputErr memberImportError
+	if errors.As(err, &inputErr) {
+		renderAdminMemberImport(w, r, string(inputErr), "", nil, opts.AllowUnknown)
+		return
+	}
+	if err != nil {
+		log.Println("parseMemberImportCSV error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("action") == "preview" {
+		plan, err := planMemberImport(db, rows, opts)
+		if err != nil {
+			log.Println("planMemberImport error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		renderAdminMemberImport(w, r, "", csvData, plan, opts.AllowUnknown)
+		return
+	}
+
+	var plan *memberImportPlan
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		var err error
+		plan, err = applyMemberImport(tx, rows, opts, auditActorFromRequest(r))
+		return err
+	})
+	if err == errMemberImportConflicts {
+		// 確認してから反映するまでの間に会員が変わった
+		renderAdminMemberImport(w, r, "確認後に会員情報が変わったため、反映できませんでした。内容を確かめてください。", csvData, plan, opts.AllowUnknown)
+		return
+	}
+	if err != nil {
+		log.Println("applyMemberImport error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ADMIN] import members: insert=%d update=%d unchanged=%d\n", plan.Inserts, plan.Updates, plan.Unchanged)
+	msg := fmt.Sprintf("会員を一括登録しました（追加 %d件・更新 %d件・変更なし %d件）。", plan.Inserts, plan.Updates, plan.Unchanged)
+	http.Redirect(w, r, "/admin/members?success_msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+func renderAdminMemberImport(w http.ResponseWriter, r *http.Request, errorMsg, csvData string, plan *memberImportPlan, allowUnknown bool) {
+	data := struct {
+		Plan         *memberImportPlan
+		CSVData      string
+		AllowUnknown bool
+		ActivePage   string
+		Admin        *adminUser
+		CSRFToken    string
+		ErrorMsg     string
+	}{
+		Plan:         plan,
+		CSVData:      csvData,
+		AllowUnknown: allowUnknown,
+		ActivePage:   "members",
+		Admin:        adminUserFromContext(r.Context()),
+		CSRFToken:    csrfTokenFromContext(r.Context()),
+		ErrorMsg:     errorMsg,
+	}
+
+	if err := adminMemberImportTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
@@ -0,0 +1,197 @@
+// admin_plans.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var adminPlansTmpl = mustParseAdminTemplate("admin_plans.html")
+
+// GET /admin/plans
+// POST /admin/plans
+func handleAdminPlans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminPlans(w, r, "", r.URL.Query().Get("success_msg"))
+	case http.MethodPost:
+		handleAdminPlansPost(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// フォームの値からプランを作る。込み回数が空なら無制限。
+func planFromForm(r *http.Request) (plan, error) {
+	p := plan{
+		Code:          strings.TrimSpace(r.FormValue("code")),
+		Name:          strings.TrimSpace(r.FormValue("name")),
+		NoticeMessage: strings.TrimSpace(strings.ReplaceAll(r.FormValue("notice_message"), "\r\n", "\n")),
+		Selectable:    r.FormValue("selectable") == "1",
+	}
+
+	ints := []struct {
+		field string
+		label string
+		dest  *int
+	}{
+		{"monthly_fee", "月額", &p.MonthlyFee},
+		{"extra_visit_price", "追加1回の料金", &p.ExtraVisitPrice},
+		{"sort_order", "表示順", &p.SortOrder},
+	}
+	for _, f := range ints {
+		raw := strings.TrimSpace(r.FormValue(f.field))
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return p, planInputError(f.label + "は整数で入力してください")
+		}
+		*f.dest = v
+	}
+
+	if raw := strings.TrimSpace(r.FormValue("included_visits")); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return p, planInputError("込み回数は整数で入力してください（無制限なら空欄）")
+		}
+		p.Metered = true
+		p.IncludedVisits = v
+	}
+	return p, nil
+}
+
+// 監査ログに残す形
+func planAuditValue(p plan) map[string]interface{} {
+	v := map[string]interface{}{
+		"code":              p.Code,
+		"name":              p.Name,
+		"monthly_fee":       p.MonthlyFee,
+		"included_visits":   nil,
+		"extra_visit_price": p.ExtraVisitPrice,
+		"notice_message":    p.NoticeMessage,
+		"sort_order":        p.SortOrder,
+		"selectable":        p.Selectable,
+	}
+	if p.Metered {
+		v["included_visits"] = p.IncludedVisits
+	}
+	return v
+}
+
+func handleAdminPlansPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	action := r.FormValue("action")
+	code := strings.TrimSpace(r.FormValue("code"))
+
+	var successMsg string
+	err := runAuditedTx(func(tx *sql.Tx) error {
+		switch action {
+		case "create":
+			p, err := planFromForm(r)
+			if err != nil {
+				return err
+			}
+			if err := insertPlan(tx, p); err != nil {
+				return err
+			}
+			successMsg = "プラン「" + p.Name + "」を追加しました。"
+			return writeAuditLog(tx, r, auditEntry{Action: auditActionPlanCreate, After: planAuditValue(p)})
+
+		case "update":
+			before, err := getPlan(code)
+			if err != nil {
+				return err
+			}
+			p, err := planFromForm(r)
+			if err != nil {
+				return err
+			}
+			if err := updatePlan(tx, p); err != nil {
+				return err
+			}
+			successMsg = "プラン「" + p.Name + "」を保存しました。"
+			return writeAuditLog(tx, r, auditEntry{
+				Action: auditActionPlanUpdate,
+				Before: planAuditValue(before),
+				After:  planAuditValue(p),
+			})
+
+		case "delete":
+			before, err := getPlan(code)
+			if err != nil {
+				return err
+			}
+			if err := deletePlan(tx, code); err != nil {
+				return err
+			}
+			successMsg = "プラン「" + before.Name + "」を削除しました。"
+			return writeAuditLog(tx, r, auditEntry{Action: auditActionPlanDelete, Before: planAuditValue(before)})
+
+		default:
+			return errBadPlanAction
+		}
+	})
+	switch {
+	case err == errBadPlanAction:
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	case err == errPlanNotFound:
+		http.Error(w, "plan not found", http.StatusNotFound)
+		return
+	case err != nil:
+		if msg, ok := err.(planInputError); ok {
+			renderAdminPlans(w, r, string(msg), "")
+			return
+		}
+		log.Println("admin plans error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ADMIN] %s plan: %s\n", action, code)
+	http.Redirect(w, r, "/admin/plans?success_msg="+url.QueryEscape(successMsg), http.StatusSeeOther)
+}
+
+var errBadPlanAction = errors.New("bad plan action")
+
+func renderAdminPlans(w http.ResponseWriter, r *http.Request, errorMsg, successMsg string) {
+	plans, err := listPlans()
+	if err != nil {
+		log.Println("listPlans error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Plans       []plan
+		DefaultCode string
+		ActivePage  string
+		Admin       *adminUser
+		CSRFToken   string
+		SuccessMsg  string
+		ErrorMsg    string
+	}{
+		Plans:       plans,
+		DefaultCode: defaultPlanCode,
+		ActivePage:  "plans",
+		Admin:       adminUserFromContext(r.Context()),
+		CSRFToken:   csrfTokenFromContext(r.Context()),
+		SuccessMsg:  successMsg,
+		ErrorMsg:    errorMsg,
+	}
+
+	if err := adminPlansTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
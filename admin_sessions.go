@@ -0,0 +1,235 @@
+// admin_sessions.go
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 再起動してもログインが切れないよう、管理画面のセッションは DB に置く。
+// Cookie のトークンそのものは保存せず、SHA-256 のハッシュだけを持つ。
+type adminSession struct {
+	ID          int64
+	TokenHash   string
+	AdminUserID int64
+	Username    string
+	CreatedAt   string
+	LastSeenAt  string
+	ExpiresAt   string
+	IP          string
+	UserAgent   string
+	CSRFToken   string // フォームに埋め込む同期トークン
+}
+
+// 監査ログや一覧に出す短い識別子
+func (s *adminSession) Ref() string {
+	return adminSessionRef(s.TokenHash)
+}
+
+// last_seen_at / expires_at の更新はこの間隔より細かくはしない（書き込みを減らすため）
+const adminSessionTouchInterval = time.Minute
+
+func hashAdminSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func adminSessionRef(tokenHash string) string {
+	if len(tokenHash) < 16 {
+		return tokenHash
+	}
+	return tokenHash[:16]
+}
+
+// mfaPending のセッションは2段階目が済むまで管理画面には使えず、有効期限も短い
+func createAdminSession(userID int64, token string, r *http.Request, mfaPending bool) error {
+	now := jstNow()
+	ttl := adminSessionTTL
+	if mfaPending {
+		ttl = adminMFAPendingTTL
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	csrfToken, err := newAdminSessionToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO admin_sessions(token_hash, admin_user_id, created_at, last_seen_at, expires_at, ip, user_agent, csrf_token, mfa_pending)
+         VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashAdminSessionToken(token), userID,
+		formatJSTDateTime(now), formatJSTDateTime(now), formatJSTDateTime(now.Add(ttl)),
+		host, r.UserAgent(), csrfToken, mfaPending,
+	)
+	return err
+}
+
+const adminSessionColumns = `
+  s.id,
+  s.token_hash,
+  s.admin_user_id,
+  IFNULL(u.username, ''),
+  strftime('%Y-%m-%d %H:%M:%S', s.created_at),
+  strftime('%Y-%m-%d %H:%M:%S', s.last_seen_at),
+  strftime('%Y-%m-%d %H:%M:%S', s.expires_at),
+  IFNULL(s.ip, ''),
+  IFNULL(s.user_agent, ''),
+  IFNULL(s.csrf_token, '')
+`
+
+func scanAdminSession(scan func(dest ...interface{}) error) (*adminSession, error) {
+	var s adminSession
+	if err := scan(
+		&s.ID, &s.TokenHash, &s.AdminUserID, &s.Username,
+		&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.IP, &s.UserAgent, &s.CSRFToken,
+	); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// 有効なセッションを探し、見つかれば有効期限を延ばす（スライディング）。
+// 期限切れ・取り消し済みなら sql.ErrNoRows を返す。
+func touchAdminSession(token string, now time.Time) (*adminSession, error) {
+	s, err := scanAdminSession(db.QueryRow(
+		`SELECT `+adminSessionColumns+`
+           FROM admin_sessions s
+           LEFT JOIN admin_users u ON u.id = s.admin_user_id
+          WHERE s.token_hash = ? AND s.expires_at > ? AND s.mfa_pending = 0`,
+		hashAdminSessionToken(token), formatJSTDateTime(now),
+	).Scan)
+	if err != nil {
+		return nil, err
+	}
+
+	// CSRF トークンの導入前に作られたセッション
+	if s.CSRFToken == "" {
+		csrfToken, err := newAdminSessionToken()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(`UPDATE admin_sessions SET csrf_token = ? WHERE id = ?`, csrfToken, s.ID); err != nil {
+			return nil, err
+		}
+		s.CSRFToken = csrfToken
+	}
+
+	lastSeen, err := parseJSTDateTime(s.LastSeenAt)
+	if err != nil || now.Sub(lastSeen) >= adminSessionTouchInterval {
+		s.LastSeenAt = formatJSTDateTime(now)
+		s.ExpiresAt = formatJSTDateTime(now.Add(adminSessionTTL))
+		if _, err := db.Exec(
+			`UPDATE admin_sessions SET last_seen_at = ?, expires_at = ? WHERE id = ?`,
+			s.LastSeenAt, s.ExpiresAt, s.ID,
+		); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// adminUserID が 0 なら全員分
+func listActiveAdminSessions(adminUserID int64) ([]adminSession, error) {
+	query := `SELECT ` + adminSessionColumns + `
+  FROM admin_sessions s
+  LEFT JOIN admin_users u ON u.id = s.admin_user_id
+ WHERE s.expires_at > ? AND s.mfa_pending = 0`
+	args := []interface{}{formatJSTDateTime(jstNow())}
+	if adminUserID > 0 {
+		query += " AND s.admin_user_id = ?"
+		args = append(args, adminUserID)
+	}
+	query += " ORDER BY s.last_seen_at DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []adminSession
+	for rows.Next() {
+		s, err := scanAdminSession(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *s)
+	}
+	return list, rows.Err()
+}
+
+// 2段階目の入力待ちのセッション（期限切れなら sql.ErrNoRows）
+func getPendingAdminSession(token string, now time.Time) (*adminSession, error) {
+	return scanAdminSession(db.QueryRow(
+		`SELECT `+adminSessionColumns+`
+           FROM admin_sessions s
+           LEFT JOIN admin_users u ON u.id = s.admin_user_id
+          WHERE s.token_hash = ? AND s.expires_at > ? AND s.mfa_pending = 1`,
+		hashAdminSessionToken(token), formatJSTDateTime(now),
+	).Scan)
+}
+
+// 2段階目が済んだら通常のセッションにする
+func completeAdminSessionMFA(id int64, now time.Time) error {
+	res, err := db.Exec(
+		`UPDATE admin_sessions
+            SET mfa_pending = 0, last_seen_at = ?, expires_at = ?
+          WHERE id = ? AND mfa_pending = 1`,
+		formatJSTDateTime(now), formatJSTDateTime(now.Add(adminSessionTTL)), id,
+	)
+	if err != nil {
+		return err
+	}
+	// 同じセッションで同時に送られたときは片方だけ通す
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func getAdminSession(id int64) (*adminSession, error) {
+	return scanAdminSession(db.QueryRow(
+		`SELECT `+adminSessionColumns+`
+           FROM admin_sessions s
+           LEFT JOIN admin_users u ON u.id = s.admin_user_id
+          WHERE s.id = ?`,
+		id,
+	).Scan)
+}
+
+func deleteAdminSessionByToken(token string) error {
+	_, err := db.Exec(`DELETE FROM admin_sessions WHERE token_hash = ?`, hashAdminSessionToken(token))
+	return err
+}
+
+func deleteAdminSession(id int64) error {
+	_, err := db.Exec(`DELETE FROM admin_sessions WHERE id = ?`, id)
+	return err
+}
+
+// exceptID のセッション（今使っているもの）だけ残したいときに指定する。全部消すなら 0。
+func deleteAdminSessionsForUser(adminUserID, exceptID int64) (int64, error) {
+	res, err := db.Exec(
+		`DELETE FROM admin_sessions WHERE admin_user_id = ? AND id <> ?`,
+		adminUserID, exceptID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func deleteExpiredAdminSessions(now time.Time) error {
+	_, err := db.Exec(`DELETE FROM admin_sessions WHERE expires_at <= ?`, formatJSTDateTime(now))
+	return err
+}
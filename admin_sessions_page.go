@@ -0,0 +1,155 @@
+// admin_sessions_page.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var adminSessionsTmpl = mustParseAdminTemplate("admin_sessions.html")
+
+// 一覧の1行分
+type AdminSessionRow struct {
+	adminSession
+	Current bool // このリクエストのセッション
+}
+
+// GET /admin/sessions
+// POST /admin/sessions
+//
+// 自分のセッションは誰でも取り消せる。オーナー（管理者アカウントの管理権限）は全員分を見て取り消せる。
+func (a *adminAuth) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminSessions(w, r, "", r.URL.Query().Get("success_msg"))
+	case http.MethodPost:
+		a.handleSessionsPost(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *adminAuth) handleSessionsPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	current := adminUserFromContext(r.Context())
+	currentSession := adminSessionFromContext(r.Context())
+
+	switch r.FormValue("action") {
+	case "revoke":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		target, err := getAdminSession(id)
+		if err == sql.ErrNoRows {
+			redirectAdminSessions(w, r, "既にログアウト済みです。")
+			return
+		}
+		if err != nil {
+			log.Println("getAdminSession error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if target.AdminUserID != current.ID && !current.Can(permManageAdmins) {
+			http.Error(w, "権限がありません", http.StatusForbidden)
+			return
+		}
+		if err := deleteAdminSession(id); err != nil {
+			log.Println("deleteAdminSession error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[ADMIN] revoke session: user=%s session=%s by=%s\n", target.Username, target.Ref(), current.Username)
+
+		if target.ID == currentSession.ID {
+			a.clearSessionCookie(w, r)
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			return
+		}
+		redirectAdminSessions(w, r, fmt.Sprintf("%s のセッションをログアウトさせました。", target.Username))
+
+	case "revoke_others":
+		n, err := deleteAdminSessionsForUser(current.ID, currentSession.ID)
+		if err != nil {
+			log.Println("deleteAdminSessionsForUser error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[ADMIN] revoke other sessions: user=%s count=%d\n", current.Username, n)
+		redirectAdminSessions(w, r, fmt.Sprintf("ほかの端末 %d件をログアウトさせました。", n))
+
+	case "revoke_all":
+		// この端末も含めてすべてログアウト
+		n, err := deleteAdminSessionsForUser(current.ID, 0)
+		if err != nil {
+			log.Println("deleteAdminSessionsForUser error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[ADMIN] log out everywhere: user=%s count=%d\n", current.Username, n)
+		a.clearSessionCookie(w, r)
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+func redirectAdminSessions(w http.ResponseWriter, r *http.Request, successMsg string) {
+	http.Redirect(w, r, "/admin/sessions?success_msg="+url.QueryEscape(successMsg), http.StatusSeeOther)
+}
+
+func renderAdminSessions(w http.ResponseWriter, r *http.Request, errorMsg, successMsg string) {
+	current := adminUserFromContext(r.Context())
+	currentSession := adminSessionFromContext(r.Context())
+
+	var filterUserID int64
+	if !current.Can(permManageAdmins) {
+		filterUserID = current.ID
+	}
+	sessions, err := listActiveAdminSessions(filterUserID)
+	if err != nil {
+		log.Println("listActiveAdminSessions error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rows := make([]AdminSessionRow, 0, len(sessions))
+	for _, s := range sessions {
+		rows = append(rows, AdminSessionRow{
+			adminSession: s,
+			Current:      currentSession != nil && s.ID == currentSession.ID,
+		})
+	}
+
+	data := struct {
+		Sessions   []AdminSessionRow
+		ShowAll    bool
+		ActivePage string
+		Admin      *adminUser
+		CSRFToken  string
+		SuccessMsg string
+		ErrorMsg   string
+	}{
+		Sessions:   rows,
+		ShowAll:    filterUserID == 0,
+		ActivePage: "sessions",
+		Admin:      current,
+		CSRFToken:  csrfTokenFromContext(r.Context()),
+		SuccessMsg: successMsg,
+		ErrorMsg:   errorMsg,
+	}
+
+	if err := adminSessionsTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
@@ -0,0 +1,205 @@
+// admin_settings.go
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var adminSettingsTmpl = mustParseAdminTemplate("admin_settings.html")
+
+// 設定画面の1行分
+type SettingRow struct {
+	Key          string
+	Label        string
+	Unit         string
+	Value        int
+	DefaultValue int  // 環境変数（なければ組み込み）の値
+	Overridden   bool // 管理画面で保存した値を使っているか
+	Min          int
+	Max          int
+}
+
+func getSettingRows() ([]SettingRow, error) {
+	defaults, err := envSettingValues()
+	if err != nil {
+		return nil, err
+	}
+	values, err := resolveSettingValues()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := getStoredSettingValues()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]SettingRow, 0, len(intSettingDefs))
+	for _, def := range intSettingDefs {
+		_, overridden := stored[def.Key]
+		rows = append(rows, SettingRow{
+			Key:          def.Key,
+			Label:        def.Label,
+			Unit:         def.Unit,
+			Value:        values[def.Key],
+			DefaultValue: defaults[def.Key],
+			Overridden:   overridden,
+			Min:          def.Min,
+			Max:          def.Max,
+		})
+	}
+	return rows, nil
+}
+
+// GET /admin/settings
+// POST /admin/settings
+func handleAdminSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminSettings(w, r, "", r.URL.Query().Get("success_msg"))
+	case http.MethodPost:
+		handleAdminSettingsPost(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAdminSettingsPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	before, err := resolvedSettingsAuditValue()
+	if err != nil {
+		log.Println("resolve settings error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("action") == "reset" {
+		if err := resetStoreSettings(); err != nil {
+			log.Println("reset settings error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		after, _ := resolvedSettingsAuditValue()
+		recordAuditLog(r, auditEntry{Action: auditActionSettingsReset, Before: before, After: after})
+		log.Println("[ADMIN] reset settings to defaults")
+		http.Redirect(w, r, "/admin/settings?success_msg="+url.QueryEscape("設定を既定値に戻しました。"), http.StatusSeeOther)
+		return
+	}
+
+	values := make(map[string]int, len(intSettingDefs))
+	var errs []string
+	for _, def := range intSettingDefs {
+		v, err := def.parse(r.FormValue(def.Key))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		values[def.Key] = v
+	}
+	policy, err := parseCapacityPolicy(r.FormValue(settingKeyCapacityPolicy))
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		renderAdminSettings(w, r, strings.Join(errs, " / "), "")
+		return
+	}
+
+	if err := saveStoreSettings(values, policy); err != nil {
+		log.Println("save settings error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	after := settingsAuditValue(values, policy)
+	recordAuditLog(r, auditEntry{Action: auditActionSettingsUpdate, Before: before, After: after})
+	log.Printf("[ADMIN] update settings: %v\n", after)
+	http.Redirect(w, r, "/admin/settings?success_msg="+url.QueryEscape("設定を保存しました。"), http.StatusSeeOther)
+}
+
+// 監査ログに残す設定値（整数の設定と、定員に達したときの扱い）
+func settingsAuditValue(values map[string]int, policy capacityPolicy) map[string]interface{} {
+	v := make(map[string]interface{}, len(values)+1)
+	for key, value := range values {
+		v[key] = value
+	}
+	v[settingKeyCapacityPolicy] = string(policy)
+	return v
+}
+
+func resolvedSettingsAuditValue() (map[string]interface{}, error) {
+	values, err := resolveSettingValues()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := resolveCapacityPolicy()
+	if err != nil {
+		return nil, err
+	}
+	return settingsAuditValue(values, policy), nil
+}
+
+func renderAdminSettings(w http.ResponseWriter, r *http.Request, errorMsg, successMsg string) {
+	rows, err := getSettingRows()
+	if err != nil {
+		log.Println("getSettingRows error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	policy, err := resolveCapacityPolicy()
+	if err != nil {
+		log.Println("resolveCapacityPolicy error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defaultPolicy, err := envCapacityPolicy()
+	if err != nil {
+		log.Println("envCapacityPolicy error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	stored, err := getStoredSettingValues()
+	if err != nil {
+		log.Println("getStoredSettingValues error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	_, policyOverridden := stored[settingKeyCapacityPolicy]
+
+	data := struct {
+		Settings         []SettingRow
+		PolicyKey        string
+		Policy           capacityPolicy
+		DefaultPolicy    capacityPolicy
+		PolicyOverridden bool
+		PolicyOptions    []capacityPolicyOption
+		ActivePage       string
+		Admin            *adminUser
+		CSRFToken        string
+		SuccessMsg       string
+		ErrorMsg         string
+	}{
+		Settings:         rows,
+		PolicyKey:        settingKeyCapacityPolicy,
+		Policy:           policy,
+		DefaultPolicy:    defaultPolicy,
+		PolicyOverridden: policyOverridden,
+		PolicyOptions:    capacityPolicyOptions,
+		ActivePage:       "settings",
+		Admin:            adminUserFromContext(r.Context()),
+		CSRFToken:        csrfTokenFromContext(r.Context()),
+		SuccessMsg:       successMsg,
+		ErrorMsg:         errorMsg,
+	}
+
+	if err := adminSettingsTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
@@ -0,0 +1,344 @@
+// admin_tickets.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var adminTicketsTmpl = mustParseAdminTemplate("admin_tickets.html")
+
+// GET /admin/tickets
+//
+// 回数券の商品と、使える残りがある回数券の一覧。販売・返金・調整は会員の来店履歴画面から行う。
+func handleAdminTickets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	renderAdminTickets(w, r, "", r.URL.Query().Get("success_msg"))
+}
+
+func renderAdminTickets(w http.ResponseWriter, r *http.Request, errorMsg, successMsg string) {
+	products, err := listTicketProducts(false)
+	if err != nil {
+		log.Println("listTicketProducts error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	packs, err := listUsableTicketPacks()
+	if err != nil {
+		log.Println("listUsableTicketPacks error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	totalRemaining := 0
+	for _, p := range packs {
+		totalRemaining += p.Remaining
+	}
+
+	data := struct {
+		Products       []ticketProduct
+		Packs          []ticketPack
+		TotalRemaining int
+		ActivePage     string
+		Admin          *adminUser
+		CSRFToken      string
+		SuccessMsg     string
+		ErrorMsg       string
+	}{
+		Products:       products,
+		Packs:          packs,
+		TotalRemaining: totalRemaining,
+		ActivePage:     "tickets",
+		Admin:          adminUserFromContext(r.Context()),
+		CSRFToken:      csrfTokenFromContext(r.Context()),
+		SuccessMsg:     successMsg,
+		ErrorMsg:       errorMsg,
+	}
+
+	if err := adminTicketsTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
+
+// フォームの値から商品を作る
+func ticketProductFromForm(r *http.Request) (ticketProduct, error) {
+	p := ticketProduct{
+		Name:   strings.TrimSpace(r.FormValue("name")),
+		Active: r.FormValue("active") == "1",
+	}
+	ints := []struct {
+		field string
+		label string
+		dest  *int
+	}{
+		{"visits", "回数", &p.Visits},
+		{"price", "金額", &p.Price},
+		{"valid_days", "有効日数", &p.ValidDays},
+		{"sort_order", "表示順", &p.SortOrder},
+	}
+	for _, f := range ints {
+		raw := strings.TrimSpace(r.FormValue(f.field))
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return p, ticketInputError(f.label + "は整数で入力してください")
+		}
+		*f.dest = v
+	}
+	return p, nil
+}
+
+func ticketProductAuditValue(p ticketProduct) map[string]interface{} {
+	return map[string]interface{}{
+		"product_id": p.ID,
+		"name":       p.Name,
+		"visits":     p.Visits,
+		"price":      p.Price,
+		"valid_days": p.ValidDays,
+		"active":     p.Active,
+		"sort_order": p.SortOrder,
+	}
+}
+
+// POST /admin/tickets/products
+func handleAdminTicketProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	action := r.FormValue("action")
+	var successMsg string
+	err := runAuditedTx(func(tx *sql.Tx) error {
+		p, err := ticketProductFromForm(r)
+		if err != nil {
+			return err
+		}
+		switch action {
+		case "create":
+			if p.ID, err = insertTicketProduct(tx, p); err != nil {
+				return err
+			}
+			successMsg = "回数券「" + p.Name + "」を追加しました。"
+			return writeAuditLog(tx, r, auditEntry{Action: auditActionTicketProduct, After: ticketProductAuditValue(p)})
+
+		case "update":
+			if p.ID, err = strconv.ParseInt(r.FormValue("product_id"), 10, 64); err != nil {
+				return errBadTicketAction
+			}
+			before, err := getTicketProduct(p.ID)
+			if err != nil {
+				return err
+			}
+			if err := updateTicketProduct(tx, p); err != nil {
+				return err
+			}
+			successMsg = "回数券「" + p.Name + "」を保存しました。"
+			return writeAuditLog(tx, r, auditEntry{
+				Action: auditActionTicketProduct,
+				Before: ticketProductAuditValue(before),
+				After:  ticketProductAuditValue(p),
+			})
+
+		default:
+			return errBadTicketAction
+		}
+	})
+	if handled := handleTicketTxError(w, err); handled {
+		return
+	}
+	var inputErr ticketInputError
+	if errors.As(err, &inputErr) {
+		renderAdminTickets(w, r, string(inputErr), "")
+		return
+	}
+
+	log.Printf("[ADMIN] %s ticket product: %s\n", action, r.FormValue("name"))
+	http.Redirect(w, r, "/admin/tickets?success_msg="+url.QueryEscape(successMsg), http.StatusSeeOther)
+}
+
+var errBadTicketAction = errors.New("bad ticket action")
+
+// 回数券まわりの共通のエラー応答。入力内容の誤りは呼び出し側で扱う。
+func handleTicketTxError(w http.ResponseWriter, err error) bool {
+	var inputErr ticketInputError
+	switch {
+	case err == nil || errors.As(err, &inputErr):
+		return false
+	case err == errBadTicketAction:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	case err == errTicketProductNotFound:
+		http.Error(w, "ticket product not found", http.StatusNotFound)
+	case err == errTicketPackNotFound:
+		http.Error(w, "ticket pack not found", http.StatusNotFound)
+	case err == errTicketPackRefunded:
+		http.Error(w, "この回数券は返金済みです", http.StatusConflict)
+	default:
+		log.Println("admin tickets error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+	return true
+}
+
+func ticketPackAuditValue(p ticketPack) map[string]interface{} {
+	return map[string]interface{}{
+		"ticket_pack_id": p.ID,
+		"name":           p.Name,
+		"total":          p.Total,
+		"remaining":      p.Remaining,
+		"price":          p.Price,
+		"method":         p.Method,
+		"expires_on":     p.ExpiresOn,
+		"refund_amount":  p.RefundAmount,
+		"note":           p.Note,
+	}
+}
+
+// POST /admin/tickets/packs
+//
+// 会員の来店履歴画面からの販売・返金・調整。終わったら来店履歴画面に戻す。
+func handleAdminTicketPacks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	action := r.FormValue("action")
+	lineUserID := r.FormValue("line_user_id")
+	month := r.FormValue("month")
+	if lineUserID == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	admin := adminUserFromContext(r.Context())
+
+	formInt := func(field string) (int, error) {
+		v, err := strconv.Atoi(strings.TrimSpace(r.FormValue(field)))
+		if err != nil || v < 0 {
+			return 0, ticketInputError("数値は0以上の整数で入力してください")
+		}
+		return v, nil
+	}
+
+	var successMsg string
+	err := runAuditedTx(func(tx *sql.Tx) error {
+		if action == "sell" {
+			productID, err := strconv.ParseInt(r.FormValue("product_id"), 10, 64)
+			if err != nil {
+				return errBadTicketAction
+			}
+			product, err := getTicketProduct(productID)
+			if err != nil {
+				return err
+			}
+			if !product.Active {
+				return ticketInputError("販売を停止している回数券です")
+			}
+			method := r.FormValue("method")
+			if !isValidPaymentMethod(method) {
+				return errBadTicketAction
+			}
+			price := product.Price
+			if strings.TrimSpace(r.FormValue("price")) != "" {
+				if price, err = formInt("price"); err != nil {
+					return err
+				}
+			}
+			id, err := sellTicketPack(tx, lineUserID, product, price, method, strings.TrimSpace(r.FormValue("note")), admin.ID)
+			if err != nil {
+				return err
+			}
+			after, err := getTicketPack(tx, id)
+			if err != nil {
+				return err
+			}
+			successMsg = fmt.Sprintf("回数券「%s」を%d円（%s）で販売しました。", product.Name, price, paymentMethodLabel(method))
+			return writeAuditLog(tx, r, auditEntry{
+				Action:     auditActionTicketSell,
+				LineUserID: lineUserID,
+				After:      ticketPackAuditValue(after),
+			})
+		}
+
+		packID, err := strconv.ParseInt(r.FormValue("pack_id"), 10, 64)
+		if err != nil {
+			return errBadTicketAction
+		}
+		before, err := getTicketPack(tx, packID)
+		if err != nil {
+			return err
+		}
+		if before.LineUserID != lineUserID {
+			return errTicketPackNotFound
+		}
+
+		var auditAction string
+		switch action {
+		case "refund":
+			amount, err := formInt("amount")
+			if err != nil {
+				return err
+			}
+			if err := refundTicketPack(tx, packID, amount); err != nil {
+				return err
+			}
+			auditAction = auditActionTicketRefund
+			successMsg = fmt.Sprintf("回数券「%s」を%d円で返金しました。", before.Name, amount)
+
+		case "adjust":
+			remaining, err := formInt("remaining")
+			if err != nil {
+				return err
+			}
+			if err := adjustTicketPack(tx, packID, remaining, strings.TrimSpace(r.FormValue("expires_on"))); err != nil {
+				return err
+			}
+			auditAction = auditActionTicketAdjust
+			successMsg = fmt.Sprintf("回数券「%s」を調整しました。", before.Name)
+
+		default:
+			return errBadTicketAction
+		}
+
+		after, err := getTicketPack(tx, packID)
+		if err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{
+			Action:     auditAction,
+			LineUserID: lineUserID,
+			Before:     ticketPackAuditValue(before),
+			After:      ticketPackAuditValue(after),
+		})
+	})
+	if handled := handleTicketTxError(w, err); handled {
+		return
+	}
+	var inputErr ticketInputError
+	if errors.As(err, &inputErr) {
+		http.Error(w, string(inputErr), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[ADMIN] %s ticket pack: user=%s\n", action, lineUserID)
+	redirectVisitDetail(w, r, lineUserID, month, successMsg)
+}
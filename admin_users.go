@@ -0,0 +1,317 @@
+// admin_users.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 管理画面のロール
+const (
+	adminRoleOwner  = "owner"  // オーナー: すべての操作
+	adminRoleStaff  = "staff"  // スタッフ: 受付業務（支払い・来店追加・会員情報）
+	adminRoleViewer = "viewer" // 閲覧のみ
+)
+
+var adminRoles = []string{adminRoleOwner, adminRoleStaff, adminRoleViewer}
+
+type adminPermission string
+
+const (
+	permView           adminPermission = "view"            // 一覧・詳細の閲覧
+	permMarkPayment    adminPermission = "mark_payment"    // 支払い済みチェック
+	permEditVisits     adminPermission = "edit_visits"     // 来店履歴の追加・管理画面からのチェックアウト
+	permDeleteVisits   adminPermission = "delete_visits"   // 来店履歴の削除
+	permEditMembers    adminPermission = "edit_members"    // 会員種別・PosterID の変更
+	permManageSettings adminPermission = "manage_settings" // 設定の変更
+	permManageAdmins   adminPermission = "manage_admins"   // 管理者アカウントの管理
+	permViewAudit      adminPermission = "view_audit"      // 操作履歴（監査ログ）の閲覧
+)
+
+var rolePermissions = map[string][]adminPermission{
+	adminRoleOwner: {
+		permView, permMarkPayment, permEditVisits, permDeleteVisits,
+		permEditMembers, permManageSettings, permManageAdmins, permViewAudit,
+	},
+	adminRoleStaff: {
+		permView, permMarkPayment, permEditVisits, permEditMembers, permViewAudit,
+	},
+	adminRoleViewer: {
+		permView,
+	},
+}
+
+const adminMinPasswordLength = 8
+
+var errAdminUserNotFound = errors.New("admin user not found")
+
+type adminUser struct {
+	ID          int64
+	Username    string
+	Role        string
+	Disabled    bool
+	TOTPEnabled bool // 2段階認証を設定済み
+}
+
+func (u *adminUser) Can(p adminPermission) bool {
+	if u == nil || u.Disabled {
+		return false
+	}
+	for _, granted := range rolePermissions[u.Role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *adminUser) RoleLabel() string {
+	return adminRoleLabel(u.Role)
+}
+
+func adminRoleLabel(role string) string {
+	switch role {
+	case adminRoleOwner:
+		return "オーナー"
+	case adminRoleStaff:
+		return "スタッフ"
+	case adminRoleViewer:
+		return "閲覧のみ"
+	default:
+		return role
+	}
+}
+
+func isValidAdminRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func validateAdminPassword(password string) error {
+	if len(password) < adminMinPasswordLength {
+		return fmt.Errorf("パスワードは%d文字以上にしてください", adminMinPasswordLength)
+	}
+	// bcrypt は72バイトより後ろを無視する
+	if len(password) > 72 {
+		return errors.New("パスワードは72バイト以内にしてください")
+	}
+	return nil
+}
+
+func hashAdminPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// 存在しないユーザー名でも同じくらい時間がかかるよう、比較用のハッシュを持っておく
+var dummyAdminPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+// ユーザー名とパスワードを確認する。無効化されたアカウントは通さない。
+func authenticateAdminUser(username, password string) (*adminUser, error) {
+	var (
+		u          adminUser
+		hash       string
+		disabledAt sql.NullString
+	)
+	err := db.QueryRow(
+		`SELECT id, username, role, password_hash, disabled_at, totp_enabled_at IS NOT NULL
+           FROM admin_users
+          WHERE username = ?`,
+		username,
+	).Scan(&u.ID, &u.Username, &u.Role, &hash, &disabledAt, &u.TOTPEnabled)
+	if err == sql.ErrNoRows {
+		_ = bcrypt.CompareHashAndPassword(dummyAdminPasswordHash, []byte(password))
+		return nil, errAdminUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, errAdminUserNotFound
+	}
+	if disabledAt.Valid {
+		return nil, errAdminUserNotFound
+	}
+	return &u, nil
+}
+
+func getAdminUser(id int64) (*adminUser, error) {
+	var (
+		u          adminUser
+		disabledAt sql.NullString
+	)
+	err := db.QueryRow(
+		`SELECT id, username, role, disabled_at, totp_enabled_at IS NOT NULL
+           FROM admin_users
+          WHERE id = ?`,
+		id,
+	).Scan(&u.ID, &u.Username, &u.Role, &disabledAt, &u.TOTPEnabled)
+	if err == sql.ErrNoRows {
+		return nil, errAdminUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.Disabled = disabledAt.Valid
+	return &u, nil
+}
+
+func listAdminUsers() ([]adminUser, error) {
+	rows, err := db.Query(`
+SELECT id, username, role, disabled_at IS NOT NULL, totp_enabled_at IS NOT NULL
+FROM admin_users
+ORDER BY disabled_at IS NOT NULL, id
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []adminUser
+	for rows.Next() {
+		var u adminUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.Disabled, &u.TOTPEnabled); err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+func createAdminUser(username, password, role string) (int64, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return 0, errors.New("ユーザー名を入力してください")
+	}
+	if !isValidAdminRole(role) {
+		return 0, fmt.Errorf("不明なロールです: %s", role)
+	}
+	if err := validateAdminPassword(password); err != nil {
+		return 0, err
+	}
+	return insertAdminUser(username, password, role)
+}
+
+func insertAdminUser(username, password, role string) (int64, error) {
+	hash, err := hashAdminPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := db.Exec(
+		`INSERT INTO admin_users(username, password_hash, role, created_at)
+         VALUES(?, ?, ?, ?)`,
+		username, hash, role, formatJSTDateTime(jstNow()),
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return 0, fmt.Errorf("ユーザー名「%s」は既に使われています", username)
+		}
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func updateAdminUserPassword(id int64, password string) error {
+	if err := validateAdminPassword(password); err != nil {
+		return err
+	}
+	hash, err := hashAdminPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE admin_users SET password_hash = ? WHERE id = ?`, hash, id)
+	return err
+}
+
+func updateAdminUserRole(id int64, role string) error {
+	if !isValidAdminRole(role) {
+		return fmt.Errorf("不明なロールです: %s", role)
+	}
+	if role != adminRoleOwner {
+		if err := ensureAnotherActiveOwner(id); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(`UPDATE admin_users SET role = ? WHERE id = ?`, role, id)
+	return err
+}
+
+func setAdminUserDisabled(id int64, disabled bool) error {
+	if disabled {
+		if err := ensureAnotherActiveOwner(id); err != nil {
+			return err
+		}
+		_, err := db.Exec(`UPDATE admin_users SET disabled_at = ? WHERE id = ?`, formatJSTDateTime(jstNow()), id)
+		return err
+	}
+	_, err := db.Exec(`UPDATE admin_users SET disabled_at = NULL WHERE id = ?`, id)
+	return err
+}
+
+// オーナーが1人もいなくなる変更は受け付けない
+func ensureAnotherActiveOwner(exceptID int64) error {
+	owners, err := countActiveOwners(exceptID)
+	if err != nil {
+		return err
+	}
+	if owners == 0 {
+		return errors.New("有効なオーナーが1人もいなくなるため変更できません")
+	}
+	return nil
+}
+
+// exceptID 以外の有効なオーナーの人数（全員を数えるなら 0）
+func countActiveOwners(exceptID int64) (int, error) {
+	var owners int
+	err := db.QueryRow(
+		`SELECT COUNT(*)
+           FROM admin_users
+          WHERE role = ? AND disabled_at IS NULL AND id <> ?`,
+		adminRoleOwner, exceptID,
+	).Scan(&owners)
+	return owners, err
+}
+
+func countAdminUsers() (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM admin_users`).Scan(&n)
+	return n, err
+}
+
+// 起動時に呼び出す。
+// 管理者がまだ1人もおらず ADMIN_USERNAME / ADMIN_PASSWORD が残っていれば、それをオーナーとして登録する
+// （単一アカウント時代の環境からの移行用）。
+func bootstrapAdminFromEnv() error {
+	n, err := countAdminUsers()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	username := os.Getenv("ADMIN_USERNAME")
+	password := os.Getenv("ADMIN_PASSWORD")
+	if username == "" || password == "" {
+		log.Println("⚠️ 管理者アカウントがありません。`checkin-app admin bootstrap <username>` で作成してください")
+		return nil
+	}
+
+	// 既存のパスワードで入れなくなると困るので、ここでは長さのチェックをしない
+	if _, err := insertAdminUser(username, password, adminRoleOwner); err != nil {
+		return fmt.Errorf("bootstrap admin from ADMIN_USERNAME: %w", err)
+	}
+	log.Printf("✅ ADMIN_USERNAME からオーナー %q を作成しました。ADMIN_PASSWORD は .env から削除してください\n", username)
+	return nil
+}
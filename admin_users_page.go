@@ -0,0 +1,219 @@
+// admin_users_page.go
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var adminUsersTmpl = mustParseAdminTemplate("admin_users.html")
+
+type adminRoleOption struct {
+	Value string
+	Label string
+}
+
+func adminRoleOptions() []adminRoleOption {
+	options := make([]adminRoleOption, 0, len(adminRoles))
+	for _, role := range adminRoles {
+		options = append(options, adminRoleOption{Value: role, Label: adminRoleLabel(role)})
+	}
+	return options
+}
+
+// GET /admin/users
+// POST /admin/users
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAdminUsers(w, r, "", r.URL.Query().Get("success_msg"))
+	case http.MethodPost:
+		handleAdminUsersPost(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAdminUsersPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	current := adminUserFromContext(r.Context())
+	action := r.FormValue("action")
+
+	if action == "create" {
+		username := r.FormValue("username")
+		role := r.FormValue("role")
+		if _, err := createAdminUser(username, r.FormValue("password"), role); err != nil {
+			renderAdminUsers(w, r, err.Error(), "")
+			return
+		}
+		recordAuditLog(r, auditEntry{
+			Action: auditActionAdminUserChange,
+			After:  map[string]string{"username": username, "role": role, "change": action},
+		})
+		log.Printf("[ADMIN] create admin user username=%s role=%s by=%s\n", username, role, current.Username)
+		redirectAdminUsers(w, r, "管理者「"+username+"」を作成しました。")
+		return
+	}
+
+	if action == "require_2fa" {
+		required := r.FormValue("required") == "1"
+		// 自分が締め出されないよう、先に自分の設定を済ませてもらう
+		if required && !current.TOTPEnabled {
+			renderAdminUsers(w, r, "必須にする前に、ご自身の2段階認証を設定してください。", "")
+			return
+		}
+		before, err := isAdmin2FARequired()
+		if err != nil {
+			log.Println("isAdmin2FARequired error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := setAdmin2FARequired(required); err != nil {
+			log.Println("setAdmin2FARequired error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		recordAuditLog(r, auditEntry{
+			Action: auditActionAdmin2FA,
+			Before: map[string]bool{"required": before},
+			After:  map[string]bool{"required": required},
+		})
+		log.Printf("[ADMIN] require 2fa=%t by=%s\n", required, current.Username)
+		if required {
+			redirectAdminUsers(w, r, "全員の2段階認証を必須にしました。未設定の人は次のアクセスで設定画面に案内されます。")
+		} else {
+			redirectAdminUsers(w, r, "2段階認証を任意に戻しました。")
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	target, err := getAdminUser(id)
+	if err == errAdminUserNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("getAdminUser error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var successMsg string
+	switch action {
+	case "role":
+		role := r.FormValue("role")
+		err = updateAdminUserRole(id, role)
+		successMsg = "「" + target.Username + "」のロールを" + adminRoleLabel(role) + "に変更しました。"
+	case "password":
+		err = updateAdminUserPassword(id, r.FormValue("password"))
+		successMsg = "「" + target.Username + "」のパスワードを変更しました。"
+	case "disable":
+		if id == current.ID {
+			renderAdminUsers(w, r, "自分自身のアカウントは無効化できません。", "")
+			return
+		}
+		err = setAdminUserDisabled(id, true)
+		successMsg = "「" + target.Username + "」を無効化しました。"
+	case "enable":
+		err = setAdminUserDisabled(id, false)
+		successMsg = "「" + target.Username + "」を有効化しました。"
+	case "reset_2fa":
+		// スマートフォンを無くしてリカバリーコードも無い人向け。次のログインはパスワードだけで入れる。
+		err = disableAdminTOTP(id)
+		successMsg = "「" + target.Username + "」の2段階認証をリセットしました。"
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		// 入力や「オーナーがいなくなる」などの業務エラーは画面に出す
+		renderAdminUsers(w, r, err.Error(), "")
+		return
+	}
+
+	// パスワード変更・無効化・2段階認証のリセットのときは、その人のログインを終わらせる（自分の今の端末は残す）
+	if action == "password" || action == "disable" || action == "reset_2fa" {
+		var keep int64
+		if s := adminSessionFromContext(r.Context()); s != nil && id == current.ID {
+			keep = s.ID
+		}
+		if _, err := deleteAdminSessionsForUser(id, keep); err != nil {
+			log.Println("deleteAdminSessionsForUser error:", err)
+		}
+	}
+
+	// パスワードそのものは残さない
+	after := map[string]string{"username": target.Username, "change": action}
+	if action == "role" {
+		after["role"] = r.FormValue("role")
+	}
+	auditAction := auditActionAdminUserChange
+	if action == "reset_2fa" {
+		auditAction = auditActionAdmin2FA
+	}
+	recordAuditLog(r, auditEntry{
+		Action: auditAction,
+		Before: map[string]interface{}{
+			"username": target.Username, "role": target.Role, "disabled": target.Disabled, "totp_enabled": target.TOTPEnabled,
+		},
+		After: after,
+	})
+	log.Printf("[ADMIN] %s admin user username=%s by=%s\n", action, target.Username, current.Username)
+	redirectAdminUsers(w, r, successMsg)
+}
+
+func redirectAdminUsers(w http.ResponseWriter, r *http.Request, successMsg string) {
+	http.Redirect(w, r, "/admin/users?success_msg="+url.QueryEscape(successMsg), http.StatusSeeOther)
+}
+
+func renderAdminUsers(w http.ResponseWriter, r *http.Request, errorMsg, successMsg string) {
+	users, err := listAdminUsers()
+	if err != nil {
+		log.Println("listAdminUsers error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	require2FA, err := isAdmin2FARequired()
+	if err != nil {
+		log.Println("isAdmin2FARequired error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Users             []adminUser
+		Require2FA        bool
+		Roles             []adminRoleOption
+		MinPasswordLength int
+		ActivePage        string
+		Admin             *adminUser
+		CSRFToken         string
+		SuccessMsg        string
+		ErrorMsg          string
+	}{
+		Users:             users,
+		Require2FA:        require2FA,
+		Roles:             adminRoleOptions(),
+		MinPasswordLength: adminMinPasswordLength,
+		ActivePage:        "users",
+		Admin:             adminUserFromContext(r.Context()),
+		CSRFToken:         csrfTokenFromContext(r.Context()),
+		SuccessMsg:        successMsg,
+		ErrorMsg:          errorMsg,
+	}
+
+	if err := adminUsersTmpl.Execute(w, data); err != nil {
+		log.Println("template execute error:", err)
+	}
+}
@@ -0,0 +1,96 @@
+// api.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 外部連携用の管理 API（/api/v1/admin/...）。
+// 管理画面の Cookie ではなく、管理画面で発行した Bearer トークンで認証する。
+// 仕様は public/api/v1/admin/openapi.yaml。
+
+const apiTokenContextKey contextKey = "api_token"
+
+// requireAPIToken を通ったリクエストのトークン
+func apiTokenFromContext(ctx context.Context) *apiToken {
+	t, _ := ctx.Value(apiTokenContextKey).(*apiToken)
+	return t
+}
+
+// Authorization: Bearer <token> を確かめ、scope が無ければ 403 を返す。
+// 発行した管理者を管理画面と同じコンテキストキーに入れるので、監査ログや権限の確認はそのまま使える。
+func requireAPIToken(scope apiScope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields := eventFieldsFromRequest(r)
+		raw, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || raw == "" {
+			fields["reason"] = "missing_token"
+			appLog.warn("api_auth_failed", fields)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin-api"`)
+			writeAPIError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+
+		token, user, err := authenticateAPIToken(raw, jstNow())
+		if err == errAPITokenInvalid {
+			fields["reason"] = "invalid_token"
+			appLog.warn("api_auth_failed", fields)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin-api", error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if err != nil {
+			log.Println("authenticateAPIToken error:", err)
+			writeAPIError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		// トークンのスコープと、発行した管理者の今のロールの両方を満たす必要がある
+		if !token.HasScope(scope) || !user.Can(scope.permission()) {
+			fields["reason"] = "insufficient_scope"
+			fields["scope"] = string(scope)
+			fields["api_token"] = token.Prefix
+			fields["admin_user"] = user.Username
+			appLog.warn("api_auth_failed", fields)
+			writeAPIError(w, http.StatusForbidden, "insufficient scope")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), adminUserContextKey, user)
+		ctx = context.WithValue(ctx, apiTokenContextKey, token)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("api json encode error:", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]string{"error": message})
+}
+
+// 想定外のエラーはログに残して 500 を返す
+func writeAPIInternalError(w http.ResponseWriter, operation string, err error) {
+	log.Println(operation+" error:", err)
+	writeAPIError(w, http.StatusInternalServerError, "internal server error")
+}
+
+// リクエストボディの JSON を読む。読めなければ 400 を返して false。
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return false
+	}
+	return true
+}
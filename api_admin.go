@@ -0,0 +1,603 @@
+// api_admin.go
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API の JSON で返す形。画面用の構造体をそのまま出さず、キーは camelCase にそろえる。
+
+type apiMember struct {
+	LineUserID   string `json:"lineUserId"`
+	DisplayName  string `json:"displayName"`
+	FullName     string `json:"fullName"`
+	MemberType   string `json:"memberType"`
+	PlanName     string `json:"planName"`
+	PosterID     string `json:"posterId"`
+	MonthlyCount int    `json:"monthlyCount"`
+}
+
+type apiVisitSummary struct {
+	LineUserID  string `json:"lineUserId"`
+	DisplayName string `json:"displayName"`
+	FullName    string `json:"fullName"`
+	MemberType  string `json:"memberType"`
+	PlanName    string `json:"planName"`
+	PosterID    string `json:"posterId"`
+	Count       int    `json:"count"`
+	Expected    int    `json:"expected"`
+	Balance     int    `json:"balance"`
+	InsideNow   bool   `json:"insideNow"`
+}
+
+type apiVisit struct {
+	ID             int    `json:"id"`
+	VisitedAt      string `json:"visitedAt"`
+	CheckedOutAt   string `json:"checkedOutAt,omitempty"`
+	CheckoutReason string `json:"checkoutReason,omitempty"`
+	StaySeconds    int    `json:"staySeconds,omitempty"`
+	NeedPayment    bool   `json:"needPayment"`
+	Paid           bool   `json:"paid"`
+	TicketUsed     bool   `json:"ticketUsed"`
+	PaymentID      int64  `json:"paymentId,omitempty"`
+	Source         string `json:"source,omitempty"`
+}
+
+type apiPayment struct {
+	ID         int64  `json:"id"`
+	LineUserID string `json:"lineUserId"`
+	VisitID    int64  `json:"visitId,omitempty"`
+	Month      string `json:"month"`
+	Amount     int    `json:"amount"`
+	Method     string `json:"method"`
+	ReceivedBy string `json:"receivedBy,omitempty"`
+	ReceivedAt string `json:"receivedAt,omitempty"`
+	Note       string `json:"note"`
+}
+
+type apiStatement struct {
+	PlanCode       string       `json:"planCode"`
+	PlanName       string       `json:"planName"`
+	VisitCount     int          `json:"visitCount"`
+	BillableVisits int          `json:"billableVisits"`
+	TicketVisits   int          `json:"ticketVisits"`
+	MonthlyFee     int          `json:"monthlyFee"`
+	ExtraCharges   int          `json:"extraCharges"`
+	Expected       int          `json:"expected"`
+	Received       int          `json:"received"`
+	Balance        int          `json:"balance"`
+	Payments       []apiPayment `json:"payments"`
+}
+
+type apiDailyVisitor struct {
+	LineUserID         string `json:"lineUserId"`
+	DisplayName        string `json:"displayName"`
+	FullName           string `json:"fullName"`
+	MemberType         string `json:"memberType"`
+	PlanName           string `json:"planName"`
+	PosterID           string `json:"posterId"`
+	FirstVisitAt       string `json:"firstVisitAt"` // "15:04"
+	MonthlyCount       int    `json:"monthlyCount"`
+	StaySeconds        int    `json:"staySeconds,omitempty"`
+	AverageStaySeconds int    `json:"averageStaySeconds,omitempty"`
+	InsideNow          bool   `json:"insideNow"`
+}
+
+type apiCalendarDay struct {
+	Date               string `json:"date"`
+	Visitors           int    `json:"visitors"`
+	AverageStaySeconds int    `json:"averageStaySeconds,omitempty"`
+	Closed             bool   `json:"closed"`
+	ClosedReason       string `json:"closedReason,omitempty"`
+	Holiday            string `json:"holiday,omitempty"`
+}
+
+// DB の日時（JST "2006-01-02 15:04:05"）を RFC 3339 にする。空ならそのまま。
+func apiDateTime(s string) string {
+	return apiTimeIn("2006-01-02 15:04:05", s)
+}
+
+func apiTimeIn(layout, s string) string {
+	if s == "" {
+		return ""
+	}
+	t, err := time.ParseInLocation(layout, s, jst)
+	if err != nil {
+		return s
+	}
+	return t.Format(time.RFC3339)
+}
+
+func newAPIVisitSummaries(list []VisitSummary) []apiVisitSummary {
+	out := make([]apiVisitSummary, 0, len(list))
+	for _, s := range list {
+		out = append(out, apiVisitSummary{
+			LineUserID:  s.LineUserID,
+			DisplayName: s.DisplayName,
+			FullName:    s.FullName,
+			MemberType:  s.MemberType,
+			PlanName:    s.Plan.Name,
+			PosterID:    s.PosterID,
+			Count:       s.Count,
+			Expected:    s.Expected,
+			Balance:     s.Balance,
+			InsideNow:   s.InsideNow,
+		})
+	}
+	return out
+}
+
+func newAPIPayment(p payment) apiPayment {
+	return apiPayment{
+		ID:         p.ID,
+		LineUserID: p.LineUserID,
+		VisitID:    p.VisitID,
+		Month:      p.Month,
+		Amount:     p.Amount,
+		Method:     p.Method,
+		ReceivedBy: p.ReceivedBy,
+		ReceivedAt: apiTimeIn("2006/01/02 15:04", p.ReceivedAt),
+		Note:       p.Note,
+	}
+}
+
+func newAPIStatement(s memberStatement) apiStatement {
+	out := apiStatement{
+		PlanCode:       s.Plan.Code,
+		PlanName:       s.Plan.Name,
+		VisitCount:     s.VisitCount,
+		BillableVisits: s.BillableVisits,
+		TicketVisits:   s.TicketVisits,
+		MonthlyFee:     s.MonthlyFee,
+		ExtraCharges:   s.ExtraCharges,
+		Expected:       s.Expected,
+		Received:       s.Received,
+		Balance:        s.Balance,
+		Payments:       make([]apiPayment, 0, len(s.Payments)),
+	}
+	for _, p := range s.Payments {
+		out.Payments = append(out.Payments, newAPIPayment(p))
+	}
+	return out
+}
+
+// ?month=YYYY-MM を読む。空なら今月。
+func apiMonthParam(r *http.Request) (time.Time, bool) {
+	ym := r.URL.Query().Get("month")
+	if ym == "" {
+		return monthStart(jstNow()), true
+	}
+	t, err := time.ParseInLocation("2006-01", ym, jst)
+	return t, err == nil
+}
+
+// ?member_type= がプランに無ければ false
+func apiMemberTypeParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	memberType := r.URL.Query().Get("member_type")
+	if memberType == "" {
+		return "", true
+	}
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		writeAPIInternalError(w, "loadPlanCatalog", err)
+		return "", false
+	}
+	if !plans.has(memberType) {
+		writeAPIError(w, http.StatusBadRequest, "unknown member_type")
+		return "", false
+	}
+	return memberType, true
+}
+
+// GET /api/v1/admin/members?q=&member_type=
+func handleAPIMembers(w http.ResponseWriter, r *http.Request) {
+	memberType, ok := apiMemberTypeParam(w, r)
+	if !ok {
+		return
+	}
+	members, err := getMemberSummaries(strings.TrimSpace(r.URL.Query().Get("q")), memberType)
+	if err != nil {
+		writeAPIInternalError(w, "getMemberSummaries", err)
+		return
+	}
+
+	out := make([]apiMember, 0, len(members))
+	for _, m := range members {
+		out = append(out, apiMember{
+			LineUserID:   m.LineUserID,
+			DisplayName:  m.DisplayName,
+			FullName:     m.FullName,
+			MemberType:   m.MemberType,
+			PlanName:     m.Plan.Name,
+			PosterID:     m.PosterID,
+			MonthlyCount: m.MonthlyCount,
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"members": out})
+}
+
+// GET /api/v1/admin/members/{lineUserId}/visits?month=YYYY-MM
+func handleAPIMemberVisits(w http.ResponseWriter, r *http.Request) {
+	base, ok := apiMonthParam(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "month must be YYYY-MM")
+		return
+	}
+	lineUserID := r.PathValue("lineUserId")
+
+	detail, err := getUserMonthlyVisitDetail(lineUserID, formatJSTMonth(base))
+	if err != nil {
+		writeAPIInternalError(w, "getUserMonthlyVisitDetail", err)
+		return
+	}
+
+	visits := make([]apiVisit, 0, len(detail.Visits))
+	for _, v := range detail.Visits {
+		av := apiVisit{
+			ID:           v.ID,
+			VisitedAt:    apiDateTime(v.VisitedAt),
+			CheckedOutAt: apiDateTime(v.CheckedOutAt),
+			StaySeconds:  v.StaySeconds,
+			NeedPayment:  v.NeedPayment,
+			Paid:         v.Paid,
+			TicketUsed:   v.TicketUsed,
+			Source:       v.SourceCode,
+		}
+		if v.CheckedOutAt != "" {
+			av.CheckoutReason = v.CheckoutReasonCode
+		}
+		if v.Payment != nil {
+			av.PaymentID = v.Payment.ID
+		}
+		visits = append(visits, av)
+	}
+
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"member": apiMember{
+			LineUserID:   lineUserID,
+			DisplayName:  detail.DisplayName,
+			FullName:     detail.FullName,
+			MemberType:   detail.MemberType,
+			PlanName:     detail.Plan.Name,
+			PosterID:     detail.PosterID,
+			MonthlyCount: detail.Count,
+		},
+		"month":     detail.MonthKey,
+		"archived":  detail.Rollup != nil,
+		"visits":    visits,
+		"statement": newAPIStatement(detail.Statement),
+	})
+}
+
+// GET /api/v1/admin/visits?month=YYYY-MM&q=&member_type=
+func handleAPIVisits(w http.ResponseWriter, r *http.Request) {
+	base, ok := apiMonthParam(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "month must be YYYY-MM")
+		return
+	}
+	memberType, ok := apiMemberTypeParam(w, r)
+	if !ok {
+		return
+	}
+
+	summaries, err := getMonthlySummaries(base.Year(), int(base.Month()), strings.TrimSpace(r.URL.Query().Get("q")), memberType)
+	if err != nil {
+		writeAPIInternalError(w, "getMonthlySummaries", err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"month":  formatJSTMonth(base),
+		"visits": newAPIVisitSummaries(summaries),
+	})
+}
+
+// GET /api/v1/admin/visits/today
+func handleAPIVisitsToday(w http.ResponseWriter, r *http.Request) {
+	summaries, err := getTodaySummaries()
+	if err != nil {
+		writeAPIInternalError(w, "getTodaySummaries", err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"date":         formatJSTDate(jstNow()),
+		"currentCount": getCurrentCount(),
+		"visits":       newAPIVisitSummaries(summaries),
+	})
+}
+
+// GET /api/v1/admin/visits/day?date=YYYY-MM-DD
+func handleAPIVisitsDay(w http.ResponseWriter, r *http.Request) {
+	target, err := time.ParseInLocation("2006-01-02", r.URL.Query().Get("date"), jst)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "date must be YYYY-MM-DD")
+		return
+	}
+
+	visitors, err := getDailyVisitors(formatJSTDate(target), formatJSTMonth(target))
+	if err != nil {
+		writeAPIInternalError(w, "getDailyVisitors", err)
+		return
+	}
+
+	out := make([]apiDailyVisitor, 0, len(visitors))
+	for _, v := range visitors {
+		out = append(out, apiDailyVisitor{
+			LineUserID:         v.LineUserID,
+			DisplayName:        v.DisplayName,
+			FullName:           v.FullName,
+			MemberType:         v.MemberType,
+			PlanName:           v.Plan.Name,
+			PosterID:           v.PosterID,
+			FirstVisitAt:       v.FirstVisitAt,
+			MonthlyCount:       v.MonthlyCount,
+			StaySeconds:        v.StaySeconds,
+			AverageStaySeconds: v.AverageStaySeconds,
+			InsideNow:          v.InsideNow,
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"date":     formatJSTDate(target),
+		"visitors": out,
+	})
+}
+
+// GET /api/v1/admin/calendar?month=YYYY-MM
+func handleAPICalendar(w http.ResponseWriter, r *http.Request) {
+	base, ok := apiMonthParam(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "month must be YYYY-MM")
+		return
+	}
+	monthKey := formatJSTMonth(base)
+
+	counts, monthlyTotal, err := getMonthlyDailyVisitorCounts(monthKey)
+	if err != nil {
+		writeAPIInternalError(w, "getMonthlyDailyVisitorCounts", err)
+		return
+	}
+	averages, err := getMonthlyDailyAverageStay(monthKey)
+	if err != nil {
+		writeAPIInternalError(w, "getMonthlyDailyAverageStay", err)
+		return
+	}
+
+	var days []apiCalendarDay
+	for d := base; d.Month() == base.Month(); d = d.AddDate(0, 0, 1) {
+		day := apiCalendarDay{
+			Date:               formatJSTDate(d),
+			Visitors:           counts[d.Day()],
+			AverageStaySeconds: averages[d.Day()],
+		}
+		if businessHours != nil {
+			bd := businessHours.day(d)
+			day.Closed = bd.Hours.Closed
+			day.ClosedReason = bd.Note
+			day.Holiday = bd.HolidayName
+		}
+		days = append(days, day)
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"month":           monthKey,
+		"monthlyVisitors": monthlyTotal,
+		"days":            days,
+	})
+}
+
+// GET /api/v1/admin/payments?line_user_id=...&month=YYYY-MM
+func handleAPIPayments(w http.ResponseWriter, r *http.Request) {
+	lineUserID := r.URL.Query().Get("line_user_id")
+	if lineUserID == "" {
+		writeAPIError(w, http.StatusBadRequest, "line_user_id is required")
+		return
+	}
+	base, ok := apiMonthParam(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "month must be YYYY-MM")
+		return
+	}
+
+	detail, err := getUserMonthlyVisitDetail(lineUserID, formatJSTMonth(base))
+	if err != nil {
+		writeAPIInternalError(w, "getUserMonthlyVisitDetail", err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"lineUserId": lineUserID,
+		"month":      detail.MonthKey,
+		"statement":  newAPIStatement(detail.Statement),
+	})
+}
+
+type apiPaymentRequest struct {
+	LineUserID string `json:"lineUserId"`
+	Month      string `json:"month"`   // visitId が無いときは必須
+	VisitID    int64  `json:"visitId"` // 来店（追加1回分）の支払いなら指定
+	Amount     int    `json:"amount"`
+	Method     string `json:"method"`
+	Note       string `json:"note"`
+}
+
+// POST /api/v1/admin/payments
+func handleAPIPaymentCreate(w http.ResponseWriter, r *http.Request) {
+	var req apiPaymentRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if req.LineUserID == "" || req.Amount < 0 || !isValidPaymentMethod(req.Method) {
+		writeAPIError(w, http.StatusBadRequest, "lineUserId, amount (>= 0) and method (cash, card, qr) are required")
+		return
+	}
+	if req.VisitID == 0 {
+		if _, err := time.ParseInLocation("2006-01", req.Month, jst); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "month must be YYYY-MM")
+			return
+		}
+	}
+
+	p, err := recordPayment(r, payment{
+		LineUserID: req.LineUserID,
+		VisitID:    req.VisitID,
+		Month:      req.Month,
+		Amount:     req.Amount,
+		Method:     req.Method,
+		Note:       strings.TrimSpace(req.Note),
+	})
+	if err == errMemberNotFound {
+		writeAPIError(w, http.StatusNotFound, "member not found")
+		return
+	}
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "visit not found")
+		return
+	}
+	if err == errVisitAlreadyPaid {
+		writeAPIError(w, http.StatusConflict, "visit already paid")
+		return
+	}
+	if err != nil {
+		writeAPIInternalError(w, "insert payment", err)
+		return
+	}
+
+	log.Printf("[API] add payment: id=%d user=%s visit=%d amount=%d method=%s\n",
+		p.ID, p.LineUserID, p.VisitID, p.Amount, p.Method)
+	writeAPIJSON(w, http.StatusCreated, newAPIPayment(p))
+}
+
+// DELETE /api/v1/admin/payments/{id}
+func handleAPIPaymentDelete(w http.ResponseWriter, r *http.Request) {
+	paymentID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid payment id")
+		return
+	}
+
+	before, err := cancelPayment(r, paymentID)
+	if err == errPaymentNotFound {
+		writeAPIError(w, http.StatusNotFound, "payment not found")
+		return
+	}
+	if err != nil {
+		writeAPIInternalError(w, "delete payment", err)
+		return
+	}
+
+	log.Printf("[API] delete payment: id=%d user=%s amount=%d\n", before.ID, before.LineUserID, before.Amount)
+	writeAPIJSON(w, http.StatusOK, newAPIPayment(before))
+}
+
+// POST /api/v1/admin/visits
+func handleAPIVisitCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		LineUserID string `json:"lineUserId"`
+	}
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if req.LineUserID == "" {
+		writeAPIError(w, http.StatusBadRequest, "lineUserId is required")
+		return
+	}
+
+	visitID, err := addManualVisit(r, req.LineUserID)
+	if err != nil {
+		writeAPIInternalError(w, "insert visit", err)
+		return
+	}
+	writeAPIJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":         visitID,
+		"lineUserId": req.LineUserID,
+	})
+}
+
+// POST /api/v1/admin/members/{lineUserId}/checkout
+func handleAPIMemberCheckout(w http.ResponseWriter, r *http.Request) {
+	lineUserID := r.PathValue("lineUserId")
+	wasInside := isCheckedIn(lineUserID)
+
+	count, err := adminCheckout(r, lineUserID)
+	if err != nil {
+		writeAPIInternalError(w, "admin checkout", err)
+		return
+	}
+
+	log.Printf("[API] checkout: user=%s count_after=%d\n", lineUserID, count)
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"lineUserId":   lineUserID,
+		"wasInside":    wasInside,
+		"currentCount": count,
+	})
+}
+
+// PATCH /api/v1/admin/members/{lineUserId}
+//
+// 指定したキーだけ変える。posterId は空文字でクリア。
+func handleAPIMemberUpdate(w http.ResponseWriter, r *http.Request) {
+	// 会員情報の変更は来店の編集とは別の権限
+	if !adminUserFromContext(r.Context()).Can(permEditMembers) {
+		writeAPIError(w, http.StatusForbidden, "insufficient scope")
+		return
+	}
+
+	var req struct {
+		MemberType *string `json:"memberType"`
+		PosterID   *string `json:"posterId"`
+	}
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if req.MemberType == nil && req.PosterID == nil {
+		writeAPIError(w, http.StatusBadRequest, "memberType or posterId is required")
+		return
+	}
+	lineUserID := r.PathValue("lineUserId")
+
+	// 先に全部確かめてから、両方を1つのトランザクションで変える（途中で失敗したら何も変えない）
+	if req.MemberType != nil {
+		_, err := getPlan(*req.MemberType)
+		if err == errPlanNotFound {
+			writeAPIError(w, http.StatusBadRequest, "unknown memberType")
+			return
+		}
+		if err != nil {
+			writeAPIInternalError(w, "get plan", err)
+			return
+		}
+	}
+
+	err := runAuditedTx(func(tx *sql.Tx) error {
+		if req.MemberType != nil {
+			if err := updateMemberTypeTx(tx, r, lineUserID, *req.MemberType); err != nil {
+				return err
+			}
+		}
+		if req.PosterID != nil {
+			if _, err := updateMemberPosterIDTx(tx, r, lineUserID, strings.TrimSpace(*req.PosterID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "member not found")
+		return
+	}
+	if err != nil {
+		writeAPIInternalError(w, "update member", err)
+		return
+	}
+	if req.MemberType != nil {
+		log.Printf("[API] change member_type: %s -> %s\n", lineUserID, *req.MemberType)
+	}
+	if req.PosterID != nil {
+		log.Printf("[API] update poster_id: %s -> %s\n", lineUserID, *req.PosterID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
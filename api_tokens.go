@@ -0,0 +1,257 @@
+// api_tokens.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// API トークンの権限。1つのトークンに複数付けられる。
+type apiScope string
+
+const (
+	apiScopeRead    apiScope = "read"    // 一覧・詳細の取得
+	apiScopeBilling apiScope = "billing" // 入金の取得・記録・取消
+	apiScopeWrite   apiScope = "write"   // 来店の追加・チェックアウト・会員情報の変更
+)
+
+type apiScopeOption struct {
+	Value apiScope
+	Label string
+}
+
+var apiScopeOptions = []apiScopeOption{
+	{apiScopeRead, "read（閲覧）"},
+	{apiScopeBilling, "billing（入金）"},
+	{apiScopeWrite, "write（来店・会員の変更）"},
+}
+
+// スコープごとに、発行した管理者に求める権限
+func (s apiScope) permission() adminPermission {
+	switch s {
+	case apiScopeBilling:
+		return permMarkPayment
+	case apiScopeWrite:
+		return permEditVisits
+	default:
+		return permView
+	}
+}
+
+func isValidAPIScope(s string) bool {
+	for _, o := range apiScopeOptions {
+		if string(o.Value) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 見分けやすいように固定の接頭辞を付ける
+const apiTokenPrefix = "ecapi_"
+
+// last_used_at の更新はこの間隔より細かくはしない
+const apiTokenTouchInterval = time.Minute
+
+var errAPITokenInvalid = errors.New("api token invalid")
+
+type apiToken struct {
+	ID            int64
+	Name          string
+	Prefix        string
+	Scopes        []apiScope
+	AdminUserID   int64
+	AdminUsername string
+	CreatedAt     string
+	ExpiresAt     string // 空なら無期限
+	LastUsedAt    string // 空なら未使用
+	RevokedAt     string // 空なら有効
+	Expired       bool
+}
+
+func (t *apiToken) HasScope(s apiScope) bool {
+	for _, have := range t.Scopes {
+		if have == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *apiToken) ScopesLabel() string {
+	names := make([]string, len(t.Scopes))
+	for i, s := range t.Scopes {
+		names[i] = string(s)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (t *apiToken) Active() bool {
+	return t.RevokedAt == "" && !t.Expired
+}
+
+// 監査ログに出す識別子（セッションの代わり）
+func (t *apiToken) Ref() string {
+	return "api:" + t.Prefix
+}
+
+func parseAPIScopes(s string) []apiScope {
+	var scopes []apiScope
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			scopes = append(scopes, apiScope(v))
+		}
+	}
+	return scopes
+}
+
+const apiTokenColumns = `
+  t.id,
+  t.name,
+  t.token_prefix,
+  t.scopes,
+  t.admin_user_id,
+  IFNULL(u.username, ''),
+  strftime('%Y-%m-%d %H:%M', t.created_at),
+  IFNULL(strftime('%Y-%m-%d %H:%M', t.expires_at), ''),
+  IFNULL(strftime('%Y-%m-%d %H:%M', t.last_used_at), ''),
+  IFNULL(strftime('%Y-%m-%d %H:%M', t.revoked_at), ''),
+  t.expires_at IS NOT NULL AND t.expires_at <= ?
+`
+
+func scanAPIToken(scan func(dest ...interface{}) error) (*apiToken, error) {
+	var (
+		t      apiToken
+		scopes string
+	)
+	if err := scan(&t.ID, &t.Name, &t.Prefix, &scopes, &t.AdminUserID, &t.AdminUsername,
+		&t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt, &t.Expired); err != nil {
+		return nil, err
+	}
+	t.Scopes = parseAPIScopes(scopes)
+	return &t, nil
+}
+
+// 発行する。生のトークンを返すのはこのときだけ。
+func createAPIToken(ex sqlExecer, name string, scopes []apiScope, adminUserID int64, ttl time.Duration) (string, *apiToken, error) {
+	secret, err := newAdminSessionToken()
+	if err != nil {
+		return "", nil, err
+	}
+	raw := apiTokenPrefix + secret
+
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = string(s)
+	}
+	now := jstNow()
+	t := &apiToken{
+		Name:        name,
+		Prefix:      raw[:len(apiTokenPrefix)+8],
+		Scopes:      scopes,
+		AdminUserID: adminUserID,
+		CreatedAt:   formatJSTDateTime(now),
+	}
+	var expiresAt interface{}
+	if ttl > 0 {
+		t.ExpiresAt = formatJSTDateTime(now.Add(ttl))
+		expiresAt = t.ExpiresAt
+	}
+
+	res, err := ex.Exec(
+		`INSERT INTO api_tokens(name, token_hash, token_prefix, scopes, admin_user_id, created_at, expires_at)
+         VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		name, hashAdminSessionToken(raw), t.Prefix, strings.Join(names, ","), adminUserID, t.CreatedAt, expiresAt,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.ID, err = res.LastInsertId(); err != nil {
+		return "", nil, err
+	}
+	return raw, t, nil
+}
+
+func listAPITokens() ([]apiToken, error) {
+	rows, err := db.Query(`SELECT `+apiTokenColumns+`
+FROM api_tokens t
+LEFT JOIN admin_users u ON u.id = t.admin_user_id
+ORDER BY t.revoked_at IS NOT NULL, t.created_at DESC, t.id DESC`, formatJSTDateTime(jstNow()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []apiToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *t)
+	}
+	return list, rows.Err()
+}
+
+func getAPIToken(id int64) (*apiToken, error) {
+	return scanAPIToken(db.QueryRow(`SELECT `+apiTokenColumns+`
+FROM api_tokens t
+LEFT JOIN admin_users u ON u.id = t.admin_user_id
+WHERE t.id = ?`, formatJSTDateTime(jstNow()), id).Scan)
+}
+
+func revokeAPIToken(ex sqlExecer, id int64) error {
+	res, err := ex.Exec(
+		`UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		formatJSTDateTime(jstNow()), id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Authorization ヘッダーのトークンを確かめ、発行した管理者と一緒に返す。
+// 取り消し・期限切れ・発行者が無効化されている場合は errAPITokenInvalid。
+func authenticateAPIToken(raw string, now time.Time) (*apiToken, *adminUser, error) {
+	if !strings.HasPrefix(raw, apiTokenPrefix) {
+		return nil, nil, errAPITokenInvalid
+	}
+	t, err := scanAPIToken(db.QueryRow(`SELECT `+apiTokenColumns+`
+FROM api_tokens t
+LEFT JOIN admin_users u ON u.id = t.admin_user_id
+WHERE t.token_hash = ?`, formatJSTDateTime(now), hashAdminSessionToken(raw)).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil, errAPITokenInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !t.Active() {
+		return nil, nil, errAPITokenInvalid
+	}
+
+	user, err := getAdminUser(t.AdminUserID)
+	if err == errAdminUserNotFound {
+		return nil, nil, errAPITokenInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, errAPITokenInvalid
+	}
+
+	if _, err := db.Exec(
+		`UPDATE api_tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at <= ?)`,
+		formatJSTDateTime(now), t.ID, formatJSTDateTime(now.Add(-apiTokenTouchInterval)),
+	); err != nil {
+		return nil, nil, err
+	}
+	return t, user, nil
+}
@@ -0,0 +1,322 @@
+// audit.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// audit_log.action に入る値
+const (
+	auditActionVisitPay        = "visit.pay"
+	auditActionVisitAdd        = "visit.add"
+	auditActionVisitDelete     = "visit.delete"
+	auditActionVisitCheckout   = "visit.checkout"
+	auditActionMemberType      = "member.type"
+	auditActionMemberPosterID  = "member.poster_id"
+	auditActionSettingsUpdate  = "settings.update"
+	auditActionSettingsReset   = "settings.reset"
+	auditActionAdminUserChange = "admin_user.change"
+	auditActionAdmin2FA        = "admin_user.2fa"
+	auditActionPlanCreate      = "plan.create"
+	auditActionPlanUpdate      = "plan.update"
+	auditActionPlanDelete      = "plan.delete"
+	auditActionPaymentAdd      = "payment.add"
+	auditActionPaymentDelete   = "payment.delete"
+	auditActionTicketProduct   = "ticket_product.change"
+	auditActionTicketSell      = "ticket.sell"
+	auditActionTicketRefund    = "ticket.refund"
+	auditActionTicketAdjust    = "ticket.adjust"
+	auditActionAPITokenCreate  = "api_token.create"
+	auditActionAPITokenRevoke  = "api_token.revoke"
+	auditActionMemberImport    = "member.import"
+	auditActionBackupRun       = "backup.run"
+	auditActionMemberCreate    = "member.create"
+	auditActionMemberKana      = "member.kana"
+	auditActionKioskDeviceAdd  = "kiosk_device.create"
+	auditActionKioskDeviceDel  = "kiosk_device.revoke"
+)
+
+func auditActionLabel(action string) string {
+	switch action {
+	case auditActionVisitPay:
+		return "支払いチェック"
+	case auditActionVisitAdd:
+		return "来店履歴の追加"
+	case auditActionVisitDelete:
+		return "来店履歴の削除"
+	case auditActionVisitCheckout:
+		return "チェックアウト"
+	case auditActionMemberType:
+		return "会員種別の変更"
+	case auditActionMemberPosterID:
+		return "PosterIDの変更"
+	case auditActionSettingsUpdate:
+		return "設定の変更"
+	case auditActionSettingsReset:
+		return "設定のリセット"
+	case auditActionAdminUserChange:
+		return "管理者アカウントの変更"
+	case auditActionAdmin2FA:
+		return "2段階認証の変更"
+	case auditActionPlanCreate:
+		return "プランの追加"
+	case auditActionPlanUpdate:
+		return "プランの変更"
+	case auditActionPlanDelete:
+		return "プランの削除"
+	case auditActionPaymentAdd:
+		return "入金の記録"
+	case auditActionPaymentDelete:
+		return "入金の取消"
+	case auditActionTicketProduct:
+		return "回数券の商品の変更"
+	case auditActionTicketSell:
+		return "回数券の販売"
+	case auditActionTicketRefund:
+		return "回数券の返金"
+	case auditActionTicketAdjust:
+		return "回数券の調整"
+	case auditActionAPITokenCreate:
+		return "APIトークンの発行"
+	case auditActionAPITokenRevoke:
+		return "APIトークンの取消"
+	case auditActionMemberImport:
+		return "会員の一括登録"
+	case auditActionBackupRun:
+		return "バックアップの実行"
+	case auditActionMemberCreate:
+		return "会員の登録（LINEなし）"
+	case auditActionMemberKana:
+		return "ふりがなの変更"
+	case auditActionKioskDeviceAdd:
+		return "スタッフ端末の登録"
+	case auditActionKioskDeviceDel:
+		return "スタッフ端末の取消"
+	default:
+		return action
+	}
+}
+
+// 監査ログ1件分。Before / After は JSON にして保存する（nil は NULL）。
+type auditEntry struct {
+	Action     string
+	LineUserID string
+	VisitID    int64
+	Before     interface{}
+	After      interface{}
+}
+
+// *sql.DB と *sql.Tx のどちらでも書けるように
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// 監査ログに残す操作者。画面・API からはリクエストから、CLI からは cliAuditActor を使う。
+type auditActor struct {
+	AdminUserID   interface{} // admin_users.id。無ければ nil
+	AdminUsername string
+	SessionRef    string
+	RequestID     string
+	RemoteIP      string
+}
+
+// CLI（サブコマンド）からの変更
+var cliAuditActor = auditActor{AdminUsername: "(CLI)", SessionRef: "cli"}
+
+func auditActorFromRequest(r *http.Request) auditActor {
+	var a auditActor
+	if u := adminUserFromContext(r.Context()); u != nil {
+		a.AdminUserID = u.ID
+		a.AdminUsername = u.Username
+	}
+	if s := adminSessionFromContext(r.Context()); s != nil {
+		a.SessionRef = s.Ref()
+	} else if t := apiTokenFromContext(r.Context()); t != nil {
+		a.SessionRef = t.Ref()
+	}
+	a.RequestID = requestIDFromContext(r.Context())
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	a.RemoteIP = host
+	return a
+}
+
+// 変更と同じトランザクションで書けば、記録の無い変更は残らない
+func writeAuditLog(ex sqlExecer, r *http.Request, e auditEntry) error {
+	return writeAuditLogAs(ex, auditActorFromRequest(r), e)
+}
+
+func writeAuditLogAs(ex sqlExecer, actor auditActor, e auditEntry) error {
+	before, err := auditJSON(e.Before)
+	if err != nil {
+		return err
+	}
+	after, err := auditJSON(e.After)
+	if err != nil {
+		return err
+	}
+
+	var (
+		lineUserID interface{}
+		visitID    interface{}
+	)
+	if e.LineUserID != "" {
+		lineUserID = e.LineUserID
+	}
+	if e.VisitID > 0 {
+		visitID = e.VisitID
+	}
+
+	_, err = ex.Exec(
+		`INSERT INTO audit_log(
+           created_at, admin_user_id, admin_username, admin_session, request_id, remote_ip,
+           action, line_user_id, visit_id, before_value, after_value)
+         VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		formatJSTDateTime(jstNow()), actor.AdminUserID, actor.AdminUsername,
+		actor.SessionRef, actor.RequestID, actor.RemoteIP,
+		e.Action, lineUserID, visitID, before, after,
+	)
+	return err
+}
+
+// トランザクションを張らない変更（メモリ上の状態も絡むもの）の後に呼ぶ。
+// 変更自体は済んでいるので、失敗してもログに残すだけにする。
+func recordAuditLog(r *http.Request, e auditEntry) {
+	if err := writeAuditLog(db, r, e); err != nil {
+		fields := eventFieldsFromRequest(r)
+		fields["operation"] = "write_audit_log"
+		fields["action"] = e.Action
+		fields["error"] = err.Error()
+		appLog.error("db_error", fields)
+	}
+}
+
+func auditJSON(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// 監査ログ画面の1行分
+type AuditLogRow struct {
+	ID            int64
+	CreatedAt     string
+	AdminUsername string
+	AdminSession  string
+	Action        string
+	ActionLabel   string
+	LineUserID    string
+	MemberName    string
+	VisitID       int64
+	Before        string
+	After         string
+}
+
+type auditLogFilter struct {
+	LineUserID string // 完全一致
+	Q          string // 名前 / LINE ID / PosterID の部分一致
+	From       string // "YYYY-MM-DD"（含む）
+	To         string // "YYYY-MM-DD"（含む）
+	Action     string
+}
+
+const auditLogPageLimit = 500
+
+func getAuditLogs(f auditLogFilter) ([]AuditLogRow, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if f.LineUserID != "" {
+		where = append(where, "a.line_user_id = ?")
+		args = append(args, f.LineUserID)
+	}
+	if f.Q != "" {
+		like := "%" + f.Q + "%"
+		where = append(where, `(a.line_user_id LIKE ? OR m.display_name LIKE ? OR m.full_name LIKE ? OR m.poster_id LIKE ?)`)
+		args = append(args, like, like, like, like)
+	}
+	if f.From != "" {
+		where = append(where, "a.created_at >= ?")
+		args = append(args, f.From+" 00:00:00")
+	}
+	if f.To != "" {
+		where = append(where, "a.created_at <= ?")
+		args = append(args, f.To+" 23:59:59")
+	}
+	if f.Action != "" {
+		where = append(where, "a.action = ?")
+		args = append(args, f.Action)
+	}
+
+	query := `
+SELECT
+  a.id,
+  strftime('%Y/%m/%d %H:%M:%S', a.created_at),
+  IFNULL(a.admin_username, ''),
+  IFNULL(a.admin_session, ''),
+  a.action,
+  IFNULL(a.line_user_id, ''),
+  IFNULL(NULLIF(m.full_name, ''), IFNULL(m.display_name, '')),
+  IFNULL(a.visit_id, 0),
+  IFNULL(a.before_value, ''),
+  IFNULL(a.after_value, '')
+FROM audit_log a
+LEFT JOIN members m ON m.line_user_id = a.line_user_id
+`
+	if len(where) > 0 {
+		query += "WHERE " + strings.Join(where, " AND ") + "\n"
+	}
+	query += "ORDER BY a.id DESC\nLIMIT ?"
+	args = append(args, auditLogPageLimit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []AuditLogRow
+	for rows.Next() {
+		var row AuditLogRow
+		if err := rows.Scan(
+			&row.ID, &row.CreatedAt, &row.AdminUsername, &row.AdminSession, &row.Action,
+			&row.LineUserID, &row.MemberName, &row.VisitID, &row.Before, &row.After,
+		); err != nil {
+			return nil, err
+		}
+		row.ActionLabel = auditActionLabel(row.Action)
+		list = append(list, row)
+	}
+	return list, rows.Err()
+}
+
+// POST ハンドラ共通: トランザクション内で変更と監査ログをまとめて書く
+func runAuditedTx(fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/subtle"
+	"database/sql"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"html/template"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -19,63 +22,90 @@ const (
 	adminSessionTTL        = 12 * time.Hour
 )
 
-type adminAuthConfig struct {
-	username string
-	password string
-}
-
-type adminSession struct {
-	expiresAt time.Time
-}
-
 type adminAuth struct {
-	config       adminAuthConfig
-	mu           sync.Mutex
-	sessions     map[string]adminSession
 	loginTmpl    *template.Template
+	mfaTmpl      *template.Template
 	cookieSecure bool
 }
 
-func loadAdminAuthConfig() (adminAuthConfig, error) {
-	username := os.Getenv("ADMIN_USERNAME")
-	password := os.Getenv("ADMIN_PASSWORD")
-
-	if username == "" || password == "" {
-		return adminAuthConfig{}, errors.New("ADMIN_USERNAME and ADMIN_PASSWORD must be set")
-	}
-
-	return adminAuthConfig{
-		username: username,
-		password: password,
-	}, nil
-}
-
-func newAdminAuth(config adminAuthConfig) *adminAuth {
+func newAdminAuth() *adminAuth {
 	return &adminAuth{
-		config:       config,
-		sessions:     make(map[string]adminSession),
 		loginTmpl:    template.Must(template.ParseFiles(filepathJoin("public", "admin_login.html"))),
+		mfaTmpl:      template.Must(template.ParseFiles(filepathJoin("public", "admin_login_2fa.html"))),
 		cookieSecure: strings.EqualFold(os.Getenv("ADMIN_COOKIE_SECURE"), "true"),
 	}
 }
 
+const (
+	adminUserContextKey    contextKey = "admin_user"
+	adminSessionContextKey contextKey = "admin_session"
+)
+
+// middleware を通ったリクエストからログイン中の管理者を取り出す
+func adminUserFromContext(ctx context.Context) *adminUser {
+	u, _ := ctx.Value(adminUserContextKey).(*adminUser)
+	return u
+}
+
+// middleware を通ったリクエストのセッション
+func adminSessionFromContext(ctx context.Context) *adminSession {
+	s, _ := ctx.Value(adminSessionContextKey).(*adminSession)
+	return s
+}
+
 func (a *adminAuth) middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !a.isAuthenticated(r) {
+		user, session, ok := a.authenticate(r)
+		if !ok {
 			http.Redirect(w, r, a.loginURL(r), http.StatusSeeOther)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		// オーナーが2段階認証を必須にしていれば、設定するまで他の画面には入れない
+		if !user.TOTPEnabled && r.URL.Path != "/admin/2fa" && r.URL.Path != "/admin/logout" {
+			required, err := isAdmin2FARequired()
+			if err != nil {
+				log.Println("isAdmin2FARequired error:", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			if required {
+				http.Redirect(w, r, "/admin/2fa", http.StatusSeeOther)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), adminUserContextKey, user)
+		ctx = context.WithValue(ctx, adminSessionContextKey, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// ロールに perm が無ければ 403 を返す。middleware の内側で使う。
+func requireAdminPermission(perm adminPermission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUserFromContext(r.Context())
+		if !user.Can(perm) {
+			fields := eventFieldsFromRequest(r)
+			fields["permission"] = string(perm)
+			if user != nil {
+				fields["admin_user"] = user.Username
+				fields["role"] = user.Role
+			}
+			appLog.warn("admin_permission_denied", fields)
+			http.Error(w, "権限がありません", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
 func (a *adminAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
 	normalizedNext := a.normalizeNext(r.URL.Query().Get("next"))
 
 	switch r.Method {
 	case http.MethodGet:
-		if a.isAuthenticated(r) {
+		if _, _, ok := a.authenticate(r); ok {
 			http.Redirect(w, r, normalizedNext, http.StatusSeeOther)
 			return
 		}
@@ -90,39 +120,235 @@ func (a *adminAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
 		password := r.FormValue("password")
 		next := a.normalizeNext(r.FormValue("next"))
 
-		if subtle.ConstantTimeCompare([]byte(username), []byte(a.config.username)) != 1 ||
-			subtle.ConstantTimeCompare([]byte(password), []byte(a.config.password)) != 1 {
-			a.renderLogin(w, next, "ログイン情報が正しくありません。")
+		now := jstNow()
+		ip := loginClientIP(r)
+		fields := eventFieldsFromRequest(r)
+		fields["username"] = normalizeLoginUsername(username)
+		fields["client_ip"] = ip
+
+		// ロック中はパスワードを確かめずに断る
+		lock, err := checkLoginLock(ip, username, now)
+		if err != nil {
+			log.Println("check login lock error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if lock != nil {
+			fields["scope"] = lock.Scope
+			fields["locked_until"] = formatJSTDateTime(lock.LockedUntil)
+			appLog.warn("admin_login_locked", fields)
+			recordLoginAttempt(r, ip, username, loginResultLocked)
+			a.renderLogin(w, next, loginLockedMessage(lock.LockedUntil, now))
+			return
+		}
+
+		user, err := authenticateAdminUser(username, password)
+		if errors.Is(err, errAdminUserNotFound) {
+			recordLoginAttempt(r, ip, username, loginResultFailed)
+			locks, err := registerLoginFailure(ip, username, now)
+			if err != nil {
+				log.Println("register login failure error:", err)
+			}
+			message := "ログイン情報が正しくありません。"
+			for _, l := range locks {
+				fields[l.Scope+"_failures"] = l.Failures
+				if l.locked(now) {
+					fields[l.Scope+"_locked_until"] = formatJSTDateTime(l.LockedUntil)
+					message = loginLockedMessage(l.LockedUntil, now)
+				}
+			}
+			appLog.warn("admin_login_failed", fields)
+			a.renderLogin(w, next, message)
+			return
+		}
+		if err != nil {
+			log.Println("admin login error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := deleteExpiredAdminSessions(now); err != nil {
+			log.Println("delete expired admin sessions error:", err)
+		}
+		if err := deleteOldLoginAttempts(now); err != nil {
+			log.Println("delete old login attempts error:", err)
+		}
+
+		// 2段階認証を設定している人は、コードを確かめるまで仮のセッションにしておく
+		if user.TOTPEnabled {
+			if err := a.startSession(w, r, user.ID, true); err != nil {
+				log.Println("create admin session error:", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/admin/login/2fa?next="+url.QueryEscape(next), http.StatusSeeOther)
+			return
+		}
+
+		recordLoginAttempt(r, ip, username, loginResultSuccess)
+		if err := clearLoginFailures(ip, username); err != nil {
+			log.Println("clear login failures error:", err)
+		}
+
+		if err := a.startSession(w, r, user.ID, false); err != nil {
+			log.Println("create admin session error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[ADMIN] login username=%s role=%s\n", user.Username, user.Role)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// パスワード確認後の2段階目。
+// GET /admin/login/2fa
+// POST /admin/login/2fa
+func (a *adminAuth) handleLogin2FA(w http.ResponseWriter, r *http.Request) {
+	next := a.normalizeNext(r.FormValue("next"))
+	now := jstNow()
+
+	cookie, err := r.Cookie(adminSessionCookieName)
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+	session, err := getPendingAdminSession(cookie.Value, now)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("admin session lookup error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		// 時間切れ、または別のタブで済んでいる
+		http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		a.renderLogin2FA(w, next, "")
+	case http.MethodPost:
+		ip := loginClientIP(r)
+		fields := eventFieldsFromRequest(r)
+		fields["username"] = normalizeLoginUsername(session.Username)
+		fields["client_ip"] = ip
+
+		lock, err := checkLoginLock(ip, session.Username, now)
+		if err != nil {
+			log.Println("check login lock error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if lock != nil {
+			fields["scope"] = lock.Scope
+			fields["locked_until"] = formatJSTDateTime(lock.LockedUntil)
+			appLog.warn("admin_login_locked", fields)
+			recordLoginAttempt(r, ip, session.Username, loginResultLocked)
+			a.renderLogin2FA(w, next, loginLockedMessage(lock.LockedUntil, now))
 			return
 		}
 
-		token, err := newAdminSessionToken()
+		ok, usedRecovery, err := verifyAdminSecondFactor(session.AdminUserID, r.FormValue("code"))
 		if err != nil {
+			log.Println("verify second factor error:", err)
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
+		if !ok {
+			recordLoginAttempt(r, ip, session.Username, loginResultMFAFailed)
+			locks, err := registerLoginFailure(ip, session.Username, now)
+			if err != nil {
+				log.Println("register login failure error:", err)
+			}
+			message := "確認コードが正しくありません。"
+			for _, l := range locks {
+				fields[l.Scope+"_failures"] = l.Failures
+				if l.locked(now) {
+					fields[l.Scope+"_locked_until"] = formatJSTDateTime(l.LockedUntil)
+					message = loginLockedMessage(l.LockedUntil, now)
+				}
+			}
+			appLog.warn("admin_2fa_failed", fields)
+			a.renderLogin2FA(w, next, message)
+			return
+		}
 
-		a.mu.Lock()
-		a.cleanupExpiredSessionsLocked(time.Now())
-		a.sessions[token] = adminSession{expiresAt: time.Now().Add(adminSessionTTL)}
-		a.mu.Unlock()
+		if err := completeAdminSessionMFA(session.ID, now); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+				return
+			}
+			log.Println("complete admin session error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     adminSessionCookieName,
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			Secure:   a.shouldUseSecureCookie(r),
-			MaxAge:   int(adminSessionTTL.Seconds()),
-		})
+		recordLoginAttempt(r, ip, session.Username, loginResultSuccess)
+		if err := clearLoginFailures(ip, session.Username); err != nil {
+			log.Println("clear login failures error:", err)
+		}
+		if usedRecovery {
+			remaining, err := countUnusedRecoveryCodes(session.AdminUserID)
+			if err != nil {
+				log.Println("countUnusedRecoveryCodes error:", err)
+			}
+			fields["recovery_codes_left"] = remaining
+			appLog.warn("admin_recovery_code_used", fields)
+		}
 
+		method := "totp"
+		if usedRecovery {
+			method = "recovery_code"
+		}
+		a.setSessionCookie(w, r, cookie.Value, adminSessionTTL)
+		log.Printf("[ADMIN] login username=%s 2fa=%s\n", session.Username, method)
 		http.Redirect(w, r, next, http.StatusSeeOther)
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// 新しいセッションを作って Cookie に載せる
+func (a *adminAuth) startSession(w http.ResponseWriter, r *http.Request, userID int64, mfaPending bool) error {
+	token, err := newAdminSessionToken()
+	if err != nil {
+		return err
+	}
+	if err := createAdminSession(userID, token, r, mfaPending); err != nil {
+		return err
+	}
+
+	ttl := adminSessionTTL
+	if mfaPending {
+		ttl = adminMFAPendingTTL
+	}
+	a.setSessionCookie(w, r, token, ttl)
+	return nil
+}
+
+func (a *adminAuth) setSessionCookie(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   a.shouldUseSecureCookie(r),
+		MaxAge:   int(ttl.Seconds()),
+	})
+}
+
+func loginLockedMessage(until, now time.Time) string {
+	minutes := int(math.Ceil(until.Sub(now).Minutes()))
+	if minutes < 1 {
+		minutes = 1
+	}
+	return fmt.Sprintf("ログインの失敗が続いたため、一時的にロックしています。%d分ほど待ってからやり直してください。", minutes)
+}
+
 func (a *adminAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -130,11 +356,16 @@ func (a *adminAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if cookie, err := r.Cookie(adminSessionCookieName); err == nil && cookie.Value != "" {
-		a.mu.Lock()
-		delete(a.sessions, cookie.Value)
-		a.mu.Unlock()
+		if err := deleteAdminSessionByToken(cookie.Value); err != nil {
+			log.Println("delete admin session error:", err)
+		}
 	}
 
+	a.clearSessionCookie(w, r)
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+func (a *adminAuth) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     adminSessionCookieName,
 		Value:    "",
@@ -144,39 +375,37 @@ func (a *adminAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
 		Secure:   a.shouldUseSecureCookie(r),
 		MaxAge:   -1,
 	})
-
-	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 }
 
-func (a *adminAuth) isAuthenticated(r *http.Request) bool {
+// セッションを確認し、ログイン中の管理者とセッションを返す。
+// 有効期限はアクセスのたびに延ばす（スライディング）。
+// 無効化・削除されたアカウントのセッションはその場で破棄する。
+func (a *adminAuth) authenticate(r *http.Request) (*adminUser, *adminSession, bool) {
 	cookie, err := r.Cookie(adminSessionCookieName)
 	if err != nil || cookie.Value == "" {
-		return false
+		return nil, nil, false
 	}
 
-	now := time.Now()
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	a.cleanupExpiredSessionsLocked(now)
-
-	session, ok := a.sessions[cookie.Value]
-	if !ok || session.expiresAt.Before(now) {
-		delete(a.sessions, cookie.Value)
-		return false
+	session, err := touchAdminSession(cookie.Value, jstNow())
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("admin session lookup error:", err)
+		}
+		return nil, nil, false
 	}
 
-	session.expiresAt = now.Add(adminSessionTTL)
-	a.sessions[cookie.Value] = session
-	return true
-}
-
-func (a *adminAuth) cleanupExpiredSessionsLocked(now time.Time) {
-	for token, session := range a.sessions {
-		if session.expiresAt.Before(now) {
-			delete(a.sessions, token)
+	user, err := getAdminUser(session.AdminUserID)
+	if err != nil || user.Disabled {
+		if err != nil && !errors.Is(err, errAdminUserNotFound) {
+			log.Println("admin user lookup error:", err)
+			return nil, nil, false
+		}
+		if err := deleteAdminSession(session.ID); err != nil {
+			log.Println("delete admin session error:", err)
 		}
+		return nil, nil, false
 	}
+	return user, session, true
 }
 
 func (a *adminAuth) renderLogin(w http.ResponseWriter, next, errorMessage string) {
@@ -190,6 +419,17 @@ func (a *adminAuth) renderLogin(w http.ResponseWriter, next, errorMessage string
 	})
 }
 
+func (a *adminAuth) renderLogin2FA(w http.ResponseWriter, next, errorMessage string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = a.mfaTmpl.Execute(w, struct {
+		Next         string
+		ErrorMessage string
+	}{
+		Next:         next,
+		ErrorMessage: errorMessage,
+	})
+}
+
 func (a *adminAuth) loginURL(r *http.Request) string {
 	next := a.normalizeNext(r.URL.RequestURI())
 	return "/admin/login?next=" + url.QueryEscape(next)
@@ -0,0 +1,409 @@
+// backup.go
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// checkin.db のバックアップ。
+// SQLite のオンラインバックアップ API で動いたまま複製し、整合性を確かめてから
+// backupDir に checkin-YYYYMMDD-HHMMSS.db(.gz) として置く。古いものは backupKeep 個を残して消す。
+
+const (
+	backupFilePrefix = "checkin-"
+	backupTimeLayout = "20060102-150405"
+)
+
+var errBackupRunning = errors.New("backup already running")
+
+type backupConfig struct {
+	Dir      string
+	Interval time.Duration // 0 なら定期バックアップはしない（管理画面からは取れる）
+	Keep     int
+	Gzip     bool
+}
+
+// BACKUP_DIR / BACKUP_INTERVAL_HOURS / BACKUP_KEEP / BACKUP_GZIP から読む
+func backupConfigFromEnv() (backupConfig, error) {
+	cfg := backupConfig{
+		Dir:      "backups",
+		Interval: 24 * time.Hour,
+		Keep:     14,
+		Gzip:     true,
+	}
+	if dir := strings.TrimSpace(os.Getenv("BACKUP_DIR")); dir != "" {
+		cfg.Dir = dir
+	}
+	if raw := strings.TrimSpace(os.Getenv("BACKUP_INTERVAL_HOURS")); raw != "" {
+		hours, err := strconv.Atoi(raw)
+		if err != nil || hours < 0 {
+			return cfg, fmt.Errorf("BACKUP_INTERVAL_HOURS must be a non-negative integer: %q", raw)
+		}
+		cfg.Interval = time.Duration(hours) * time.Hour
+	}
+	if raw := strings.TrimSpace(os.Getenv("BACKUP_KEEP")); raw != "" {
+		keep, err := strconv.Atoi(raw)
+		if err != nil || keep < 1 {
+			return cfg, fmt.Errorf("BACKUP_KEEP must be a positive integer: %q", raw)
+		}
+		cfg.Keep = keep
+	}
+	if raw := strings.TrimSpace(os.Getenv("BACKUP_GZIP")); raw != "" {
+		gz, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("BACKUP_GZIP must be true or false: %q", raw)
+		}
+		cfg.Gzip = gz
+	}
+	return cfg, nil
+}
+
+// 直近のバックアップの結果（再起動すると消える。ファイルの一覧は backupDir から読む）
+type backupStatus struct {
+	Running       bool
+	Trigger       string // "schedule" / "manual"
+	LastStartedAt time.Time
+	LastEndedAt   time.Time
+	LastFile      string
+	LastSize      int64
+	LastError     string // 直近が失敗なら、その理由
+	LastSuccessAt time.Time
+}
+
+type backupManager struct {
+	cfg    backupConfig
+	mu     sync.Mutex
+	status backupStatus
+}
+
+// main で設定する
+var backups *backupManager
+
+func newBackupManager(cfg backupConfig) *backupManager {
+	return &backupManager{cfg: cfg}
+}
+
+func (m *backupManager) snapshot() backupStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// BACKUP_INTERVAL_HOURS ごとにバックアップを取る。起動直後には取らない。
+func (m *backupManager) start() {
+	if m.cfg.Interval <= 0 {
+		appLog.info("backup_schedule_disabled", eventFields{"dir": m.cfg.Dir})
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(m.cfg.Interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			// 失敗は run の中でログと状態に残す
+			_, _ = m.run("schedule")
+		}
+	}()
+}
+
+// バックアップを1つ取る。戻り値は作ったファイルのパス。
+func (m *backupManager) run(trigger string) (string, error) {
+	m.mu.Lock()
+	if m.status.Running {
+		m.mu.Unlock()
+		return "", errBackupRunning
+	}
+	startedAt := jstNow()
+	m.status.Running = true
+	m.status.Trigger = trigger
+	m.status.LastStartedAt = startedAt
+	m.mu.Unlock()
+
+	path, size, err := writeBackup(m.cfg, startedAt)
+
+	m.mu.Lock()
+	m.status.Running = false
+	m.status.LastEndedAt = jstNow()
+	if err != nil {
+		m.status.LastError = err.Error()
+	} else {
+		m.status.LastError = ""
+		m.status.LastFile = filepath.Base(path)
+		m.status.LastSize = size
+		m.status.LastSuccessAt = m.status.LastEndedAt
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		appLog.error("backup_failed", eventFields{
+			"trigger": trigger,
+			"error":   err.Error(),
+		})
+		return "", err
+	}
+	appLog.info("backup_completed", eventFields{
+		"trigger":     trigger,
+		"file":        path,
+		"size":        size,
+		"duration_ms": time.Since(startedAt).Milliseconds(),
+	})
+
+	if err := pruneBackups(m.cfg.Dir, m.cfg.Keep); err != nil {
+		appLog.error("backup_prune_failed", eventFields{"error": err.Error()})
+	}
+	return path, nil
+}
+
+func writeBackup(cfg backupConfig, now time.Time) (path string, size int64, err error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return "", 0, err
+	}
+
+	path = filepath.Join(cfg.Dir, backupFilePrefix+now.In(jst).Format(backupTimeLayout)+".db")
+	tmp := path + ".tmp"
+	defer os.Remove(tmp)
+
+	if err := backupSQLiteTo(tmp); err != nil {
+		return "", 0, fmt.Errorf("backup: %w", err)
+	}
+	if err := checkSQLiteIntegrity(tmp); err != nil {
+		return "", 0, err
+	}
+
+	if cfg.Gzip {
+		path += ".gz"
+		if err := gzipFile(tmp, path); err != nil {
+			return "", 0, fmt.Errorf("gzip: %w", err)
+		}
+	} else if err := os.Rename(tmp, path); err != nil {
+		return "", 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, info.Size(), nil
+}
+
+// 動いている db を dest（新しいファイル）に丸ごと複製する
+func backupSQLiteTo(dest string) error {
+	ctx := context.Background()
+
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSQLite, ok1 := destDriverConn.(*sqlite3.SQLiteConn)
+			srcSQLite, ok2 := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok1 || !ok2 {
+				return errors.New("unexpected driver connection")
+			}
+
+			bk, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			// 全ページを1回で写す（小さな DB なので、途中で書き込みを待たせる時間も短い）
+			if _, err := bk.Step(-1); err != nil {
+				_ = bk.Finish()
+				return err
+			}
+			return bk.Finish()
+		})
+	})
+}
+
+// PRAGMA integrity_check が ok で、このアプリの DB（schema_migrations がある）であることを確かめる
+func checkSQLiteIntegrity(path string) error {
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var result string
+	if err := conn.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	var tables int
+	if err := conn.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`,
+	).Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return errors.New("not a checkin database (schema_migrations is missing)")
+	}
+	return nil
+}
+
+// バックアップに記録されている最新のマイグレーション番号
+func backupSchemaVersion(path string) (int, error) {
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var version int
+	err = conn.QueryRow(`SELECT IFNULL(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+func gzipFile(src, dest string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dest + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// src（.gz なら展開して）を dest に書き出す
+func copyBackupFile(src, dest string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if strings.HasSuffix(src, ".gz") {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// backupDir にあるバックアップ1つ
+type backupFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+func (f backupFile) SizeLabel() string {
+	switch {
+	case f.Size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(f.Size)/(1<<20))
+	case f.Size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(f.Size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", f.Size)
+	}
+}
+
+func isBackupFileName(name string) bool {
+	return strings.HasPrefix(name, backupFilePrefix) &&
+		(strings.HasSuffix(name, ".db") || strings.HasSuffix(name, ".db.gz"))
+}
+
+// 新しい順。ディレクトリがまだ無ければ空
+func listBackupFiles(dir string) ([]backupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []backupFile
+	for _, e := range entries {
+		if e.IsDir() || !isBackupFileName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, backupFile{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime().In(jst)})
+	}
+	// ファイル名に日時が入っているので、名前の降順が新しい順
+	sort.Slice(files, func(i, j int) bool { return files[i].Name > files[j].Name })
+	return files, nil
+}
+
+func pruneBackups(dir string, keep int) error {
+	files, err := listBackupFiles(dir)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(files); i++ {
+		if err := os.Remove(filepath.Join(dir, files[i].Name)); err != nil {
+			return err
+		}
+		appLog.info("backup_pruned", eventFields{"file": files[i].Name})
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// business_hours.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 営業時間・休業日・祝日のカレンダー。
+// BUSINESS_HOURS_FILE の JSON（例: business_hours.example.json）を起動時に読む。
+// 設定しなければ今まで通り時間の制限はしない（businessHours が nil）。
+//
+//	{
+//	  "weekly":   {"mon": "10:00-22:00", ..., "sun": "closed"},
+//	  "holiday":  "10:00-20:00",                 // 祝日の営業時間（省略時はその曜日と同じ）
+//	  "holidays": {"2026-01-01": "元日", ...},
+//	  "closures": [{"from": "2026-12-29", "to": "2027-01-03", "note": "年末年始休業"}]
+//	}
+
+// 営業時間の枠（0:00 からの分。閉店は 24:00 = 1440 まで）
+type openingHours struct {
+	Closed bool
+	Open   int
+	Close  int
+}
+
+func (h openingHours) Label() string {
+	if h.Closed {
+		return "休業"
+	}
+	return formatClockMinutes(h.Open) + "–" + formatClockMinutes(h.Close)
+}
+
+type businessClosure struct {
+	From string `json:"from"` // "YYYY-MM-DD"
+	To   string `json:"to"`   // 省略時は From の1日だけ
+	Note string `json:"note"`
+}
+
+type businessCalendar struct {
+	weekly   [7]openingHours // time.Weekday の順（日曜が 0）
+	holiday  *openingHours   // nil なら祝日もその曜日の営業時間
+	holidays map[string]string
+	closures []businessClosure
+}
+
+// ある日の営業の予定
+type businessDay struct {
+	Hours       openingHours
+	HolidayName string // 祝日なら名前
+	Note        string // 休業・定休日の理由（画面とメッセージ用）
+}
+
+// main で設定する。nil なら営業時間の制限なし
+var businessHours *businessCalendar
+
+var businessWeekdayKeys = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func loadBusinessCalendarFromEnv() (*businessCalendar, error) {
+	path := strings.TrimSpace(os.Getenv("BUSINESS_HOURS_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	cal, err := loadBusinessCalendar(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("✅ 営業時間を読み込み: %s（祝日 %d日・臨時休業 %d件）\n", path, len(cal.holidays), len(cal.closures))
+	return cal, nil
+}
+
+func loadBusinessCalendar(path string) (*businessCalendar, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Weekly   map[string]string `json:"weekly"`
+		Holiday  string            `json:"holiday"`
+		Holidays map[string]string `json:"holidays"`
+		Closures []businessClosure `json:"closures"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	cal := &businessCalendar{holidays: make(map[string]string)}
+	for wd, key := range businessWeekdayKeys {
+		spec, ok := file.Weekly[key]
+		if !ok {
+			return nil, fmt.Errorf("%s: weekly.%s is missing", path, key)
+		}
+		hours, err := parseOpeningHours(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: weekly.%s: %w", path, key, err)
+		}
+		cal.weekly[wd] = hours
+	}
+	for key := range file.Weekly {
+		if indexOfWeekdayKey(key) < 0 {
+			return nil, fmt.Errorf("%s: unknown weekday %q (use sun..sat)", path, key)
+		}
+	}
+	if file.Holiday != "" {
+		hours, err := parseOpeningHours(file.Holiday)
+		if err != nil {
+			return nil, fmt.Errorf("%s: holiday: %w", path, err)
+		}
+		cal.holiday = &hours
+	}
+	for date, name := range file.Holidays {
+		if _, err := time.ParseInLocation("2006-01-02", date, jst); err != nil {
+			return nil, fmt.Errorf("%s: holidays: bad date %q", path, date)
+		}
+		cal.holidays[date] = name
+	}
+	for i, c := range file.Closures {
+		if c.To == "" {
+			c.To = c.From
+		}
+		from, err1 := time.ParseInLocation("2006-01-02", c.From, jst)
+		to, err2 := time.ParseInLocation("2006-01-02", c.To, jst)
+		if err1 != nil || err2 != nil || to.Before(from) {
+			return nil, fmt.Errorf("%s: closures[%d]: bad date range %q..%q", path, i, c.From, c.To)
+		}
+		if c.Note == "" {
+			c.Note = "臨時休業"
+		}
+		cal.closures = append(cal.closures, c)
+	}
+	return cal, nil
+}
+
+func indexOfWeekdayKey(key string) int {
+	for i, k := range businessWeekdayKeys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// "10:00-22:00" / "closed"
+func parseOpeningHours(spec string) (openingHours, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "closed" {
+		return openingHours{Closed: true}, nil
+	}
+	openStr, closeStr, ok := strings.Cut(spec, "-")
+	if !ok {
+		return openingHours{}, fmt.Errorf("want HH:MM-HH:MM or closed: %q", spec)
+	}
+	open, err := parseClockMinutes(openStr)
+	if err != nil {
+		return openingHours{}, err
+	}
+	closeAt, err := parseClockMinutes(closeStr)
+	if err != nil {
+		return openingHours{}, err
+	}
+	if closeAt <= open {
+		return openingHours{}, fmt.Errorf("closing time must be after opening time: %q", spec)
+	}
+	return openingHours{Open: open, Close: closeAt}, nil
+}
+
+func parseClockMinutes(s string) (int, error) {
+	hh, mm, ok := strings.Cut(strings.TrimSpace(s), ":")
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func formatClockMinutes(minutes int) string {
+	return fmt.Sprintf("%d:%02d", minutes/60, minutes%60)
+}
+
+// date の日の営業の予定（臨時休業 > 祝日 > 曜日 の順に見る）
+func (c *businessCalendar) day(date time.Time) businessDay {
+	key := formatJSTDate(date)
+	d := businessDay{
+		Hours:       c.weekly[date.In(jst).Weekday()],
+		HolidayName: c.holidays[key],
+	}
+	if d.HolidayName != "" && c.holiday != nil {
+		d.Hours = *c.holiday
+	}
+	if d.Hours.Closed {
+		d.Note = "定休日"
+	}
+	for _, cl := range c.closures {
+		if cl.From <= key && key <= cl.To {
+			d.Hours = openingHours{Closed: true}
+			d.Note = cl.Note
+			break
+		}
+	}
+	return d
+}
+
+// t が営業時間内か
+func (c *businessCalendar) isOpen(t time.Time) bool {
+	h := c.day(t).Hours
+	if h.Closed {
+		return false
+	}
+	minutes := t.In(jst).Hour()*60 + t.In(jst).Minute()
+	return h.Open <= minutes && minutes < h.Close
+}
+
+// 営業時間内の t について、その日の閉店時刻。営業時間外なら false
+func (c *businessCalendar) closingAfter(t time.Time) (time.Time, bool) {
+	if !c.isOpen(t) {
+		return time.Time{}, false
+	}
+	t = t.In(jst)
+	h := c.day(t).Hours
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, jst)
+	return midnight.Add(time.Duration(h.Close) * time.Minute), true
+}
+
+// 次に開く時刻（2週間先まで探す。見つからなければ false）
+func (c *businessCalendar) nextOpening(t time.Time) (time.Time, bool) {
+	t = t.In(jst)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, jst)
+	for i := 0; i < 14; i++ {
+		date := midnight.AddDate(0, 0, i)
+		h := c.day(date).Hours
+		if h.Closed {
+			continue
+		}
+		opening := date.Add(time.Duration(h.Open) * time.Minute)
+		if opening.After(t) {
+			return opening, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 営業時間外に /checkin されたときの案内
+func (c *businessCalendar) closedMessage(now time.Time) string {
+	d := c.day(now)
+	msg := "ただいま営業時間外のため、チェックインできません。"
+	if d.Hours.Closed {
+		msg = fmt.Sprintf("本日は%sのため、チェックインできません。", d.Note)
+	} else {
+		msg += fmt.Sprintf("\n本日の営業時間は %s です。", d.Hours.Label())
+	}
+	if next, ok := c.nextOpening(now); ok {
+		msg += fmt.Sprintf("\n次の営業開始は %d/%d %s です。",
+			int(next.Month()), next.Day(), formatClockMinutes(next.Hour()*60+next.Minute()))
+	}
+	return msg
+}
+
+// 画面用の曜日ごとの営業時間（日曜始まり）
+func (c *businessCalendar) weeklyLabels() []string {
+	labels := make([]string, 7)
+	for i, h := range c.weekly {
+		labels[i] = h.Label()
+	}
+	return labels
+}
+
+// 祝日の営業時間の表示（曜日どおりなら空）
+func (c *businessCalendar) holidayLabel() string {
+	if c.holiday == nil {
+		return ""
+	}
+	return c.holiday.Label()
+}
+
+// 今日以降の臨時休業（画面用、日付順）
+func (c *businessCalendar) upcomingClosures(now time.Time) []businessClosure {
+	today := formatJSTDate(now)
+	var out []businessClosure
+	for _, cl := range c.closures {
+		if cl.To >= today {
+			out = append(out, cl)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].From < out[j].From })
+	return out
+}
+
+// businessHours が無ければ常に営業中
+func isBusinessOpen(t time.Time) bool {
+	return businessHours == nil || businessHours.isOpen(t)
+}
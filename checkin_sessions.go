@@ -0,0 +1,232 @@
+// checkin_sessions.go
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// checkin_sessions.checkout_reason / visits.checkout_reason に入る値
+const (
+	checkoutReasonManual     = "manual"      // 画面からのチェックアウト
+	checkoutReasonAutoToggle = "auto_toggle" // LIFF を開いたときの自動チェックアウト
+	checkoutReasonExpired    = "expired"     // expireAfter 経過による自動終了
+	checkoutReasonAdmin      = "admin"       // 管理画面からのチェックアウト
+	checkoutReasonRecheckin  = "recheckin"   // チェックアウトせずに再チェックイン
+	checkoutReasonClosing    = "closing"     // 閉店時刻での自動チェックアウト
+	checkoutReasonStaff      = "staff"       // 受付のスタッフ端末からのチェックアウト
+)
+
+// 滞在時間の集計に使う終了方法（期限切れ・再チェックイン・閉店は実際の滞在時間が分からないので除く）
+const measuredCheckoutReasonsSQL = "('manual', 'auto_toggle', 'admin', 'staff')"
+
+func checkoutReasonLabel(reason string) string {
+	switch reason {
+	case checkoutReasonManual:
+		return "手動"
+	case checkoutReasonAutoToggle:
+		return "自動切替"
+	case checkoutReasonExpired:
+		return "期限切れ"
+	case checkoutReasonAdmin:
+		return "管理画面"
+	case checkoutReasonRecheckin:
+		return "再チェックイン"
+	case checkoutReasonClosing:
+		return "閉店"
+	case checkoutReasonStaff:
+		return "スタッフ端末"
+	case "":
+		return "-"
+	default:
+		return reason
+	}
+}
+
+// 起動時に呼び出す。
+// 未チェックアウトのセッションと直近のチェックアウト時刻を DB からメモリに復元する。
+func loadCheckinSessions() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query(`
+SELECT line_user_id, strftime('%Y-%m-%d %H:%M:%S', checked_in_at), IFNULL(visit_id, 0)
+FROM checkin_sessions
+WHERE checked_out_at IS NULL
+`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, checkedInAt string
+		var visitID int64
+		if err := rows.Scan(&userID, &checkedInAt, &visitID); err != nil {
+			return err
+		}
+		at, err := parseJSTDateTime(checkedInAt)
+		if err != nil {
+			return err
+		}
+		checkedInUsers[userID] = checkinInfo{At: at, VisitID: visitID}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// 自動チェックインのブロック判定に使うので、ブロック期間内のチェックアウトだけ戻せばよい
+	since := formatJSTDateTime(jstNow().Add(-currentSettings.AutoCheckinBlockFor))
+	checkoutRows, err := db.Query(`
+SELECT line_user_id, MAX(checked_out_at)
+FROM checkin_sessions
+WHERE checked_out_at >= ?
+GROUP BY line_user_id
+`, since)
+	if err != nil {
+		return err
+	}
+	defer checkoutRows.Close()
+
+	for checkoutRows.Next() {
+		var userID, checkedOutAt string
+		if err := checkoutRows.Scan(&userID, &checkedOutAt); err != nil {
+			return err
+		}
+		if _, inside := checkedInUsers[userID]; inside {
+			continue
+		}
+		at, err := parseJSTDateTime(checkedOutAt)
+		if err != nil {
+			return err
+		}
+		lastCheckoutAtByUser[userID] = at
+	}
+	if err := checkoutRows.Err(); err != nil {
+		return err
+	}
+
+	// 停止中に期限切れになった人はここで閉じる
+	cleanupExpiredLocked(jstNow())
+
+	log.Printf("✅ チェックイン状態を復元: 在館 %d人\n", len(checkedInUsers))
+	return nil
+}
+
+// 新しいセッションを開始する。visitID は recordVisit で作った visits.id（無ければ 0）。
+// 同じユーザーの閉じていないセッションがあれば、再チェックインとして閉じてから作り直す。
+func insertCheckinSession(userID string, visitID int64, at time.Time) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err = closeOpenSessionTx(tx, userID, at, checkoutReasonRecheckin); err != nil {
+		return err
+	}
+
+	var visitIDArg interface{}
+	if visitID > 0 {
+		visitIDArg = visitID
+	}
+	if _, err = tx.Exec(
+		`INSERT INTO checkin_sessions(line_user_id, checked_in_at, visit_id)
+         VALUES(?, ?, ?)`,
+		userID, formatJSTDateTime(at), visitIDArg,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// セッションを閉じる。closes は line_user_id → チェックアウト時刻。
+// 期限切れ掃除で複数人をまとめて閉じることがあるので、1トランザクションで処理する。
+func closeCheckinSessions(closes map[string]time.Time, reason string) (err error) {
+	if len(closes) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for userID, at := range closes {
+		if err = closeOpenSessionTx(tx, userID, at, reason); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 閉じていないセッションと、それに紐づく visits 行にチェックアウト情報を書く
+func closeOpenSessionTx(tx *sql.Tx, userID string, at time.Time, reason string) error {
+	var (
+		sessionID   int64
+		checkedInAt string
+		visitID     sql.NullInt64
+	)
+	err := tx.QueryRow(
+		`SELECT id, strftime('%Y-%m-%d %H:%M:%S', checked_in_at), visit_id
+           FROM checkin_sessions
+          WHERE line_user_id = ? AND checked_out_at IS NULL
+          ORDER BY id DESC
+          LIMIT 1`,
+		userID,
+	).Scan(&sessionID, &checkedInAt, &visitID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	checkedOutAt := formatJSTDateTime(at)
+	if _, err := tx.Exec(
+		`UPDATE checkin_sessions
+            SET checked_out_at = ?, checkout_reason = ?
+          WHERE id = ?`,
+		checkedOutAt, reason, sessionID,
+	); err != nil {
+		return err
+	}
+
+	if !visitID.Valid {
+		return nil
+	}
+
+	inAt, err := parseJSTDateTime(checkedInAt)
+	if err != nil {
+		return err
+	}
+	duration := int(at.Sub(inAt).Seconds())
+	if duration < 0 {
+		duration = 0
+	}
+
+	_, err = tx.Exec(
+		`UPDATE visits
+            SET checked_out_at = ?, checkout_reason = ?, duration_seconds = ?
+          WHERE id = ? AND checked_out_at IS NULL`,
+		checkedOutAt, reason, duration, visitID.Int64,
+	)
+	return err
+}
+
+func isMeasuredCheckoutReason(reason string) bool {
+	return reason == checkoutReasonManual || reason == checkoutReasonAutoToggle || reason == checkoutReasonAdmin ||
+		reason == checkoutReasonStaff
+}
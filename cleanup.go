@@ -6,12 +6,25 @@ import (
 )
 
 const (
-	visitsRetentionDays = 90
-	visitsCleanupEvery  = 24 * time.Hour
+	visitsCleanupEvery = 24 * time.Hour
+	checkinExpiryEvery = time.Minute
 )
 
+// 期限切れ掃除はリクエストのついでにも走るが、
+// 誰もアクセスしない間も人数の変化を配信できるよう定期的に回す。
+func startCheckinExpiryJob() {
+	go func() {
+		ticker := time.NewTicker(checkinExpiryEvery)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			getCurrentCount()
+		}
+	}()
+}
+
 func startVisitsCleanupJob() {
-	// 起動直後に1回実行してから、24時間ごとに削除する。
+	// 起動直後に1回実行してから、24時間ごとに古い来店を集計に移す。
 	runVisitsCleanup()
 
 	go func() {
@@ -24,23 +37,19 @@ func startVisitsCleanupJob() {
 	}()
 }
 
+// 保存期間を過ぎた月の来店を、会員ごとの月次集計に移してから明細を消す（visit_archive.go）
 func runVisitsCleanup() {
-	cutoff := formatJSTDateTime(jstNow().AddDate(0, 0, -visitsRetentionDays))
-	res, err := db.Exec(
-		`DELETE FROM visits
-          WHERE visited_at < ?`,
-		cutoff,
-	)
-	if err != nil {
-		log.Println("cleanup visits error:", err)
-		return
-	}
+	mu.Lock()
+	retentionDays := currentSettings.VisitsRetentionDays
+	mu.Unlock()
 
-	deleted, err := res.RowsAffected()
+	cutoff := visitsArchiveCutoff(jstNow(), retentionDays)
+	archived, rollups, err := archiveVisitsBefore(cutoff)
 	if err != nil {
-		log.Println("cleanup visits rows affected error:", err)
+		log.Println("cleanup visits error:", err)
 		return
 	}
 
-	log.Printf("✅ visits cleanup: deleted %d rows older than %d days\n", deleted, visitsRetentionDays)
+	log.Printf("✅ visits cleanup: archived %d rows before %s into %d monthly rollups (retention %d days)\n",
+		archived, formatJSTDate(cutoff), rollups, retentionDays)
 }
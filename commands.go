@@ -0,0 +1,249 @@
+// commands.go
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// サブコマンド付きで起動されたときの入口。
+//
+//	checkin-app migrate status   … マイグレーションの適用状況を表示
+//	checkin-app migrate up       … 未適用のマイグレーションを適用
+//	checkin-app admin bootstrap <username>
+//	                             … 最初のオーナーを作成（パスワードは標準入力の1行目）
+//	checkin-app members import [-apply] [-allow-unknown] <file.csv>
+//	                             … 会員の一括登録（-apply が無ければ差分の表示だけ）
+//	checkin-app restore [-apply] <backup.db[.gz]>
+//	                             … バックアップから戻す（-apply が無ければ検査だけ。サーバーは止めておく）
+func runCommand(args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrateCommand(args[1:])
+	case "admin":
+		return runAdminCommand(args[1:])
+	case "members":
+		return runMembersCommand(args[1:])
+	case "restore":
+		return runRestoreCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func runMigrateCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: checkin-app migrate status|up")
+	}
+
+	if err := openDB(); err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "status":
+		statuses, err := getMigrationStatuses()
+		if err != nil {
+			return err
+		}
+		pending := 0
+		for _, s := range statuses {
+			if s.Applied {
+				fmt.Fprintf(os.Stdout, "  [applied] %03d %s (%s)\n", s.Version, s.Name, s.AppliedAt)
+			} else {
+				pending++
+				fmt.Fprintf(os.Stdout, "  [pending] %03d %s\n", s.Version, s.Name)
+			}
+		}
+		fmt.Fprintf(os.Stdout, "%d pending migration(s)\n", pending)
+		return nil
+	case "up":
+		applied, err := runMigrations()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "applied %d migration(s)\n", applied)
+		return nil
+	default:
+		return errors.New("usage: checkin-app migrate status|up")
+	}
+}
+
+func runAdminCommand(args []string) error {
+	if len(args) != 2 || args[0] != "bootstrap" {
+		return errors.New("usage: checkin-app admin bootstrap <username>")
+	}
+	username := args[1]
+
+	if err := openDB(); err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := runMigrations(); err != nil {
+		return err
+	}
+
+	// 既にオーナーがいるなら管理画面から追加してもらう
+	owners, err := countActiveOwners(0)
+	if err != nil {
+		return err
+	}
+	if owners > 0 {
+		return errors.New("an active owner already exists; add accounts from /admin/users")
+	}
+
+	fmt.Fprintf(os.Stderr, "password for %s: ", username)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("read password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+
+	id, err := createAdminUser(username, password, adminRoleOwner)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "created owner %q (id=%d)\n", username, id)
+	return nil
+}
+
+const membersImportUsage = "usage: checkin-app members import [-apply] [-allow-unknown] <file.csv>"
+
+func runMembersCommand(args []string) error {
+	if len(args) == 0 || args[0] != "import" {
+		return errors.New(membersImportUsage)
+	}
+	fs := flag.NewFlagSet("members import", flag.ContinueOnError)
+	apply := fs.Bool("apply", false, "差分を確かめたうえで反映する")
+	allowUnknown := fs.Bool("allow-unknown", false, "来店も会員登録も無い LINE ID も追加する")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(membersImportUsage)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rows, err := parseMemberImportCSV(f)
+	if err != nil {
+		return err
+	}
+
+	if err := openDB(); err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer db.Close()
+	if _, err := runMigrations(); err != nil {
+		return err
+	}
+
+	opts := memberImportOptions{AllowUnknown: *allowUnknown}
+	var plan *memberImportPlan
+	if *apply {
+		err = runAuditedTx(func(tx *sql.Tx) error {
+			var err error
+			plan, err = applyMemberImport(tx, rows, opts, cliAuditActor)
+			return err
+		})
+	} else {
+		plan, err = planMemberImport(db, rows, opts)
+	}
+	if plan != nil {
+		printMemberImportPlan(os.Stdout, plan)
+	}
+	if err != nil && err != errMemberImportConflicts {
+		return err
+	}
+
+	switch {
+	case plan.Conflicts > 0:
+		return fmt.Errorf("%d row(s) have errors; nothing was applied", plan.Conflicts)
+	case *apply:
+		fmt.Fprintln(os.Stdout, "applied.")
+	case plan.CanApply():
+		fmt.Fprintln(os.Stdout, "dry run; run again with -apply to write these changes.")
+	}
+	return nil
+}
+
+func printMemberImportPlan(w io.Writer, plan *memberImportPlan) {
+	for _, it := range plan.Items {
+		if it.Action == memberImportUnchanged {
+			continue
+		}
+		fmt.Fprintf(w, "  line %-4d %-9s %s %s\n", it.Line, it.Action, it.LineUserID, it.Name)
+		for _, e := range it.Errors {
+			fmt.Fprintf(w, "      ! %s\n", e)
+		}
+		for _, c := range it.Changes {
+			fmt.Fprintf(w, "      %s: %q -> %q\n", c.Label, c.Before, c.After)
+		}
+	}
+	fmt.Fprintf(w, "insert %d, update %d, unchanged %d, conflict %d\n",
+		plan.Inserts, plan.Updates, plan.Unchanged, plan.Conflicts)
+}
+
+func runRestoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	apply := fs.Bool("apply", false, "replace "+dbPath+" with the backup")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: checkin-app restore [-apply] <backup.db[.gz]>")
+	}
+	src := fs.Arg(0)
+
+	// 展開・検査は checkin.db と同じディレクトリで行い、最後に rename で差し替える
+	tmp := dbPath + ".restore-tmp"
+	defer os.Remove(tmp)
+	if err := copyBackupFile(src, tmp); err != nil {
+		return fmt.Errorf("read backup: %w", err)
+	}
+	if err := checkSQLiteIntegrity(tmp); err != nil {
+		return err
+	}
+	version, err := backupSchemaVersion(tmp)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return fmt.Errorf("backup schema version %d is newer than this build (%d)", version, latest)
+	}
+	fmt.Fprintf(os.Stdout, "%s: integrity ok, schema version %d (this build: %d)\n", src, version, latest)
+
+	if !*apply {
+		fmt.Fprintln(os.Stdout, "check only; stop the server and run again with -apply to restore.")
+		return nil
+	}
+
+	// 今の DB は消さずに横へ置く。ジャーナルが残っていると戻した DB に適用されてしまうので一緒に動かす
+	suffix := ".before-restore-" + jstNow().Format(backupTimeLayout)
+	for _, name := range []string{dbPath, dbPath + "-journal"} {
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := os.Rename(name, name+suffix); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "moved %s to %s\n", name, name+suffix)
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "restored %s from %s; pending migrations are applied on the next start.\n", dbPath, src)
+	return nil
+}
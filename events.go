@@ -0,0 +1,149 @@
+// events.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const occupancyStreamHeartbeat = 25 * time.Second
+
+type occupancyEvent struct {
+	Count int `json:"count"`
+	Max   int `json:"max"`
+}
+
+// 人数の変化を SSE の購読者に配る
+type occupancyBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan occupancyEvent]struct{}
+}
+
+func newOccupancyBroker() *occupancyBroker {
+	return &occupancyBroker{
+		subscribers: make(map[chan occupancyEvent]struct{}),
+	}
+}
+
+var occupancyEvents = newOccupancyBroker()
+
+func (b *occupancyBroker) subscribe() chan occupancyEvent {
+	// 最新の値だけ分かればよいので、バッファは1で古いものは捨てる
+	ch := make(chan occupancyEvent, 1)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *occupancyBroker) unsubscribe(ch chan occupancyEvent) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+// store の mu を持ったまま呼ばれるので、絶対にブロックしない
+func (b *occupancyBroker) publish(ev occupancyEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (b *occupancyBroker) subscriberCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// 起動時に呼び出す。store の人数変化を broker に流す。
+func startOccupancyEvents() {
+	onOccupancyChange(func(count, max int) {
+		occupancyEvents.publish(occupancyEvent{Count: count, Max: max})
+	})
+}
+
+// GET /count-stream（Server-Sent Events）
+func handleCountStream(w http.ResponseWriter, r *http.Request) {
+	fields := eventFieldsFromRequest(r)
+	if r.Method != http.MethodGet {
+		fields["status"] = http.StatusMethodNotAllowed
+		appLog.error("request_error", fields)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		fields["error"] = "streaming unsupported"
+		appLog.error("request_error", fields)
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := occupancyEvents.subscribe()
+	defer occupancyEvents.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx のバッファリングを止める
+
+	openedAt := time.Now()
+	fields["subscribers"] = occupancyEvents.subscriberCount()
+	appLog.info("count_stream_opened", fields)
+	defer func() {
+		closeFields := eventFieldsFromRequest(r)
+		closeFields["duration_sec"] = int(time.Since(openedAt).Seconds())
+		appLog.info("count_stream_closed", closeFields)
+	}()
+
+	// 接続直後に今の値を送る
+	fmt.Fprint(w, "retry: 5000\n\n")
+	if err := writeOccupancyEvent(w, occupancyEvent{Count: getCurrentCount(), Max: getMaxPeople()}); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(occupancyStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			if err := writeOccupancyEvent(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			// プロキシに切られないようコメント行を送る
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeOccupancyEvent(w http.ResponseWriter, ev occupancyEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: occupancy\ndata: %s\n\n", data)
+	return err
+}
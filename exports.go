@@ -0,0 +1,266 @@
+// exports.go
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 管理画面の一覧を CSV / Excel でダウンロードする。
+// 絞り込み（q / member_type）は一覧画面と同じ memberFilterConditions を使う。
+
+const (
+	exportFormatCSV  = "csv"
+	exportFormatXLSX = "xlsx"
+)
+
+// ?format= を読む。空なら CSV
+func exportFormatParam(r *http.Request) (string, bool) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "", exportFormatCSV:
+		return exportFormatCSV, true
+	case exportFormatXLSX:
+		return exportFormatXLSX, true
+	default:
+		return "", false
+	}
+}
+
+// 1行目を見出しとして、CSV（BOM 付き UTF-8）か XLSX で返す。baseName は拡張子なしの ASCII のファイル名。
+func writeExport(w http.ResponseWriter, format, baseName, sheetName string, rows [][]interface{}) {
+	switch format {
+	case exportFormatXLSX:
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+baseName+`.xlsx"`)
+		if err := writeXLSX(w, sheetName, rows); err != nil {
+			log.Println("write xlsx error:", err)
+		}
+	default:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+baseName+`.csv"`)
+		// Excel が UTF-8 と判断できるように BOM を付ける
+		w.Write([]byte("\xEF\xBB\xBF"))
+		cw := csv.NewWriter(w)
+		cw.UseCRLF = true
+		for _, row := range rows {
+			record := make([]string, len(row))
+			for i, cell := range row {
+				record[i] = csvCell(cell)
+			}
+			if err := cw.Write(record); err != nil {
+				log.Println("write csv error:", err)
+				return
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Println("write csv error:", err)
+		}
+	}
+}
+
+// 表示名などが "=" で始まると Excel が数式として扱うので、文字列の先頭に ' を付ける
+func csvCell(cell interface{}) string {
+	s, ok := cell.(string)
+	if !ok {
+		return fmt.Sprint(cell)
+	}
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "○"
+	}
+	return ""
+}
+
+// エクスポート用の来店1件
+type exportVisit struct {
+	ID             int64
+	VisitedAt      string // "2006-01-02 15:04"
+	CheckedOutAt   string // "15:04"。未チェックアウトなら空
+	CheckoutReason string
+	StaySeconds    sql.NullInt64
+	LineUserID     string
+	DisplayName    string
+	FullName       string
+	MemberType     string
+	PosterID       string
+	Paid           bool
+	TicketUsed     bool
+}
+
+// from〜to（"YYYY-MM-DD"、両端を含む）の来店を古い順に
+func getVisitsInRange(from, to, filterText, filterType string) ([]exportVisit, error) {
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+SELECT
+  v.id,
+  strftime('%Y-%m-%d %H:%M', v.visited_at),
+  IFNULL(strftime('%H:%M', v.checked_out_at), ''),
+  IFNULL(v.checkout_reason, ''),
+  v.duration_seconds,
+  v.line_user_id,
+  IFNULL(m.display_name, ''),
+  IFNULL(m.full_name, ''),
+  IFNULL(m.member_type, ` + defaultPlanCodeSQL + `),
+  IFNULL(m.poster_id, ''),
+  IFNULL(v.paid, 0) != 0,
+  v.ticket_pack_id IS NOT NULL
+FROM visits v
+LEFT JOIN members m ON m.line_user_id = v.line_user_id
+WHERE date(v.visited_at) BETWEEN ? AND ?`
+	where, filterArgs := memberFilterConditions(plans, filterText, filterType, "v.line_user_id")
+	args := append([]interface{}{from, to}, filterArgs...)
+	if len(where) > 0 {
+		query += " AND " + strings.Join(where, " AND ")
+	}
+	query += "\nORDER BY v.visited_at, v.id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []exportVisit
+	for rows.Next() {
+		var v exportVisit
+		if err := rows.Scan(&v.ID, &v.VisitedAt, &v.CheckedOutAt, &v.CheckoutReason, &v.StaySeconds,
+			&v.LineUserID, &v.DisplayName, &v.FullName, &v.MemberType, &v.PosterID, &v.Paid, &v.TicketUsed); err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+// GET /admin/export/visits?from=YYYY-MM-DD&to=YYYY-MM-DD&q=&member_type=&format=csv|xlsx
+func handleAdminExportVisits(w http.ResponseWriter, r *http.Request) {
+	format, ok := exportFormatParam(r)
+	if !ok {
+		http.Error(w, "bad format", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	from, err1 := time.ParseInLocation("2006-01-02", query.Get("from"), jst)
+	to, err2 := time.ParseInLocation("2006-01-02", query.Get("to"), jst)
+	if err1 != nil || err2 != nil || to.Before(from) {
+		http.Error(w, "bad date range", http.StatusBadRequest)
+		return
+	}
+
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		log.Println("loadPlanCatalog error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	visits, err := getVisitsInRange(formatJSTDate(from), formatJSTDate(to), query.Get("q"), query.Get("member_type"))
+	if err != nil {
+		log.Println("getVisitsInRange error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rows := [][]interface{}{{
+		"来店ID", "来店日時", "退館", "終了方法", "滞在（分）",
+		"LINE ID", "表示名", "氏名", "会員種別", "PosterID", "支払い済み", "回数券",
+	}}
+	for _, v := range visits {
+		var stay interface{} = ""
+		if v.StaySeconds.Valid {
+			stay = int(v.StaySeconds.Int64 / 60)
+		}
+		reason := ""
+		if v.CheckedOutAt != "" {
+			reason = checkoutReasonLabel(v.CheckoutReason)
+		}
+		rows = append(rows, []interface{}{
+			v.ID, v.VisitedAt, v.CheckedOutAt, reason, stay,
+			v.LineUserID, v.DisplayName, v.FullName, plans.lookup(v.MemberType).Name, v.PosterID,
+			yesNo(v.Paid), yesNo(v.TicketUsed),
+		})
+	}
+
+	log.Printf("[ADMIN] export visits: %s..%s rows=%d format=%s\n", formatJSTDate(from), formatJSTDate(to), len(visits), format)
+	writeExport(w, format, "visits_"+formatJSTDate(from)+"_"+formatJSTDate(to), "来店履歴", rows)
+}
+
+// GET /admin/export/members?q=&member_type=&format=csv|xlsx
+func handleAdminExportMembers(w http.ResponseWriter, r *http.Request) {
+	format, ok := exportFormatParam(r)
+	if !ok {
+		http.Error(w, "bad format", http.StatusBadRequest)
+		return
+	}
+	members, err := getMemberSummaries(r.URL.Query().Get("q"), r.URL.Query().Get("member_type"))
+	if err != nil {
+		log.Println("getMemberSummaries error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rows := [][]interface{}{{
+		"LINE ID", "表示名", "氏名", "会員種別コード", "会員種別", "PosterID", "今月の来店回数",
+	}}
+	for _, m := range members {
+		rows = append(rows, []interface{}{
+			m.LineUserID, m.DisplayName, m.FullName, m.MemberType, m.Plan.Name, m.PosterID, m.MonthlyCount,
+		})
+	}
+
+	log.Printf("[ADMIN] export members: rows=%d format=%s\n", len(members), format)
+	writeExport(w, format, "members_"+formatJSTDate(jstNow()), "会員一覧", rows)
+}
+
+// GET /admin/export/billing?month=YYYY-MM&q=&member_type=&format=csv|xlsx
+//
+// 月間の来店一覧と同じ集計（その月に来店した会員ごとの請求・入金・未収）
+func handleAdminExportBilling(w http.ResponseWriter, r *http.Request) {
+	format, ok := exportFormatParam(r)
+	if !ok {
+		http.Error(w, "bad format", http.StatusBadRequest)
+		return
+	}
+	base, err := time.ParseInLocation("2006-01", r.URL.Query().Get("month"), jst)
+	if err != nil {
+		http.Error(w, "bad month", http.StatusBadRequest)
+		return
+	}
+
+	summaries, err := getMonthlySummaries(base.Year(), int(base.Month()), r.URL.Query().Get("q"), r.URL.Query().Get("member_type"))
+	if err != nil {
+		log.Println("getMonthlySummaries error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rows := [][]interface{}{{
+		"LINE ID", "表示名", "氏名", "会員種別", "PosterID", "来店回数",
+		"月額（円）", "追加料金（円）", "請求額（円）", "入金額（円）", "未収（円）",
+	}}
+	for _, s := range summaries {
+		rows = append(rows, []interface{}{
+			s.LineUserID, s.DisplayName, s.FullName, s.Plan.Name, s.PosterID, s.Count,
+			s.Plan.MonthlyFee, s.Expected - s.Plan.MonthlyFee, s.Expected, s.Expected - s.Balance, s.Balance,
+		})
+	}
+
+	monthKey := formatJSTMonth(base)
+	log.Printf("[ADMIN] export billing: month=%s rows=%d format=%s\n", monthKey, len(summaries), format)
+	writeExport(w, format, "billing_"+monthKey, monthKey+" 請求", rows)
+}
@@ -0,0 +1,262 @@
+// geofence.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 端末の位置（ブラウザの Geolocation API）による来店の確認。
+// GEOFENCE_MODE=flag    : 離れた場所・位置が分からないチェックインも受け付け、要確認として残す
+// GEOFENCE_MODE=enforce : 半径の外・位置が分からないチェックインは断る（精度が悪いだけなら要確認で受け付ける）
+// どちらも距離は appLog に残し、要確認・断ったものは checkin_location_flags に記録する（/admin/location-flags）。
+
+const (
+	geofenceModeOff     = "off"
+	geofenceModeFlag    = "flag"
+	geofenceModeEnforce = "enforce"
+)
+
+// checkin_location_flags.result
+const (
+	geofenceResultOK      = "ok"
+	geofenceResultFlagged = "flagged"
+	geofenceResultRefused = "refused"
+)
+
+// checkin_location_flags.reason
+const (
+	geofenceReasonNoLocation   = "no_location"
+	geofenceReasonTooFar       = "too_far"
+	geofenceReasonPoorAccuracy = "poor_accuracy"
+	geofenceReasonInvalid      = "invalid_location"
+)
+
+func geofenceReasonLabel(reason string) string {
+	switch reason {
+	case geofenceReasonNoLocation:
+		return "位置情報なし"
+	case geofenceReasonTooFar:
+		return "店舗から遠い"
+	case geofenceReasonPoorAccuracy:
+		return "位置の精度が低い"
+	case geofenceReasonInvalid:
+		return "位置情報が不正"
+	default:
+		return reason
+	}
+}
+
+type geofenceConfig struct {
+	Mode         string
+	Lat, Lng     float64
+	RadiusM      float64
+	MaxAccuracyM float64 // これより精度が悪い（誤差が大きい）位置は要確認にする
+}
+
+// main で設定する
+var geofence = geofenceConfig{Mode: geofenceModeOff}
+
+// GEOFENCE_MODE / GEOFENCE_LAT / GEOFENCE_LNG / GEOFENCE_RADIUS_METERS / GEOFENCE_MAX_ACCURACY_METERS から読む
+func geofenceConfigFromEnv() (geofenceConfig, error) {
+	cfg := geofenceConfig{Mode: geofenceModeOff, RadiusM: 150, MaxAccuracyM: 300}
+	switch mode := strings.TrimSpace(os.Getenv("GEOFENCE_MODE")); mode {
+	case "", geofenceModeOff:
+		return cfg, nil
+	case geofenceModeFlag, geofenceModeEnforce:
+		cfg.Mode = mode
+	default:
+		return cfg, fmt.Errorf("unknown GEOFENCE_MODE: %s", mode)
+	}
+
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(os.Getenv("GEOFENCE_LAT")), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(os.Getenv("GEOFENCE_LNG")), 64)
+	if err1 != nil || err2 != nil || !validLatLng(lat, lng) {
+		return cfg, fmt.Errorf("GEOFENCE_LAT and GEOFENCE_LNG must be set for GEOFENCE_MODE=%s", cfg.Mode)
+	}
+	cfg.Lat, cfg.Lng = lat, lng
+
+	if raw := strings.TrimSpace(os.Getenv("GEOFENCE_RADIUS_METERS")); raw != "" {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || v <= 0 {
+			return cfg, fmt.Errorf("GEOFENCE_RADIUS_METERS must be a positive number: %q", raw)
+		}
+		cfg.RadiusM = v
+	}
+	if raw := strings.TrimSpace(os.Getenv("GEOFENCE_MAX_ACCURACY_METERS")); raw != "" {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || v <= 0 {
+			return cfg, fmt.Errorf("GEOFENCE_MAX_ACCURACY_METERS must be a positive number: %q", raw)
+		}
+		cfg.MaxAccuracyM = v
+	}
+	log.Printf("✅ 位置の確認: %s（半径 %.0fm）\n", cfg.Mode, cfg.RadiusM)
+	return cfg, nil
+}
+
+func (g geofenceConfig) enabled() bool {
+	return g.Mode == geofenceModeFlag || g.Mode == geofenceModeEnforce
+}
+
+func validLatLng(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 && !(lat == 0 && lng == 0)
+}
+
+// 2点間の距離（メートル、球面で近似）
+func haversineMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusM = 6371000
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+// /checkin で送られてきた位置の判定結果
+type geofenceCheck struct {
+	Result      string // geofenceResult*
+	Reason      string // geofenceReason*（ok なら空）
+	HasLocation bool
+	Lat, Lng    float64
+	AccuracyM   float64
+	DistanceM   float64
+}
+
+func (g geofenceConfig) evaluate(lat, lng, accuracy *float64) geofenceCheck {
+	outside := geofenceResultFlagged
+	if g.Mode == geofenceModeEnforce {
+		outside = geofenceResultRefused
+	}
+
+	if lat == nil || lng == nil {
+		return geofenceCheck{Result: outside, Reason: geofenceReasonNoLocation}
+	}
+	c := geofenceCheck{HasLocation: true, Lat: *lat, Lng: *lng}
+	if accuracy != nil {
+		c.AccuracyM = *accuracy
+	}
+	if !validLatLng(c.Lat, c.Lng) || math.IsNaN(c.AccuracyM) || c.AccuracyM < 0 {
+		c.Result, c.Reason = outside, geofenceReasonInvalid
+		return c
+	}
+
+	c.DistanceM = haversineMeters(g.Lat, g.Lng, c.Lat, c.Lng)
+	switch {
+	case c.DistanceM-c.AccuracyM > g.RadiusM:
+		// 誤差の範囲を考えても半径に届かない
+		c.Result, c.Reason = outside, geofenceReasonTooFar
+	case accuracy == nil || c.AccuracyM > g.MaxAccuracyM:
+		c.Result, c.Reason = geofenceResultFlagged, geofenceReasonPoorAccuracy
+	default:
+		c.Result = geofenceResultOK
+	}
+	return c
+}
+
+// /checkin で断ったときの案内
+func (c geofenceCheck) refusedMessage() string {
+	switch c.Reason {
+	case geofenceReasonNoLocation, geofenceReasonInvalid:
+		return "位置情報を確認できないため、チェックインできません。\nLINE の位置情報の利用を許可してから、もう一度お試しください。"
+	default:
+		return fmt.Sprintf("店舗から離れた場所（約%s）ではチェックインできません。\n店舗に着いてから、もう一度お試しください。",
+			formatDistance(c.DistanceM))
+	}
+}
+
+func formatDistance(m float64) string {
+	if m >= 1000 {
+		return fmt.Sprintf("%.1fkm", m/1000)
+	}
+	return fmt.Sprintf("%.0fm", m)
+}
+
+// 要確認・断ったチェックインを残す（ok なら何もしない）。visitID は断った場合 0
+func recordGeofenceFlag(lineUserID, displayName string, visitID int64, c geofenceCheck) error {
+	if c.Result == geofenceResultOK {
+		return nil
+	}
+	var lat, lng, accuracy, distance interface{}
+	if c.HasLocation {
+		lat, lng, accuracy, distance = c.Lat, c.Lng, c.AccuracyM, c.DistanceM
+	}
+	_, err := db.Exec(`
+INSERT INTO checkin_location_flags(
+  line_user_id, display_name, visit_id, checked_at, result, reason,
+  latitude, longitude, accuracy_m, distance_m
+) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		lineUserID, displayName, sql.NullInt64{Int64: visitID, Valid: visitID != 0},
+		formatJSTDateTime(jstNow()), c.Result, c.Reason,
+		lat, lng, accuracy, distance,
+	)
+	return err
+}
+
+// 管理画面の一覧の1行
+type locationFlag struct {
+	ID          int64
+	LineUserID  string
+	DisplayName string
+	FullName    string
+	VisitID     int64
+	CheckedAt   string // "2006/01/02 15:04"
+	Result      string
+	Reason      string
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+	AccuracyM   float64
+	DistanceM   float64
+}
+
+func (f locationFlag) ReasonLabel() string {
+	return geofenceReasonLabel(f.Reason)
+}
+
+func (f locationFlag) DistanceLabel() string {
+	return formatDistance(f.DistanceM)
+}
+
+func (f locationFlag) AccuracyLabel() string {
+	return formatDistance(f.AccuracyM)
+}
+
+func (f locationFlag) MapURL() string {
+	return fmt.Sprintf("https://www.google.com/maps?q=%.6f,%.6f", f.Latitude, f.Longitude)
+}
+
+// 新しい順。result が空なら両方
+func listLocationFlags(result string, limit int) ([]locationFlag, error) {
+	rows, err := db.Query(`
+SELECT f.id, f.line_user_id, f.display_name, IFNULL(m.full_name, ''), IFNULL(f.visit_id, 0),
+       strftime('%Y/%m/%d %H:%M', f.checked_at), f.result, f.reason,
+       f.latitude IS NOT NULL, IFNULL(f.latitude, 0), IFNULL(f.longitude, 0),
+       IFNULL(f.accuracy_m, 0), IFNULL(f.distance_m, 0)
+FROM checkin_location_flags f
+LEFT JOIN members m ON m.line_user_id = f.line_user_id
+WHERE ? = '' OR f.result = ?
+ORDER BY f.checked_at DESC, f.id DESC
+LIMIT ?`, result, result, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []locationFlag
+	for rows.Next() {
+		var f locationFlag
+		if err := rows.Scan(&f.ID, &f.LineUserID, &f.DisplayName, &f.FullName, &f.VisitID,
+			&f.CheckedAt, &f.Result, &f.Reason,
+			&f.HasLocation, &f.Latitude, &f.Longitude, &f.AccuracyM, &f.DistanceM); err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
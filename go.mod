@@ -3,3 +3,7 @@ module checkin-app
 go 1.25.3
 
 require github.com/mattn/go-sqlite3 v1.14.32
+
+require golang.org/x/crypto v0.45.0
+
+require rsc.io/qr v0.2.0
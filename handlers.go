@@ -2,17 +2,61 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 )
 
+// /checkin の結果（checkinResponse.Status）
+const (
+	checkinStatusCheckedIn    = "checked_in"
+	checkinStatusOverCapacity = "over_capacity" // 入れたが定員を超えている（warn）
+	checkinStatusWaitlisted   = "waitlisted"    // 満員で断り、順番待ちに入れた（reject）
+	checkinStatusClosed       = "closed"        // 営業時間外で断った（business_hours.go）
+	checkinStatusKioskToken   = "kiosk_token"   // 受付の QR コードが無い・古いので断った（kiosk_qr.go）
+	checkinStatusGeofence     = "geofence"      // 店舗から離れた場所なので断った（geofence.go）
+	checkinStatusFull         = "full"          // 満員で断った（順番待ちに入れられないスタッフ端末から）
+)
+
 type checkinResponse struct {
 	Count             int `json:"count"`
 	Max               int `json:"max"`
 	MonthlyVisitCount int `json:"monthlyVisitCount"`
 
-	ShowLightPlanNotice bool   `json:"showLightPlanNotice"`
+	ShowLightPlanNotice bool   `json:"showLightPlanNotice"` // 込み回数を超えた来店（名前は旧ライトプランの名残）
 	Message             string `json:"message,omitempty"`
+
+	TicketUsed       bool `json:"ticketUsed"`                 // この来店で回数券を1回分使った
+	TicketsRemaining *int `json:"ticketsRemaining,omitempty"` // 使える回数券の残り（持っていなければ省略）
+
+	Status           string `json:"status"`                     // checkinStatus*
+	WaitlistPosition int    `json:"waitlistPosition,omitempty"` // 順番待ちの何番目か（status が waitlisted のとき）
+}
+
+// チェックインできたときの回数券・追加料金・定員超えの案内を入れる（/checkin とスタッフ端末で共通）
+func (resp *checkinResponse) setCompletionMessage(ticketPackID int64, ticketsRemaining int, planNotice string) {
+	resp.ShowLightPlanNotice = planNotice != ""
+	switch {
+	case ticketPackID != 0:
+		// 回数券で払い済みなのでスタッフへの声かけは要らない
+		resp.ShowLightPlanNotice = false
+		resp.TicketUsed = true
+		resp.TicketsRemaining = &ticketsRemaining
+		resp.Message = fmt.Sprintf("チェックインが完了しました。\n回数券を1回分使いました（残り%d回）。", ticketsRemaining)
+	case planNotice != "":
+		resp.Message = "チェックインが完了しました。\n" + planNotice
+	}
+	if ticketsRemaining > 0 {
+		resp.TicketsRemaining = &ticketsRemaining
+	}
+	if resp.Status == checkinStatusOverCapacity {
+		msg := resp.Message
+		if msg == "" {
+			msg = "チェックインが完了しました。"
+		}
+		resp.Message = "※ただいま定員を超えています。混み合っていますのでご注意ください。\n" + msg
+	}
 }
 
 type clientLogRequest struct {
@@ -40,6 +84,41 @@ func handleCountJSON(w http.ResponseWriter, r *http.Request) {
 	appLog.info("count_checked", fields)
 }
 
+// GET /plans
+// LIFF の登録画面で選べるプラン
+func handlePlans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		log.Println("loadPlanCatalog error:", err)
+		fields := eventFieldsFromRequest(r)
+		fields["operation"] = "list_plans"
+		fields["error"] = err.Error()
+		appLog.error("db_error", fields)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	type planOption struct {
+		Code string `json:"code"`
+		Name string `json:"name"`
+	}
+	options := []planOption{}
+	for _, p := range plans.selectable() {
+		options = append(options, planOption{Code: p.Code, Name: p.Name})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"plans":   options,
+		"default": defaultPlanCode,
+	})
+}
+
 // POST /checkin
 func handleCheckin(w http.ResponseWriter, r *http.Request) {
 	fields := eventFieldsFromRequest(r)
@@ -50,20 +129,131 @@ func handleCheckin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	identity, ok := requireLineUser(w, r, fields)
+	if !ok {
+		return
+	}
+
 	var req checkinRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		fields["status"] = http.StatusBadRequest
 		fields["error"] = "bad request"
 		appLog.error("request_error", fields)
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	fields["line_user_id"] = req.UserID
+	req.UserID = identity.UserID
+	if identity.DisplayName != "" {
+		req.DisplayName = identity.DisplayName
+	}
 	fields["display_name"] = req.DisplayName
 	appLog.info("checkin_attempt", fields)
 
+	if kioskQR.Required {
+		if err := kioskQR.verify(req.KioskToken, jstNow()); err != nil {
+			fields["reason"] = err.Error()
+			appLog.info("checkin_rejected_kiosk_token", fields)
+			w.Header().Set("Content-Type", "application/json")
+			resp := checkinResponse{
+				Count:   getCurrentCount(),
+				Max:     getMaxPeople(),
+				Status:  checkinStatusKioskToken,
+				Message: kioskTokenErrorMessage(err),
+			}
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				log.Println("encode error:", err)
+			}
+			return
+		}
+	}
+
+	var geo geofenceCheck
+	if geofence.enabled() {
+		geo = geofence.evaluate(req.Latitude, req.Longitude, req.Accuracy)
+		geoFields := eventFieldsFromRequest(r)
+		geoFields["line_user_id"] = req.UserID
+		geoFields["mode"] = geofence.Mode
+		geoFields["result"] = geo.Result
+		if geo.Reason != "" {
+			geoFields["reason"] = geo.Reason
+		}
+		if geo.HasLocation {
+			geoFields["distance_m"] = math.Round(geo.DistanceM)
+			geoFields["accuracy_m"] = math.Round(geo.AccuracyM)
+		}
+		appLog.info("checkin_geofence", geoFields)
+
+		if geo.Result == geofenceResultRefused {
+			if err := recordGeofenceFlag(req.UserID, req.DisplayName, 0, geo); err != nil {
+				log.Println("recordGeofenceFlag error:", err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			resp := checkinResponse{
+				Count:   getCurrentCount(),
+				Max:     getMaxPeople(),
+				Status:  checkinStatusGeofence,
+				Message: geo.refusedMessage(),
+			}
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				log.Println("encode error:", err)
+			}
+			return
+		}
+	}
+
+	if now := jstNow(); !isBusinessOpen(now) {
+		appLog.info("checkin_refused_closed", fields)
+		w.Header().Set("Content-Type", "application/json")
+		resp := checkinResponse{
+			Count:   getCurrentCount(),
+			Max:     getMaxPeople(),
+			Status:  checkinStatusClosed,
+			Message: businessHours.closedMessage(now),
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Println("encode error:", err)
+		}
+		return
+	}
+
+	// 定員の判定から addCheckin までは1人ずつ
+	checkinGate.Lock()
+	admission, err := admitCheckin(req.UserID, req.DisplayName, true)
+	if err != nil {
+		checkinGate.Unlock()
+		log.Println("admitCheckin error:", err)
+		fields["operation"] = "admit_checkin"
+		fields["error"] = err.Error()
+		appLog.error("db_error", fields)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if admission.Status == checkinStatusWaitlisted {
+		checkinGate.Unlock()
+		count, maxPeople := getCurrentCount(), getMaxPeople()
+		fields["count"] = count
+		fields["max"] = maxPeople
+		fields["waitlist_position"] = admission.Position
+		appLog.info("checkin_waitlisted", fields)
+
+		w.Header().Set("Content-Type", "application/json")
+		resp := checkinResponse{
+			Count:            count,
+			Max:              maxPeople,
+			Status:           admission.Status,
+			WaitlistPosition: admission.Position,
+			Message: fmt.Sprintf("ただいま満員のため、順番待ちに登録しました（%d番目）。\n空きが出たらお知らせします。",
+				admission.Position),
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Println("encode error:", err)
+		}
+		return
+	}
+
 	// 来店履歴を保存
-	if err := recordVisit(req.UserID, req.DisplayName); err != nil {
+	visitID, ticketPackID, err := recordVisit(req.UserID, req.DisplayName, visitSourceLIFF)
+	if err != nil {
 		log.Println("recordVisit error:", err)
 		appLog.error("db_error", eventFields{
 			"request_id":   requestIDFromContext(r.Context()),
@@ -75,7 +265,29 @@ func handleCheckin(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	count := addCheckin(req.UserID)
+	count, err := addCheckin(req.UserID, visitID)
+	checkinGate.Unlock()
+	if err != nil {
+		log.Println("addCheckin error:", err)
+		fields["operation"] = "open_checkin_session"
+		fields["error"] = err.Error()
+		appLog.error("db_error", fields)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if geo.Result == geofenceResultFlagged {
+		if err := recordGeofenceFlag(req.UserID, req.DisplayName, visitID, geo); err != nil {
+			log.Println("recordGeofenceFlag error:", err)
+			appLog.error("db_error", eventFields{
+				"request_id":   requestIDFromContext(r.Context()),
+				"path":         r.URL.Path,
+				"method":       r.Method,
+				"line_user_id": req.UserID,
+				"operation":    "record_location_flag",
+				"error":        err.Error(),
+			})
+		}
+	}
 	monthlyVisitCount, err := getMonthlyVisitCount(req.UserID)
 	if err != nil {
 		log.Println("getMonthlyVisitCount error:", err)
@@ -89,15 +301,28 @@ func handleCheckin(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	showLightPlanNotice, err := shouldShowLightPlanCheckinNotice(req.UserID)
+	planNotice, err := planCheckinNotice(req.UserID)
+	if err != nil {
+		log.Println("planCheckinNotice error:", err)
+		appLog.error("db_error", eventFields{
+			"request_id":   requestIDFromContext(r.Context()),
+			"path":         r.URL.Path,
+			"method":       r.Method,
+			"line_user_id": req.UserID,
+			"operation":    "check_plan_notice",
+			"error":        err.Error(),
+		})
+	}
+
+	ticketsRemaining, err := memberTicketBalance(req.UserID)
 	if err != nil {
-		log.Println("shouldShowLightPlanCheckinNotice error:", err)
+		log.Println("memberTicketBalance error:", err)
 		appLog.error("db_error", eventFields{
 			"request_id":   requestIDFromContext(r.Context()),
 			"path":         r.URL.Path,
 			"method":       r.Method,
 			"line_user_id": req.UserID,
-			"operation":    "check_light_plan_notice",
+			"operation":    "get_ticket_balance",
 			"error":        err.Error(),
 		})
 	}
@@ -107,12 +332,9 @@ func handleCheckin(w http.ResponseWriter, r *http.Request) {
 		Count:             count,
 		Max:               getMaxPeople(),
 		MonthlyVisitCount: monthlyVisitCount,
-
-		ShowLightPlanNotice: showLightPlanNotice,
-	}
-	if showLightPlanNotice {
-		resp.Message = "チェックインが完了しました。\n【ライトプラン】今月5回目以降のご来店です。\nスタッフにお声がけください。"
+		Status:            admission.Status,
 	}
+	resp.setCompletionMessage(ticketPackID, ticketsRemaining, planNotice)
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Println("encode error:", err)
 		appLog.error("response_encode_failed", eventFields{
@@ -128,6 +350,11 @@ func handleCheckin(w http.ResponseWriter, r *http.Request) {
 	successFields["display_name"] = req.DisplayName
 	successFields["count_after"] = count
 	successFields["monthly_visit_count"] = monthlyVisitCount
+	successFields["checkin_status"] = admission.Status
+	if ticketPackID != 0 {
+		successFields["ticket_pack_id"] = ticketPackID
+		successFields["tickets_remaining"] = ticketsRemaining
+	}
 	appLog.info("checkin_success", successFields)
 
 	log.Printf("チェックイン：%+v\n", req)
@@ -143,19 +370,41 @@ func handleCheckout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	identity, ok := requireLineUser(w, r, fields)
+	if !ok {
+		return
+	}
+
 	var req checkinRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		fields["status"] = http.StatusBadRequest
 		fields["error"] = "bad request"
 		appLog.error("request_error", fields)
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	fields["line_user_id"] = req.UserID
+	req.UserID = identity.UserID
+	if identity.DisplayName != "" {
+		req.DisplayName = identity.DisplayName
+	}
 	fields["display_name"] = req.DisplayName
+
+	reason := checkoutReasonManual
+	if req.Trigger == "auto" {
+		reason = checkoutReasonAutoToggle
+	}
+	fields["checkout_reason"] = reason
 	appLog.info("checkout_attempt", fields)
 
-	count := removeCheckin(req.UserID)
+	count, err := removeCheckin(req.UserID, reason)
+	if err != nil {
+		log.Println("removeCheckin error:", err)
+		fields["operation"] = "close_checkin_session"
+		fields["error"] = err.Error()
+		appLog.error("db_error", fields)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]int{
@@ -175,22 +424,20 @@ func handleCheckout(w http.ResponseWriter, r *http.Request) {
 	successFields["line_user_id"] = req.UserID
 	successFields["display_name"] = req.DisplayName
 	successFields["count_after"] = count
+	successFields["checkout_reason"] = reason
 	appLog.info("checkout_success", successFields)
 
 	log.Printf("チェックアウト: %+v\n", req)
 }
 
-// GET /status?userId=xxxx
+// GET /status
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	fields := eventFieldsFromRequest(r)
-	userID := r.URL.Query().Get("userId")
-	if userID == "" {
-		fields["status"] = http.StatusBadRequest
-		fields["error"] = "userId is required"
-		appLog.error("request_error", fields)
-		http.Error(w, "userId is required", http.StatusBadRequest)
+	identity, ok := requireLineUser(w, r, fields)
+	if !ok {
 		return
 	}
+	userID := identity.UserID
 
 	status := getAutoToggleStatus(userID)
 	monthlyVisitCount, err := getMonthlyVisitCount(userID)
@@ -233,10 +480,12 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		"canAutoCheckin":             status.CanAutoCheckin,
 		"autoCheckoutBlockedSeconds": status.AutoCheckoutBlockedSeconds,
 		"autoCheckinBlockedSeconds":  status.AutoCheckinBlockedSeconds,
+		"kioskTokenRequired":         kioskQR.Required,
+		"locationRequested":          geofence.enabled(),
 	})
 }
 
-// GET /member/monthly-visits?userId=xxxx
+// GET /member/monthly-visits
 func handleMemberMonthlyVisits(w http.ResponseWriter, r *http.Request) {
 	fields := eventFieldsFromRequest(r)
 	if r.Method != http.MethodGet {
@@ -246,14 +495,11 @@ func handleMemberMonthlyVisits(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := r.URL.Query().Get("userId")
-	if userID == "" {
-		fields["status"] = http.StatusBadRequest
-		fields["error"] = "userId is required"
-		appLog.error("request_error", fields)
-		http.Error(w, "userId is required", http.StatusBadRequest)
+	identity, ok := requireLineUser(w, r, fields)
+	if !ok {
 		return
 	}
+	userID := identity.UserID
 
 	monthlyVisitCount, err := getMonthlyVisitCount(userID)
 	if err != nil {
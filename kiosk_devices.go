@@ -0,0 +1,163 @@
+// kiosk_devices.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// 受付のスタッフ端末（/staff.html）を登録したときのトークン。
+// 管理画面の Cookie とは別で、端末に保存して Authorization: Bearer で送る。
+// 会員の検索とチェックイン・チェックアウトしかできない（staff_kiosk.go）。
+
+// 見分けやすいように固定の接頭辞を付ける
+const kioskDeviceTokenPrefix = "eckiosk_"
+
+var errKioskDeviceInvalid = errors.New("kiosk device token invalid")
+
+type kioskDevice struct {
+	ID            int64
+	Name          string
+	Prefix        string
+	AdminUserID   int64
+	AdminUsername string
+	CreatedAt     string
+	LastUsedAt    string // 空なら未使用
+	RevokedAt     string // 空なら有効
+}
+
+func (d *kioskDevice) Active() bool {
+	return d.RevokedAt == ""
+}
+
+const kioskDeviceColumns = `
+  d.id,
+  d.name,
+  d.token_prefix,
+  d.admin_user_id,
+  IFNULL(u.username, ''),
+  strftime('%Y-%m-%d %H:%M', d.created_at),
+  IFNULL(strftime('%Y-%m-%d %H:%M', d.last_used_at), ''),
+  IFNULL(strftime('%Y-%m-%d %H:%M', d.revoked_at), '')
+`
+
+func scanKioskDevice(scan func(dest ...interface{}) error) (*kioskDevice, error) {
+	var d kioskDevice
+	if err := scan(&d.ID, &d.Name, &d.Prefix, &d.AdminUserID, &d.AdminUsername,
+		&d.CreatedAt, &d.LastUsedAt, &d.RevokedAt); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// 登録する。生のトークンを返すのはこのときだけ。
+func createKioskDevice(ex sqlExecer, name string, adminUserID int64) (string, *kioskDevice, error) {
+	secret, err := newAdminSessionToken()
+	if err != nil {
+		return "", nil, err
+	}
+	raw := kioskDeviceTokenPrefix + secret
+
+	d := &kioskDevice{
+		Name:        name,
+		Prefix:      raw[:len(kioskDeviceTokenPrefix)+8],
+		AdminUserID: adminUserID,
+		CreatedAt:   formatJSTDateTime(jstNow()),
+	}
+	res, err := ex.Exec(
+		`INSERT INTO kiosk_devices(name, token_hash, token_prefix, admin_user_id, created_at)
+         VALUES(?, ?, ?, ?, ?)`,
+		name, hashAdminSessionToken(raw), d.Prefix, adminUserID, d.CreatedAt,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	if d.ID, err = res.LastInsertId(); err != nil {
+		return "", nil, err
+	}
+	return raw, d, nil
+}
+
+func listKioskDevices() ([]kioskDevice, error) {
+	rows, err := db.Query(`SELECT ` + kioskDeviceColumns + `
+FROM kiosk_devices d
+LEFT JOIN admin_users u ON u.id = d.admin_user_id
+ORDER BY d.revoked_at IS NOT NULL, d.created_at DESC, d.id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []kioskDevice
+	for rows.Next() {
+		d, err := scanKioskDevice(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *d)
+	}
+	return list, rows.Err()
+}
+
+func getKioskDevice(id int64) (*kioskDevice, error) {
+	return scanKioskDevice(db.QueryRow(`SELECT `+kioskDeviceColumns+`
+FROM kiosk_devices d
+LEFT JOIN admin_users u ON u.id = d.admin_user_id
+WHERE d.id = ?`, id).Scan)
+}
+
+func revokeKioskDevice(ex sqlExecer, id int64) error {
+	res, err := ex.Exec(
+		`UPDATE kiosk_devices SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		formatJSTDateTime(jstNow()), id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Authorization ヘッダーのトークンを確かめる。
+// 取り消し済み・登録した管理者が無効化されている場合は errKioskDeviceInvalid。
+func authenticateKioskDevice(raw string, now time.Time) (*kioskDevice, error) {
+	if !strings.HasPrefix(raw, kioskDeviceTokenPrefix) {
+		return nil, errKioskDeviceInvalid
+	}
+	d, err := scanKioskDevice(db.QueryRow(`SELECT `+kioskDeviceColumns+`
+FROM kiosk_devices d
+LEFT JOIN admin_users u ON u.id = d.admin_user_id
+WHERE d.token_hash = ?`, hashAdminSessionToken(raw)).Scan)
+	if err == sql.ErrNoRows {
+		return nil, errKioskDeviceInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !d.Active() {
+		return nil, errKioskDeviceInvalid
+	}
+
+	user, err := getAdminUser(d.AdminUserID)
+	if err == errAdminUserNotFound {
+		return nil, errKioskDeviceInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, errKioskDeviceInvalid
+	}
+
+	if _, err := db.Exec(
+		`UPDATE kiosk_devices SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at <= ?)`,
+		formatJSTDateTime(now), d.ID, formatJSTDateTime(now.Add(-apiTokenTouchInterval)),
+	); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
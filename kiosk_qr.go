@@ -0,0 +1,135 @@
+// kiosk_qr.go
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 受付に置いた端末で表示する QR コード（/admin/kiosk）。
+// 中身は30秒ごとに変わるトークンで、サーバーの秘密鍵の HMAC で署名している。
+// CHECKIN_QR_REQUIRED=true のとき、/checkin はこのトークンが無い・古いと断る（家からのチェックインを防ぐ）。
+
+const (
+	kioskQRPeriod      = 30 * time.Second
+	kioskQRTokenPrefix = "ecqr1"
+	kioskQRURLParam    = "kiosk" // LIFF の URL に付けるときのパラメータ名
+)
+
+var (
+	errKioskTokenMissing = errors.New("kiosk token missing")
+	errKioskTokenInvalid = errors.New("kiosk token invalid")
+	errKioskTokenStale   = errors.New("kiosk token stale")
+)
+
+type kioskQRConfig struct {
+	Required bool
+	LIFFURL  string // 設定すると QR に LIFF の URL ごと入れる（LINE のカメラで読んでもそのまま開ける）
+	secret   []byte
+}
+
+// main で設定する
+var kioskQR kioskQRConfig
+
+// CHECKIN_QR_REQUIRED / CHECKIN_QR_SECRET / CHECKIN_QR_LIFF_URL から読む
+func kioskQRConfigFromEnv() (kioskQRConfig, error) {
+	var cfg kioskQRConfig
+	if raw := strings.TrimSpace(os.Getenv("CHECKIN_QR_REQUIRED")); raw != "" {
+		required, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("CHECKIN_QR_REQUIRED must be true or false: %q", raw)
+		}
+		cfg.Required = required
+	}
+	cfg.LIFFURL = strings.TrimSpace(os.Getenv("CHECKIN_QR_LIFF_URL"))
+
+	if secret := strings.TrimSpace(os.Getenv("CHECKIN_QR_SECRET")); secret != "" {
+		if len(secret) < 16 {
+			return cfg, errors.New("CHECKIN_QR_SECRET must be at least 16 characters")
+		}
+		cfg.secret = []byte(secret)
+	} else {
+		// 起動ごとに作り直す（再起動の直後だけ、表示中の QR が使えなくなる）
+		cfg.secret = make([]byte, 32)
+		if _, err := rand.Read(cfg.secret); err != nil {
+			return cfg, err
+		}
+		if cfg.Required {
+			log.Println("⚠️ CHECKIN_QR_SECRET が未設定のため、起動ごとに QR の鍵を作り直します")
+		}
+	}
+	return cfg, nil
+}
+
+func kioskQRWindow(t time.Time) int64 {
+	return t.Unix() / int64(kioskQRPeriod/time.Second)
+}
+
+func (c kioskQRConfig) sign(window int64) string {
+	mac := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(mac, "%s.%d", kioskQRTokenPrefix, window)
+	// QR を細かくしすぎないよう、先頭 16 バイトだけ使う
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// t の時点で表示するトークンと、その有効な表示の終わり
+func (c kioskQRConfig) tokenAt(t time.Time) (token string, expiresAt time.Time) {
+	window := kioskQRWindow(t)
+	token = fmt.Sprintf("%s.%d.%s", kioskQRTokenPrefix, window, c.sign(window))
+	expiresAt = time.Unix((window+1)*int64(kioskQRPeriod/time.Second), 0).In(jst)
+	return token, expiresAt
+}
+
+// QR コードに入れる文字列
+func (c kioskQRConfig) payload(token string) string {
+	if c.LIFFURL == "" {
+		return token
+	}
+	sep := "?"
+	if strings.Contains(c.LIFFURL, "?") {
+		sep = "&"
+	}
+	return c.LIFFURL + sep + kioskQRURLParam + "=" + url.QueryEscape(token)
+}
+
+// 今の窓と1つ前の窓のトークンを受け付ける（読み取ってから送るまでの時間の分）
+func (c kioskQRConfig) verify(token string, now time.Time) error {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return errKioskTokenMissing
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != kioskQRTokenPrefix {
+		return errKioskTokenInvalid
+	}
+	window, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errKioskTokenInvalid
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(c.sign(window))) {
+		return errKioskTokenInvalid
+	}
+	current := kioskQRWindow(now)
+	if window != current && window != current-1 {
+		return errKioskTokenStale
+	}
+	return nil
+}
+
+// /checkin で断ったときの案内
+func kioskTokenErrorMessage(err error) string {
+	if err == errKioskTokenStale {
+		return "QRコードの有効期限が切れました。\n受付のQRコードをもう一度読み取ってください。"
+	}
+	return "チェックインするには、受付に表示されているQRコードを読み取ってください。"
+}
@@ -0,0 +1,366 @@
+// lineauth.go
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lineIssuer         = "https://access.line.me"
+	lineDefaultJWKSURL = "https://api.line.me/oauth2/v2.1/certs"
+	lineJWKSCacheTTL   = 6 * time.Hour
+	lineJWKSMinRefetch = time.Minute // 知らない kid が来たときの再取得間隔の下限
+	lineTokenLeeway    = 30 * time.Second
+
+	// LINE_AUTH_MODE=stub のときに受け付けるトークンの接頭辞（"stub:<userId>[:<displayName>]"）
+	stubIDTokenPrefix = "stub:"
+)
+
+var errLineTokenInvalid = errors.New("invalid id token")
+
+// 検証済みの LINE ユーザー
+type lineIdentity struct {
+	UserID      string
+	DisplayName string // ID トークンの name クレーム（profile スコープが無ければ空）
+}
+
+// LIFF の ID トークン（liff.getIDToken()）を検証する
+type idTokenVerifier interface {
+	verify(ctx context.Context, idToken string) (lineIdentity, error)
+}
+
+// main で設定する
+var lineVerifier idTokenVerifier
+
+// LINE_AUTH_MODE=line（既定）: LINE の公開鍵で署名を検証する
+// LINE_AUTH_MODE=stub       : 開発・テスト用。"stub:<userId>" をそのまま信じる
+func newLineVerifierFromEnv() (idTokenVerifier, error) {
+	mode := strings.TrimSpace(os.Getenv("LINE_AUTH_MODE"))
+	switch mode {
+	case "", "line":
+		channelID := strings.TrimSpace(os.Getenv("LINE_CHANNEL_ID"))
+		if channelID == "" {
+			return nil, errors.New("LINE_CHANNEL_ID must be set (or LINE_AUTH_MODE=stub for local development)")
+		}
+		jwksURL := strings.TrimSpace(os.Getenv("LINE_JWKS_URL"))
+		if jwksURL == "" {
+			jwksURL = lineDefaultJWKSURL
+		}
+		return newJWKSIDTokenVerifier(channelID, jwksURL), nil
+	case "stub":
+		log.Println("⚠️ LINE_AUTH_MODE=stub: IDトークンを検証しません（開発専用）")
+		return stubIDTokenVerifier{}, nil
+	default:
+		return nil, fmt.Errorf("unknown LINE_AUTH_MODE: %s", mode)
+	}
+}
+
+// Authorization: Bearer <idToken> を検証して LINE ユーザーを返す。
+// 失敗したときは 401 を返して ok=false。
+func requireLineUser(w http.ResponseWriter, r *http.Request, fields eventFields) (lineIdentity, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !found || token == "" {
+		fields["status"] = http.StatusUnauthorized
+		fields["error"] = "id token is required"
+		appLog.error("line_auth_failed", fields)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return lineIdentity{}, false
+	}
+
+	identity, err := lineVerifier.verify(r.Context(), token)
+	if err != nil {
+		fields["status"] = http.StatusUnauthorized
+		fields["error"] = err.Error()
+		appLog.error("line_auth_failed", fields)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return lineIdentity{}, false
+	}
+
+	fields["line_user_id"] = identity.UserID
+	return identity, true
+}
+
+// ---- 開発・テスト用 ----
+
+type stubIDTokenVerifier struct{}
+
+func (stubIDTokenVerifier) verify(_ context.Context, idToken string) (lineIdentity, error) {
+	rest, ok := strings.CutPrefix(idToken, stubIDTokenPrefix)
+	if !ok {
+		return lineIdentity{}, fmt.Errorf("%w: stub token must start with %q", errLineTokenInvalid, stubIDTokenPrefix)
+	}
+	userID, displayName, _ := strings.Cut(rest, ":")
+	if userID == "" {
+		return lineIdentity{}, fmt.Errorf("%w: empty stub user", errLineTokenInvalid)
+	}
+	return lineIdentity{UserID: userID, DisplayName: displayName}, nil
+}
+
+// ---- LINE の JWKS で検証 ----
+
+type jwksIDTokenVerifier struct {
+	channelID string
+	jwksURL   string
+	client    *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // kid → 公開鍵
+	fetchedAt time.Time
+}
+
+func newJWKSIDTokenVerifier(channelID, jwksURL string) *jwksIDTokenVerifier {
+	return &jwksIDTokenVerifier{
+		channelID: channelID,
+		jwksURL:   jwksURL,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		keys:      make(map[string]crypto.PublicKey),
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type lineIDTokenClaims struct {
+	Iss  string          `json:"iss"`
+	Sub  string          `json:"sub"`
+	Aud  json.RawMessage `json:"aud"` // 文字列 or 配列
+	Exp  int64           `json:"exp"`
+	Iat  int64           `json:"iat"`
+	Name string          `json:"name"`
+}
+
+func (v *jwksIDTokenVerifier) verify(ctx context.Context, idToken string) (lineIdentity, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return lineIdentity{}, fmt.Errorf("%w: malformed", errLineTokenInvalid)
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return lineIdentity{}, fmt.Errorf("%w: header: %v", errLineTokenInvalid, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return lineIdentity{}, fmt.Errorf("%w: signature encoding", errLineTokenInvalid)
+	}
+
+	key, err := v.publicKey(ctx, header.Kid)
+	if err != nil {
+		return lineIdentity{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifyJWTSignature(header.Alg, key, digest[:], signature); err != nil {
+		return lineIdentity{}, err
+	}
+
+	var claims lineIDTokenClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return lineIdentity{}, fmt.Errorf("%w: payload: %v", errLineTokenInvalid, err)
+	}
+	if claims.Iss != lineIssuer {
+		return lineIdentity{}, fmt.Errorf("%w: unexpected issuer %q", errLineTokenInvalid, claims.Iss)
+	}
+	if !audienceContains(claims.Aud, v.channelID) {
+		return lineIdentity{}, fmt.Errorf("%w: audience mismatch", errLineTokenInvalid)
+	}
+	if time.Now().After(time.Unix(claims.Exp, 0).Add(lineTokenLeeway)) {
+		return lineIdentity{}, fmt.Errorf("%w: expired", errLineTokenInvalid)
+	}
+	if claims.Sub == "" {
+		return lineIdentity{}, fmt.Errorf("%w: empty subject", errLineTokenInvalid)
+	}
+
+	return lineIdentity{UserID: claims.Sub, DisplayName: claims.Name}, nil
+}
+
+func decodeJWTSegment(segment string, out interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func audienceContains(raw json.RawMessage, channelID string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == channelID
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return false
+	}
+	for _, aud := range list {
+		if aud == channelID {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, digest, signature []byte) error {
+	switch alg {
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("%w: bad ES256 signature", errLineTokenInvalid)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("%w: signature mismatch", errLineTokenInvalid)
+		}
+		return nil
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: bad RS256 key", errLineTokenInvalid)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature); err != nil {
+			return fmt.Errorf("%w: signature mismatch", errLineTokenInvalid)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported alg %q", errLineTokenInvalid, alg)
+	}
+}
+
+// kid に対応する公開鍵を返す。キャッシュが古い・kid が無いときは取り直す。
+func (v *jwksIDTokenVerifier) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	key, ok := v.keys[kid]
+	stale := now.Sub(v.fetchedAt) > lineJWKSCacheTTL
+	if ok && !stale {
+		return key, nil
+	}
+	if !stale && now.Sub(v.fetchedAt) < lineJWKSMinRefetch {
+		return nil, fmt.Errorf("%w: unknown kid %q", errLineTokenInvalid, kid)
+	}
+
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		appLog.error("line_jwks_fetch_failed", eventFields{"url": v.jwksURL, "error": err.Error()})
+		if ok {
+			// 取得に失敗しても、手元の鍵で検証できるならそれを使う
+			return key, nil
+		}
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	v.keys = keys
+	v.fetchedAt = now
+
+	key, ok = v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown kid %q", errLineTokenInvalid, kid)
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (v *jwksIDTokenVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", res.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			// 対応していない鍵は飛ばす
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		point := append([]byte{4}, append(leftPad(x, 32), leftPad(y, 32)...)...)
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+	}
+}
+
+func leftPad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,235 @@
+// local_members.go
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// LINE を使わない会員。スマホを持っていない方などを管理画面で登録し、受付のスタッフ端末でチェックインする。
+// line_user_id には LINE の ID の代わりに内部 ID（local_ + 乱数）を入れ、line_linked を 0 にする。
+// 来店・入金・回数券などは line_user_id でつながるので、LINE の会員と同じ画面でそのまま扱える。
+
+const localMemberIDPrefix = "local_"
+
+func newLocalMemberID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return localMemberIDPrefix + hex.EncodeToString(b), nil
+}
+
+func isLocalMemberID(lineUserID string) bool {
+	return strings.HasPrefix(lineUserID, localMemberIDPrefix)
+}
+
+// カタカナをひらがなにそろえる（ふりがなはひらがなで保存し、検索もひらがなで比べる）
+func toHiragana(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'ァ' && r <= 'ヶ' {
+			return r - ('ァ' - 'ぁ')
+		}
+		return r
+	}, s)
+}
+
+func normalizeKana(s string) string {
+	return toHiragana(strings.Join(strings.Fields(s), " "))
+}
+
+// PosterID がほかの会員と重複している。画面にはそのまま表示する。
+type posterIDTakenError struct {
+	PosterID string
+	Name     string // すでに使っている会員
+}
+
+func (e posterIDTakenError) Error() string {
+	return "PosterID「" + e.PosterID + "」は " + e.Name + " さんと重複しています"
+}
+
+// LINE なしの会員を登録して内部 ID を返す
+func createLocalMember(r *http.Request, fullName, kana, posterID, memberType string) (string, error) {
+	lineUserID, err := newLocalMemberID()
+	if err != nil {
+		return "", err
+	}
+	createdAt := formatJSTDateTime(jstNow())
+
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		// スタッフ端末は PosterID でも探すので、一括登録（member_import.go）と同じく重複させない
+		if posterID != "" {
+			var other, name string
+			err := tx.QueryRow(
+				`SELECT line_user_id, COALESCE(NULLIF(full_name, ''), display_name, '') FROM members WHERE poster_id = ?`,
+				posterID,
+			).Scan(&other, &name)
+			if err == nil {
+				if name == "" {
+					name = other
+				}
+				return posterIDTakenError{PosterID: posterID, Name: name}
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(
+			`INSERT INTO members(line_user_id, display_name, full_name, full_name_kana, member_type, poster_id, line_linked, created_at)
+             VALUES(?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, ''), 0, ?)`,
+			lineUserID, fullName, fullName, kana, memberType, posterID, createdAt,
+		); err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{
+			Action:     auditActionMemberCreate,
+			LineUserID: lineUserID,
+			After: map[string]string{
+				"full_name":      fullName,
+				"full_name_kana": kana,
+				"member_type":    memberType,
+				"poster_id":      posterID,
+			},
+		})
+	})
+	return lineUserID, err
+}
+
+// 会員のふりがなを変える（空文字でクリア）。メッセージ用に名前を返す。
+func updateMemberKana(r *http.Request, lineUserID, kana string) (name string, err error) {
+	err = runAuditedTx(func(tx *sql.Tx) error {
+		var before string
+		if err := tx.QueryRow(
+			`SELECT COALESCE(NULLIF(full_name, ''), display_name, ''), IFNULL(full_name_kana, '')
+               FROM members WHERE line_user_id = ?`,
+			lineUserID,
+		).Scan(&name, &before); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(
+			`UPDATE members SET full_name_kana = NULLIF(?, '') WHERE line_user_id = ?`,
+			kana, lineUserID,
+		); err != nil {
+			return err
+		}
+		return writeAuditLog(tx, r, auditEntry{
+			Action:     auditActionMemberKana,
+			LineUserID: lineUserID,
+			Before:     map[string]string{"full_name_kana": before},
+			After:      map[string]string{"full_name_kana": kana},
+		})
+	})
+	return name, err
+}
+
+// POST /admin/members/create
+func handleAdminMemberCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	fullName := strings.TrimSpace(r.FormValue("full_name"))
+	kana := normalizeKana(r.FormValue("full_name_kana"))
+	posterID := strings.TrimSpace(r.FormValue("poster_id"))
+	memberType := r.FormValue("member_type")
+
+	if fullName == "" {
+		http.Error(w, "full_name is required", http.StatusBadRequest)
+		return
+	}
+
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		log.Println("loadPlanCatalog error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if memberType == "" {
+		memberType = defaultPlanCode
+	}
+	if !plans.has(memberType) {
+		http.Error(w, "invalid member_type", http.StatusBadRequest)
+		return
+	}
+
+	lineUserID, err := createLocalMember(r, fullName, kana, posterID, memberType)
+	var taken posterIDTakenError
+	if errors.As(err, &taken) {
+		http.Redirect(w, r, "/admin/members?error_msg="+url.QueryEscape(taken.Error()), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Println("create local member error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[ADMIN] create local member: %s (%s)\n", lineUserID, fullName)
+	msg := fmt.Sprintf("%s さんを登録しました。受付のスタッフ端末からチェックインできます。", fullName)
+	http.Redirect(w, r, "/admin/members?success_msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+// POST /admin/member/kana
+func handleAdminUpdateMemberKana(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	lineUserID := r.FormValue("line_user_id")
+	kana := normalizeKana(r.FormValue("full_name_kana"))
+
+	if lineUserID == "" {
+		http.Error(w, "line_user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	name, err := updateMemberKana(r, lineUserID, kana)
+	if err == sql.ErrNoRows {
+		http.Error(w, "member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("update full_name_kana error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if name == "" {
+		name = "不明なユーザー"
+	}
+	msg := fmt.Sprintf("%s さんのふりがなを更新しました。", name)
+
+	redirectTo := "/admin/members"
+	if ref := r.Referer(); ref != "" {
+		if u, err := url.Parse(ref); err == nil {
+			q := u.Query()
+			q.Set("success_msg", msg)
+			u.RawQuery = q.Encode()
+			redirectTo = u.RequestURI()
+		}
+	}
+
+	log.Printf("[ADMIN] update full_name_kana: %s -> %s\n", lineUserID, kana)
+	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+}
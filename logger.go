@@ -107,6 +107,10 @@ func (l *appLogger) info(event string, fields eventFields) {
 	l.write("INFO", event, fields)
 }
 
+func (l *appLogger) warn(event string, fields eventFields) {
+	l.write("WARN", event, fields)
+}
+
 func (l *appLogger) error(event string, fields eventFields) {
 	l.write("ERROR", event, fields)
 }
@@ -0,0 +1,299 @@
+// login_throttle.go
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// /admin/login の総当たり対策。
+// IP とユーザー名それぞれで連続失敗回数を数え、閾値を超えたら指数的に伸びるロックをかける。
+// 状態は DB に置くので、再起動してもロックは解けない。
+
+const (
+	loginScopeIP       = "ip"
+	loginScopeUsername = "username"
+)
+
+// login_attempts.result に入る値
+const (
+	loginResultSuccess = "success"
+	loginResultFailed  = "failed"
+	loginResultLocked  = "locked"
+	// パスワードは通ったが、2段階認証のコードが違った
+	loginResultMFAFailed = "mfa_failed"
+)
+
+const (
+	// この回数までは失敗してもロックしない。
+	// 1つの IP から複数のスタッフが入ることがあるので、IP は多めに許す。
+	loginFreeFailuresUsername = 5
+	loginFreeFailuresIP       = 20
+
+	loginLockBase = time.Minute // 閾値を超えた最初のロック。以降1回ごとに倍
+	loginLockMax  = time.Hour
+	// 最後の失敗からこれだけ空けば回数をリセットする
+	loginFailureWindow = 24 * time.Hour
+
+	loginAttemptsRetention = 90 * 24 * time.Hour
+)
+
+type loginLock struct {
+	Scope       string
+	Key         string
+	Failures    int
+	LockedUntil time.Time
+}
+
+func (l loginLock) locked(now time.Time) bool {
+	return l.LockedUntil.After(now)
+}
+
+func normalizeLoginUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// ロック判定に使う接続元 IP。
+// リバースプロキシの後ろで動かすときは ADMIN_TRUST_PROXY=true にして、
+// プロキシが付ける X-Forwarded-For の末尾を使う。
+func loginClientIP(r *http.Request) string {
+	if strings.EqualFold(os.Getenv("ADMIN_TRUST_PROXY"), "true") {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func loginFreeFailures(scope string) int {
+	if scope == loginScopeIP {
+		return loginFreeFailuresIP
+	}
+	return loginFreeFailuresUsername
+}
+
+// 連続失敗 failures 回目でかけるロックの長さ（かけないなら 0）
+func loginLockDuration(scope string, failures int) time.Duration {
+	over := failures - loginFreeFailures(scope)
+	if over <= 0 {
+		return 0
+	}
+	d := loginLockBase
+	for i := 1; i < over; i++ {
+		d *= 2
+		if d >= loginLockMax {
+			return loginLockMax
+		}
+	}
+	return d
+}
+
+func getLoginLock(scope, key string) (loginLock, error) {
+	l := loginLock{Scope: scope, Key: key}
+	var lockedUntil, lastFailureAt sql.NullString
+	err := db.QueryRow(
+		`SELECT failures,
+		        strftime('%Y-%m-%d %H:%M:%S', locked_until),
+		        strftime('%Y-%m-%d %H:%M:%S', last_failure_at)
+		   FROM login_lockouts
+		  WHERE scope = ? AND key = ?`,
+		scope, key,
+	).Scan(&l.Failures, &lockedUntil, &lastFailureAt)
+	if err == sql.ErrNoRows {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+
+	if lastFailureAt.Valid {
+		if at, err := parseJSTDateTime(lastFailureAt.String); err == nil && jstNow().Sub(at) > loginFailureWindow {
+			l.Failures = 0
+		}
+	}
+	if lockedUntil.Valid {
+		if at, err := parseJSTDateTime(lockedUntil.String); err == nil {
+			l.LockedUntil = at
+		}
+	}
+	return l, nil
+}
+
+// ログイン前の確認。IP かユーザー名のどちらかがロック中なら、長い方を返す。
+func checkLoginLock(ip, username string, now time.Time) (*loginLock, error) {
+	var found *loginLock
+	for _, k := range []struct{ scope, key string }{
+		{loginScopeIP, ip},
+		{loginScopeUsername, normalizeLoginUsername(username)},
+	} {
+		if k.key == "" {
+			continue
+		}
+		l, err := getLoginLock(k.scope, k.key)
+		if err != nil {
+			return nil, err
+		}
+		if l.locked(now) && (found == nil || l.LockedUntil.After(found.LockedUntil)) {
+			lock := l
+			found = &lock
+		}
+	}
+	return found, nil
+}
+
+// 失敗を1回数え、必要ならロックをかける。更新後の状態を返す。
+func registerLoginFailure(ip, username string, now time.Time) ([]loginLock, error) {
+	var result []loginLock
+	for _, k := range []struct{ scope, key string }{
+		{loginScopeIP, ip},
+		{loginScopeUsername, normalizeLoginUsername(username)},
+	} {
+		if k.key == "" {
+			continue
+		}
+		l, err := getLoginLock(k.scope, k.key)
+		if err != nil {
+			return nil, err
+		}
+		l.Failures++
+
+		var lockedUntil interface{}
+		if d := loginLockDuration(k.scope, l.Failures); d > 0 {
+			l.LockedUntil = now.Add(d)
+			lockedUntil = formatJSTDateTime(l.LockedUntil)
+		}
+
+		if _, err := db.Exec(
+			`INSERT INTO login_lockouts(scope, key, failures, locked_until, last_failure_at)
+             VALUES(?, ?, ?, ?, ?)
+             ON CONFLICT(scope, key)
+             DO UPDATE SET failures = excluded.failures,
+                           locked_until = excluded.locked_until,
+                           last_failure_at = excluded.last_failure_at`,
+			k.scope, k.key, l.Failures, lockedUntil, formatJSTDateTime(now),
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+// ログインに成功したら、その IP とユーザー名の失敗回数を消す
+func clearLoginFailures(ip, username string) error {
+	_, err := db.Exec(
+		`DELETE FROM login_lockouts
+          WHERE (scope = ? AND key = ?) OR (scope = ? AND key = ?)`,
+		loginScopeIP, ip, loginScopeUsername, normalizeLoginUsername(username),
+	)
+	return err
+}
+
+// オーナーが管理画面から解除する
+func clearLoginLock(scope, key string) error {
+	_, err := db.Exec(`DELETE FROM login_lockouts WHERE scope = ? AND key = ?`, scope, key)
+	return err
+}
+
+// 画面表示用の履歴なので、書けなくてもログインは止めない
+func recordLoginAttempt(r *http.Request, ip, username, result string) {
+	if _, err := db.Exec(
+		`INSERT INTO login_attempts(attempted_at, username, ip, user_agent, result)
+         VALUES(?, ?, ?, ?, ?)`,
+		formatJSTDateTime(jstNow()), normalizeLoginUsername(username), ip, r.UserAgent(), result,
+	); err != nil {
+		log.Println("record login attempt error:", err)
+	}
+}
+
+func deleteOldLoginAttempts(now time.Time) error {
+	_, err := db.Exec(
+		`DELETE FROM login_attempts WHERE attempted_at < ?`,
+		formatJSTDateTime(now.Add(-loginAttemptsRetention)),
+	)
+	return err
+}
+
+// ログイン試行画面の行
+type LoginAttemptRow struct {
+	AttemptedAt string
+	Username    string
+	IP          string
+	UserAgent   string
+	Result      string
+}
+
+type LoginLockRow struct {
+	Scope         string
+	Key           string
+	Failures      int
+	LockedUntil   string
+	LastFailureAt string
+	Locked        bool
+}
+
+const loginAttemptsPageLimit = 200
+
+func getRecentLoginFailures() ([]LoginAttemptRow, error) {
+	rows, err := db.Query(`
+SELECT strftime('%Y/%m/%d %H:%M:%S', attempted_at), username, ip, IFNULL(user_agent, ''), result
+FROM login_attempts
+WHERE result <> ?
+ORDER BY id DESC
+LIMIT ?
+`, loginResultSuccess, loginAttemptsPageLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []LoginAttemptRow
+	for rows.Next() {
+		var a LoginAttemptRow
+		if err := rows.Scan(&a.AttemptedAt, &a.Username, &a.IP, &a.UserAgent, &a.Result); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// 失敗が数えられている IP / ユーザー名（ロック中のものが先）
+func getLoginLocks(now time.Time) ([]LoginLockRow, error) {
+	nowStr := formatJSTDateTime(now)
+	rows, err := db.Query(`
+SELECT scope, key, failures,
+       IFNULL(strftime('%Y/%m/%d %H:%M:%S', locked_until), ''),
+       strftime('%Y/%m/%d %H:%M:%S', last_failure_at),
+       IFNULL(locked_until > ?, 0)
+FROM login_lockouts
+WHERE last_failure_at >= ?
+ORDER BY IFNULL(locked_until > ?, 0) DESC, last_failure_at DESC
+`, nowStr, formatJSTDateTime(now.Add(-loginFailureWindow)), nowStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []LoginLockRow
+	for rows.Next() {
+		var l LoginLockRow
+		if err := rows.Scan(&l.Scope, &l.Key, &l.Failures, &l.LockedUntil, &l.LastFailureAt, &l.Locked); err != nil {
+			return nil, err
+		}
+		list = append(list, l)
+	}
+	return list, rows.Err()
+}
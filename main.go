@@ -14,15 +14,60 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// サブコマンド指定時はサーバーを起動しない
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	initDB()
+	if err := bootstrapAdminFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadStoreSettings(); err != nil {
+		log.Fatal("設定の読み込み失敗:", err)
+	}
+	calendar, err := loadBusinessCalendarFromEnv()
+	if err != nil {
+		log.Fatal("営業時間ファイルの読み込み失敗:", err)
+	}
+	businessHours = calendar
+	if kioskQR, err = kioskQRConfigFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if geofence, err = geofenceConfigFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	// 復元の途中でも空きが出れば順番待ちの人を呼ぶので、通知先は先に決めておく
+	if waitlistNotice, err = newWaitlistNotifierFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadCheckinSessions(); err != nil {
+		log.Fatal("チェックイン状態の復元失敗:", err)
+	}
+	if err := loadWaitlist(); err != nil {
+		log.Fatal("順番待ちの復元失敗:", err)
+	}
+	startOccupancyEvents()
 	startVisitsCleanupJob()
+	backupCfg, err := backupConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	backups = newBackupManager(backupCfg)
+	backups.start()
+	startCheckinExpiryJob()
 	appLog.cleanupOldFiles(jstNow())
 
-	adminConfig, err := loadAdminAuthConfig()
+	verifier, err := newLineVerifierFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
-	adminAuth := newAdminAuth(adminConfig)
+	lineVerifier = verifier
+
+	adminAuth := newAdminAuth()
 
 	publicDir := filepath.Join(".", "public")
 	fs := http.FileServer(http.Dir(publicDir))
@@ -32,33 +77,86 @@ func main() {
 	handle := func(pattern string, fn http.HandlerFunc) {
 		http.Handle(pattern, withRequestID(http.HandlerFunc(fn)))
 	}
-	handleAdmin := func(pattern string, fn http.HandlerFunc) {
-		http.Handle(pattern, adminAuth.middleware(withRequestID(http.HandlerFunc(fn))))
+	handleAdmin := func(pattern string, perm adminPermission, fn http.HandlerFunc) {
+		http.Handle(pattern, adminAuth.middleware(withRequestID(requireCSRF(requireAdminPermission(perm, fn)))))
+	}
+	handleAPI := func(pattern string, scope apiScope, fn http.HandlerFunc) {
+		http.Handle(pattern, withRequestID(requireAPIToken(scope, fn)))
 	}
 
 	handle("/checkin", handleCheckin)
 	handle("/checkout", handleCheckout)
 
 	handle("/count-json", handleCountJSON)
+	handle("/count-stream", handleCountStream)
 	handle("/status", handleStatus)
 	handle("/client-log", handleClientLog)
 	handle("/member/monthly-visits", handleMemberMonthlyVisits)
 	handle("/admin/login", adminAuth.handleLogin)
-	handleAdmin("/admin/logout", adminAuth.handleLogout)
+	handle("/admin/login/2fa", adminAuth.handleLogin2FA)
+	handleAdmin("/admin/logout", permView, adminAuth.handleLogout)
 
 	// 管理画面
-	handleAdmin("/admin/visits", handleAdminVisits)
-	handleAdmin("/admin/visits/today", handleAdminVisitsToday)
-	handleAdmin("/admin/visits/calendar", handleAdminVisitsCalendar)
-	handleAdmin("/admin/visits/day", handleAdminVisitsDay)
-	handleAdmin("/admin/visits/user", handleAdminVisitDetail)
-	handleAdmin("/admin/member/type", handleAdminUpdateMemberType)
-	handleAdmin("/admin/member/poster-id", handleAdminUpdatePosterID)
-	handleAdmin("/admin/visits/pay", handleAdminVisitPay)
-	handleAdmin("/admin/visits/add", handleAdminVisitAdd)
-	handleAdmin("/admin/visits/delete", handleAdminVisitDelete)
-	handleAdmin("/admin/members", handleAdminMembers)
+	handleAdmin("/admin/visits", permView, handleAdminVisits)
+	handleAdmin("/admin/visits/today", permView, handleAdminVisitsToday)
+	handleAdmin("/admin/visits/calendar", permView, handleAdminVisitsCalendar)
+	handleAdmin("/admin/visits/day", permView, handleAdminVisitsDay)
+	handleAdmin("/admin/visits/user", permView, handleAdminVisitDetail)
+	handleAdmin("/admin/member/type", permEditMembers, handleAdminUpdateMemberType)
+	handleAdmin("/admin/member/poster-id", permEditMembers, handleAdminUpdatePosterID)
+	handleAdmin("/admin/member/kana", permEditMembers, handleAdminUpdateMemberKana)
+	handleAdmin("/admin/visits/pay", permMarkPayment, handleAdminVisitPay)
+	handleAdmin("/admin/payments/delete", permMarkPayment, handleAdminPaymentDelete)
+	handleAdmin("/admin/tickets", permView, handleAdminTickets)
+	handleAdmin("/admin/tickets/products", permManageSettings, handleAdminTicketProducts)
+	handleAdmin("/admin/tickets/packs", permMarkPayment, handleAdminTicketPacks)
+	handleAdmin("/admin/visits/add", permEditVisits, handleAdminVisitAdd)
+	handleAdmin("/admin/visits/delete", permDeleteVisits, handleAdminVisitDelete)
+	handleAdmin("/admin/visits/checkout", permEditVisits, handleAdminVisitCheckout)
+	handleAdmin("/admin/members", permView, handleAdminMembers)
+	handleAdmin("/admin/kiosk", permView, handleAdminKiosk)
+	handleAdmin("/admin/kiosk/token", permView, handleAdminKioskToken)
+	handleAdmin("/admin/location-flags", permView, handleAdminLocationFlags)
+	handleAdmin("/admin/members/import", permEditMembers, handleAdminMemberImport)
+	handleAdmin("/admin/members/create", permEditMembers, handleAdminMemberCreate)
+	handleAdmin("/admin/export/visits", permView, handleAdminExportVisits)
+	handleAdmin("/admin/export/members", permView, handleAdminExportMembers)
+	handleAdmin("/admin/export/billing", permView, handleAdminExportBilling)
+	handleAdmin("/admin/audit", permViewAudit, handleAdminAudit)
+	handleAdmin("/admin/settings", permManageSettings, handleAdminSettings)
+	handleAdmin("/admin/backups", permManageSettings, handleAdminBackups)
+	handleAdmin("/admin/plans", permManageSettings, handleAdminPlans)
+	handleAdmin("/admin/users", permManageAdmins, handleAdminUsers)
+	handleAdmin("/admin/sessions", permView, adminAuth.handleSessions)
+	handleAdmin("/admin/2fa", permView, handleAdmin2FA)
+	handleAdmin("/admin/login-attempts", permManageAdmins, handleAdminLoginAttempts)
+	handleAdmin("/admin/api-tokens", permManageAdmins, handleAdminAPITokens)
+	handleAdmin("/admin/kiosk-devices", permManageAdmins, handleAdminKioskDevices)
 	handle("/member/profile", handleMemberProfile)
+	handle("/plans", handlePlans)
+
+	// 管理 API（Bearer トークン）。仕様は public/api/v1/admin/openapi.yaml
+	handleAPI("GET /api/v1/admin/members", apiScopeRead, handleAPIMembers)
+	handleAPI("GET /api/v1/admin/members/{lineUserId}/visits", apiScopeRead, handleAPIMemberVisits)
+	handleAPI("GET /api/v1/admin/visits", apiScopeRead, handleAPIVisits)
+	handleAPI("GET /api/v1/admin/visits/today", apiScopeRead, handleAPIVisitsToday)
+	handleAPI("GET /api/v1/admin/visits/day", apiScopeRead, handleAPIVisitsDay)
+	handleAPI("GET /api/v1/admin/calendar", apiScopeRead, handleAPICalendar)
+	handleAPI("GET /api/v1/admin/payments", apiScopeBilling, handleAPIPayments)
+	handleAPI("POST /api/v1/admin/payments", apiScopeBilling, handleAPIPaymentCreate)
+	handleAPI("DELETE /api/v1/admin/payments/{id}", apiScopeBilling, handleAPIPaymentDelete)
+	handleAPI("POST /api/v1/admin/visits", apiScopeWrite, handleAPIVisitCreate)
+	handleAPI("POST /api/v1/admin/members/{lineUserId}/checkout", apiScopeWrite, handleAPIMemberCheckout)
+	handleAPI("PATCH /api/v1/admin/members/{lineUserId}", apiScopeWrite, handleAPIMemberUpdate)
+
+	// 受付のスタッフ端末（端末トークン）。画面は public/staff.html
+	handleStaff := func(pattern string, fn http.HandlerFunc) {
+		http.Handle(pattern, withRequestID(requireKioskDevice(fn)))
+	}
+	handleStaff("GET /staff/api/me", handleStaffMe)
+	handleStaff("GET /staff/api/members", handleStaffMembers)
+	handleStaff("POST /staff/api/checkin", handleStaffCheckin)
+	handleStaff("POST /staff/api/checkout", handleStaffCheckout)
 
 	// ポート設定
 	port := os.Getenv("PORT")
@@ -74,14 +172,14 @@ func main() {
 
 // POST用のリクエスト
 type memberProfileRequest struct {
-	UserID      string `json:"userId"`
+	UserID      string `json:"-"` // ID トークンの sub を入れる
 	LastName    string `json:"lastName"`
 	FirstName   string `json:"firstName"`
-	MemberType  string `json:"memberType"` // "general" or "1day"
+	MemberType  string `json:"memberType"` // plans.code（GET /plans で選べるもの）
 	DisplayName string `json:"displayName"`
 }
 
-// GET /member/profile?userId=xxx
+// GET /member/profile
 // POST /member/profile
 func handleMemberProfile(w http.ResponseWriter, r *http.Request) {
 	appLog.info("profile_request_received", eventFieldsFromRequest(r))
@@ -98,15 +196,11 @@ func handleMemberProfile(w http.ResponseWriter, r *http.Request) {
 // GET: プロファイル取得
 func handleMemberProfileGet(w http.ResponseWriter, r *http.Request) {
 	fields := eventFieldsFromRequest(r)
-	userID := r.URL.Query().Get("userId")
-	if userID == "" {
-		fields["status"] = http.StatusBadRequest
-		fields["error"] = "userId is required"
-		appLog.error("request_error", fields)
-		http.Error(w, "userId is required", http.StatusBadRequest)
+	identity, ok := requireLineUser(w, r, fields)
+	if !ok {
 		return
 	}
-	fields["line_user_id"] = userID
+	userID := identity.UserID
 
 	var (
 		fullName   string
@@ -114,7 +208,7 @@ func handleMemberProfileGet(w http.ResponseWriter, r *http.Request) {
 	)
 
 	err := db.QueryRow(
-		`SELECT IFNULL(full_name, ''), IFNULL(member_type, 'general')
+		`SELECT IFNULL(full_name, ''), IFNULL(member_type, `+defaultPlanCodeSQL+`)
            FROM members
           WHERE line_user_id = ?`,
 		userID,
@@ -153,6 +247,11 @@ func handleMemberProfileGet(w http.ResponseWriter, r *http.Request) {
 // POST: プロファイル登録/更新
 func handleMemberProfilePost(w http.ResponseWriter, r *http.Request) {
 	fields := eventFieldsFromRequest(r)
+	identity, ok := requireLineUser(w, r, fields)
+	if !ok {
+		return
+	}
+
 	var req memberProfileRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		fields["status"] = http.StatusBadRequest
@@ -161,7 +260,7 @@ func handleMemberProfilePost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	fields["line_user_id"] = req.UserID
+	req.UserID = identity.UserID
 	fields["display_name"] = req.DisplayName
 	fields["member_type"] = req.MemberType
 	appLog.info("profile_register_attempt", fields)
@@ -173,7 +272,15 @@ func handleMemberProfilePost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	if req.MemberType != "general" && req.MemberType != "1day" {
+	selectedPlan, err := getPlan(req.MemberType)
+	if err != nil && err != errPlanNotFound {
+		fields["operation"] = "select_plan"
+		fields["error"] = err.Error()
+		appLog.error("db_error", fields)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err == errPlanNotFound || !selectedPlan.Selectable {
 		fields["status"] = http.StatusBadRequest
 		fields["error"] = "bad memberType"
 		appLog.error("request_error", fields)
@@ -0,0 +1,439 @@
+// member_import.go
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// 紙・Excel の名簿からの会員の一括登録。
+// CSV を読んで差分（追加・更新・変更なし・エラー）を出し、エラーが無ければ1つのトランザクションで反映する。
+// 画面（/admin/members/import）と CLI（checkin-app members import）の両方から使う。
+
+// CSV の内容の誤り。画面ではそのまま表示する。
+type memberImportError string
+
+func (e memberImportError) Error() string { return string(e) }
+
+// 一括登録で扱う列。見出しは英語のキーか、会員一覧のエクスポートと同じ日本語のどちらでもよい。
+var memberImportColumns = []struct {
+	key     string
+	aliases []string
+}{
+	{"line_user_id", []string{"LINE ID", "LINEユーザーID"}},
+	{"full_name", []string{"氏名"}},
+	{"member_type", []string{"会員種別コード"}},
+	{"poster_id", []string{"PosterID"}},
+}
+
+// LINE のユーザーID（U + 16進32桁）
+var lineUserIDPattern = regexp.MustCompile(`^U[0-9a-f]{32}$`)
+
+const memberImportMaxRows = 5000
+
+// CSV の1行。空のセルは「変えない」
+type memberImportRow struct {
+	Line       int // CSV の行番号（見出しが1行目）
+	LineUserID string
+	FullName   string
+	MemberType string
+	PosterID   string
+}
+
+type memberImportOptions struct {
+	// members にも visits にも無い LINE ID を新しい会員として追加する
+	AllowUnknown bool
+}
+
+// 差分の1行にまとめる操作
+const (
+	memberImportInsert    = "insert"
+	memberImportUpdate    = "update"
+	memberImportUnchanged = "unchanged"
+	memberImportConflict  = "conflict"
+)
+
+type memberImportChange struct {
+	Label  string
+	Before string
+	After  string
+}
+
+// 1会員分の差分
+type memberImportItem struct {
+	Line       int
+	LineUserID string
+	Name       string // 表示用（氏名、無ければ LINE の表示名）
+	Action     string
+	Changes    []memberImportChange
+	Errors     []string
+
+	before memberImportValues
+	after  memberImportValues
+}
+
+func (it memberImportItem) ActionLabel() string {
+	switch it.Action {
+	case memberImportInsert:
+		return "追加"
+	case memberImportUpdate:
+		return "更新"
+	case memberImportUnchanged:
+		return "変更なし"
+	default:
+		return "エラー"
+	}
+}
+
+type memberImportValues struct {
+	FullName   string `json:"full_name"`
+	MemberType string `json:"member_type"`
+	PosterID   string `json:"poster_id"`
+}
+
+type memberImportPlan struct {
+	Items     []memberImportItem
+	Inserts   int
+	Updates   int
+	Unchanged int
+	Conflicts int
+}
+
+// エラーが無く、反映するものがある
+func (p *memberImportPlan) CanApply() bool {
+	return p.Conflicts == 0 && p.Inserts+p.Updates > 0
+}
+
+// 見出し付きの CSV を読む。Excel の BOM 付き UTF-8 も受け付ける。
+func parseMemberImportCSV(r io.Reader) ([]memberImportRow, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	if !utf8.Valid(data) {
+		return nil, memberImportError("CSV は UTF-8 で保存してください（Excel では「CSV UTF-8」を選びます）")
+	}
+
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, memberImportError("CSV が空です")
+	}
+	if err != nil {
+		return nil, memberImportError("CSV を読めませんでした: " + err.Error())
+	}
+
+	index := map[string]int{}
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		for _, c := range memberImportColumns {
+			if strings.EqualFold(h, c.key) || containsString(c.aliases, h) {
+				index[c.key] = i
+			}
+		}
+	}
+	if _, ok := index["line_user_id"]; !ok {
+		return nil, memberImportError("見出しに line_user_id（または LINE ID）の列がありません")
+	}
+
+	cell := func(record []string, key string) string {
+		i, ok := index[key]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []memberImportRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := cr.FieldPos(0)
+		if err != nil {
+			return nil, memberImportError(fmt.Sprintf("%d行目を読めませんでした: %v", line, err))
+		}
+		row := memberImportRow{
+			Line:       line,
+			LineUserID: cell(record, "line_user_id"),
+			FullName:   cell(record, "full_name"),
+			MemberType: cell(record, "member_type"),
+			PosterID:   cell(record, "poster_id"),
+		}
+		// 空行は飛ばす
+		if row == (memberImportRow{Line: line}) {
+			continue
+		}
+		rows = append(rows, row)
+		if len(rows) > memberImportMaxRows {
+			return nil, memberImportError(fmt.Sprintf("一度に取り込めるのは%d行までです", memberImportMaxRows))
+		}
+	}
+	if len(rows) == 0 {
+		return nil, memberImportError("取り込む行がありません")
+	}
+	return rows, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// *sql.DB と *sql.Tx のどちらでも読めるように
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type importMember struct {
+	DisplayName string
+	memberImportValues
+}
+
+// 今の members と照らし合わせて差分を作る。DB は変えない。
+func planMemberImport(q sqlQueryer, rows []memberImportRow, opts memberImportOptions) (*memberImportPlan, error) {
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[string]importMember{}
+	mrows, err := q.Query(`
+SELECT line_user_id, IFNULL(display_name, ''), IFNULL(full_name, ''),
+       IFNULL(member_type, ` + defaultPlanCodeSQL + `), IFNULL(poster_id, '')
+  FROM members`)
+	if err != nil {
+		return nil, err
+	}
+	defer mrows.Close()
+	for mrows.Next() {
+		var (
+			id string
+			m  importMember
+		)
+		if err := mrows.Scan(&id, &m.DisplayName, &m.FullName, &m.MemberType, &m.PosterID); err != nil {
+			return nil, err
+		}
+		members[id] = m
+	}
+	if err := mrows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 来店はあるが members に無い LINE ID も「既知」として扱う
+	visited := map[string]bool{}
+	vrows, err := q.Query(`SELECT DISTINCT line_user_id FROM visits WHERE line_user_id NOT IN (SELECT line_user_id FROM members)`)
+	if err != nil {
+		return nil, err
+	}
+	defer vrows.Close()
+	for vrows.Next() {
+		var id string
+		if err := vrows.Scan(&id); err != nil {
+			return nil, err
+		}
+		visited[id] = true
+	}
+	if err := vrows.Err(); err != nil {
+		return nil, err
+	}
+
+	plan := &memberImportPlan{}
+	seen := map[string]int{} // LINE ID → 最初に出てきた行
+
+	for _, row := range rows {
+		it := memberImportItem{Line: row.Line, LineUserID: row.LineUserID}
+		current, exists := members[row.LineUserID]
+
+		switch {
+		case row.LineUserID == "":
+			it.Errors = append(it.Errors, "LINE ID がありません")
+		case !lineUserIDPattern.MatchString(row.LineUserID) && !isLocalMemberID(row.LineUserID):
+			it.Errors = append(it.Errors, "LINE ID の形式が違います（U + 英数字32桁）")
+		case isLocalMemberID(row.LineUserID) && !exists:
+			// LINE なしの会員の内部 ID は管理画面で登録した会員の更新にだけ使える（新しく作るのは管理画面から）
+			it.Errors = append(it.Errors, "登録されていない LINE なしの会員の ID です")
+		case seen[row.LineUserID] > 0:
+			it.Errors = append(it.Errors, fmt.Sprintf("%d行目と同じ LINE ID です", seen[row.LineUserID]))
+		case !exists && !visited[row.LineUserID] && !opts.AllowUnknown:
+			it.Errors = append(it.Errors, "来店も会員登録も無い LINE ID です")
+		}
+		if row.LineUserID != "" && seen[row.LineUserID] == 0 {
+			seen[row.LineUserID] = row.Line
+		}
+
+		if exists {
+			it.before = current.memberImportValues
+			it.after = current.memberImportValues
+		} else {
+			it.after.MemberType = defaultPlanCode
+			if row.FullName == "" {
+				it.Errors = append(it.Errors, "新しい会員には氏名が必要です")
+			}
+		}
+		if row.FullName != "" {
+			it.after.FullName = row.FullName
+		}
+		if row.MemberType != "" {
+			if !plans.has(row.MemberType) {
+				it.Errors = append(it.Errors, "プラン「"+row.MemberType+"」はありません")
+			}
+			it.after.MemberType = row.MemberType
+		}
+		if row.PosterID != "" {
+			it.after.PosterID = row.PosterID
+		}
+
+		it.Name = it.after.FullName
+		if it.Name == "" {
+			it.Name = current.DisplayName
+		}
+
+		addChange := func(label, before, after string) {
+			if before != after {
+				it.Changes = append(it.Changes, memberImportChange{Label: label, Before: before, After: after})
+			}
+		}
+		addChange("氏名", it.before.FullName, it.after.FullName)
+		planName := func(code string) string {
+			if code == "" {
+				return ""
+			}
+			return plans.lookup(code).Name
+		}
+		addChange("会員種別", planName(it.before.MemberType), planName(it.after.MemberType))
+		addChange("PosterID", it.before.PosterID, it.after.PosterID)
+
+		switch {
+		case !exists:
+			it.Action = memberImportInsert
+		case len(it.Changes) > 0:
+			it.Action = memberImportUpdate
+		default:
+			it.Action = memberImportUnchanged
+		}
+		plan.Items = append(plan.Items, it)
+	}
+
+	// PosterID の重複は、取り込んだ後の状態で確かめる（入れ替えも許す）
+	finalPoster := map[string]string{}
+	for id, m := range members {
+		finalPoster[id] = m.PosterID
+	}
+	for _, it := range plan.Items {
+		if it.LineUserID != "" && seen[it.LineUserID] == it.Line {
+			finalPoster[it.LineUserID] = it.after.PosterID
+		}
+	}
+	holders := map[string][]string{}
+	for id, posterID := range finalPoster {
+		if posterID != "" {
+			holders[posterID] = append(holders[posterID], id)
+		}
+	}
+	for i := range plan.Items {
+		it := &plan.Items[i]
+		if it.after.PosterID == "" || it.after.PosterID == it.before.PosterID {
+			continue
+		}
+		for _, other := range holders[it.after.PosterID] {
+			if other != it.LineUserID {
+				name := other
+				if m, ok := members[other]; ok && (m.FullName != "" || m.DisplayName != "") {
+					name = m.FullName
+					if name == "" {
+						name = m.DisplayName
+					}
+				}
+				it.Errors = append(it.Errors, "PosterID「"+it.after.PosterID+"」は "+name+" さんと重複しています")
+				break
+			}
+		}
+	}
+
+	for i := range plan.Items {
+		it := &plan.Items[i]
+		if len(it.Errors) > 0 {
+			it.Action = memberImportConflict
+		}
+		switch it.Action {
+		case memberImportInsert:
+			plan.Inserts++
+		case memberImportUpdate:
+			plan.Updates++
+		case memberImportUnchanged:
+			plan.Unchanged++
+		default:
+			plan.Conflicts++
+		}
+	}
+	return plan, nil
+}
+
+var errMemberImportConflicts = errors.New("member import has conflicts")
+
+// トランザクションの中で差分を作り直して反映する。エラーの行が1つでもあれば何も変えない。
+func applyMemberImport(tx *sql.Tx, rows []memberImportRow, opts memberImportOptions, actor auditActor) (*memberImportPlan, error) {
+	plan, err := planMemberImport(tx, rows, opts)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Conflicts > 0 {
+		return plan, errMemberImportConflicts
+	}
+
+	now := formatJSTDateTime(jstNow())
+	for _, it := range plan.Items {
+		switch it.Action {
+		case memberImportInsert:
+			if _, err := tx.Exec(
+				`INSERT INTO members(line_user_id, full_name, member_type, poster_id, created_at)
+                 VALUES(?, ?, ?, NULLIF(?, ''), ?)`,
+				it.LineUserID, it.after.FullName, it.after.MemberType, it.after.PosterID, now,
+			); err != nil {
+				return nil, err
+			}
+			if err := writeAuditLogAs(tx, actor, auditEntry{
+				Action:     auditActionMemberImport,
+				LineUserID: it.LineUserID,
+				After:      it.after,
+			}); err != nil {
+				return nil, err
+			}
+
+		case memberImportUpdate:
+			if _, err := tx.Exec(
+				`UPDATE members SET full_name = ?, member_type = ?, poster_id = NULLIF(?, '') WHERE line_user_id = ?`,
+				it.after.FullName, it.after.MemberType, it.after.PosterID, it.LineUserID,
+			); err != nil {
+				return nil, err
+			}
+			if err := writeAuditLogAs(tx, actor, auditEntry{
+				Action:     auditActionMemberImport,
+				LineUserID: it.LineUserID,
+				Before:     it.before,
+				After:      it.after,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,582 @@
+// migrations.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// スキーマ変更は必ずここに追記する（番号は連番、既存のものは書き換えない）
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create_members_and_visits",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS members (
+  line_user_id  TEXT PRIMARY KEY,          -- LINEのユーザーID
+  display_name  TEXT,                      -- LINEの表示名（ニックネーム）
+  poster_id     TEXT,                      -- 将来使う用
+  member_type   TEXT NOT NULL DEFAULT 'general', -- 'general' or '1day'
+  created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS visits (
+  id           INTEGER PRIMARY KEY AUTOINCREMENT,
+  line_user_id TEXT NOT NULL,
+  visited_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`),
+	},
+	{
+		// 旧 initDB で作られたDBには無く、手動で足されている環境もある
+		version: 2,
+		name:    "add_members_full_name",
+		up:      addColumnIfMissing("members", "full_name", "TEXT"),
+	},
+	{
+		version: 3,
+		name:    "add_visits_paid",
+		up:      addColumnIfMissing("visits", "paid", "INTEGER NOT NULL DEFAULT 0"),
+	},
+	{
+		version: 4,
+		name:    "create_checkin_sessions",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS checkin_sessions (
+  id              INTEGER PRIMARY KEY AUTOINCREMENT,
+  line_user_id    TEXT NOT NULL,
+  checked_in_at   DATETIME NOT NULL,
+  checked_out_at  DATETIME,                -- NULL の間は在館中
+  checkout_reason TEXT                     -- 'checkout' / 'expired' / 'recheckin'
+);
+
+CREATE INDEX IF NOT EXISTS idx_checkin_sessions_open
+  ON checkin_sessions(line_user_id, checked_out_at);
+`),
+	},
+	{
+		version: 5,
+		name:    "add_visit_checkout_columns",
+		up: func(tx *sql.Tx) error {
+			for _, col := range []struct{ table, name, def string }{
+				{"visits", "checked_out_at", "DATETIME"},
+				{"visits", "checkout_reason", "TEXT"},
+				{"visits", "duration_seconds", "INTEGER"},
+				{"checkin_sessions", "visit_id", "INTEGER"},
+			} {
+				if err := addColumnIfMissing(col.table, col.name, col.def)(tx); err != nil {
+					return err
+				}
+			}
+			// 'checkout' は手動チェックアウトの旧名
+			_, err := tx.Exec(`UPDATE checkin_sessions SET checkout_reason = 'manual' WHERE checkout_reason = 'checkout'`)
+			return err
+		},
+	},
+	{
+		version: 6,
+		name:    "create_settings",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS settings (
+  key        TEXT PRIMARY KEY,
+  value      TEXT NOT NULL,
+  updated_at DATETIME NOT NULL
+);
+`),
+	},
+	{
+		version: 7,
+		name:    "create_admin_users",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS admin_users (
+  id            INTEGER PRIMARY KEY AUTOINCREMENT,
+  username      TEXT NOT NULL UNIQUE,
+  password_hash TEXT NOT NULL,             -- bcrypt
+  role          TEXT NOT NULL,             -- 'owner' / 'staff' / 'viewer'
+  created_at    DATETIME NOT NULL,
+  disabled_at   DATETIME                   -- NULL 以外は無効化済み
+);
+`),
+	},
+	{
+		version: 8,
+		name:    "create_audit_log",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS audit_log (
+  id             INTEGER PRIMARY KEY AUTOINCREMENT,
+  created_at     DATETIME NOT NULL,
+  admin_user_id  INTEGER,
+  admin_username TEXT,                     -- アカウント名が変わっても当時の名前が分かるように
+  admin_session  TEXT,                     -- セッショントークンのハッシュ（先頭）
+  request_id     TEXT,
+  remote_ip      TEXT,
+  action         TEXT NOT NULL,            -- 'visit.pay' など
+  line_user_id   TEXT,
+  visit_id       INTEGER,
+  before_value   TEXT,                     -- JSON
+  after_value    TEXT                      -- JSON
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_member
+  ON audit_log(line_user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at
+  ON audit_log(created_at);
+`),
+	},
+	{
+		version: 9,
+		name:    "create_admin_sessions",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS admin_sessions (
+  id            INTEGER PRIMARY KEY AUTOINCREMENT,
+  token_hash    TEXT NOT NULL UNIQUE,      -- Cookie のトークンの SHA-256
+  admin_user_id INTEGER NOT NULL,
+  created_at    DATETIME NOT NULL,
+  last_seen_at  DATETIME NOT NULL,
+  expires_at    DATETIME NOT NULL,
+  ip            TEXT,
+  user_agent    TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_sessions_user
+  ON admin_sessions(admin_user_id, expires_at);
+`),
+	},
+	{
+		// 既存のセッションは次のアクセス時に発行する
+		version: 10,
+		name:    "add_admin_sessions_csrf_token",
+		up:      addColumnIfMissing("admin_sessions", "csrf_token", "TEXT"),
+	},
+	{
+		version: 11,
+		name:    "create_login_throttle",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS login_attempts (
+  id           INTEGER PRIMARY KEY AUTOINCREMENT,
+  attempted_at DATETIME NOT NULL,
+  username     TEXT NOT NULL,             -- 小文字に揃えたもの
+  ip           TEXT NOT NULL,
+  user_agent   TEXT,
+  result       TEXT NOT NULL              -- 'success' / 'failed' / 'locked'
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_attempted_at
+  ON login_attempts(attempted_at);
+
+CREATE TABLE IF NOT EXISTS login_lockouts (
+  scope           TEXT NOT NULL,          -- 'ip' / 'username'
+  key             TEXT NOT NULL,
+  failures        INTEGER NOT NULL,       -- 連続失敗回数
+  locked_until    DATETIME,
+  last_failure_at DATETIME NOT NULL,
+  PRIMARY KEY (scope, key)
+);
+`),
+	},
+	{
+		version: 12,
+		name:    "add_admin_totp",
+		up: func(tx *sql.Tx) error {
+			for _, col := range []struct{ table, name, def string }{
+				{"admin_users", "totp_secret", "TEXT"},
+				{"admin_users", "totp_enabled_at", "DATETIME"}, // NULL の間は未設定（または登録中）
+				{"admin_users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+				{"admin_sessions", "mfa_pending", "INTEGER NOT NULL DEFAULT 0"}, // パスワードは通ったが2段階目がまだ
+			} {
+				if err := addColumnIfMissing(col.table, col.name, col.def)(tx); err != nil {
+					return err
+				}
+			}
+			return execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS admin_recovery_codes (
+  id            INTEGER PRIMARY KEY AUTOINCREMENT,
+  admin_user_id INTEGER NOT NULL,
+  code_hash     TEXT NOT NULL,            -- SHA-256（平文は発行時に1度だけ表示）
+  created_at    DATETIME NOT NULL,
+  used_at       DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_recovery_codes_user
+  ON admin_recovery_codes(admin_user_id);
+`)(tx)
+		},
+	},
+	{
+		// これまでコードに直書きしていた2つのプランを初期データにする。
+		// ライトプランは「今月5回目以降は都度払い」だったので、込み回数は4回。
+		version: 13,
+		name:    "create_plans",
+		up: func(tx *sql.Tx) error {
+			if err := execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS plans (
+  code              TEXT PRIMARY KEY,           -- members.member_type に入る値
+  name              TEXT NOT NULL,
+  monthly_fee       INTEGER NOT NULL DEFAULT 0, -- 円
+  included_visits   INTEGER,                    -- 月の込み回数。NULL は無制限
+  extra_visit_price INTEGER NOT NULL DEFAULT 0, -- 込み回数を超えた1回あたり（円）
+  notice_message    TEXT NOT NULL DEFAULT '',   -- 込み回数を超えたチェックインで出す案内
+  sort_order        INTEGER NOT NULL DEFAULT 0,
+  selectable        INTEGER NOT NULL DEFAULT 1, -- LIFF の登録画面で選べる
+  created_at        DATETIME NOT NULL,
+  updated_at        DATETIME NOT NULL
+);
+`)(tx); err != nil {
+				return err
+			}
+			now := formatJSTDateTime(jstNow())
+			_, err := tx.Exec(
+				`INSERT OR IGNORE INTO plans(code, name, included_visits, notice_message, sort_order, created_at, updated_at)
+                 VALUES('general', 'フリープラン', NULL, '', 10, ?, ?),
+                       ('1day', 'ライトプラン', 4, ?, 20, ?, ?)`,
+				now, now,
+				"【ライトプラン】今月5回目以降のご来店です。\nスタッフにお声がけください。", now, now,
+			)
+			return err
+		},
+	},
+	{
+		version: 14,
+		name:    "create_payments",
+		up: func(tx *sql.Tx) error {
+			if err := execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS payments (
+  id                   INTEGER PRIMARY KEY AUTOINCREMENT,
+  line_user_id         TEXT NOT NULL,
+  visit_id             INTEGER,          -- 追加来店1回分の支払いなら visits.id。月額などは NULL
+  month                TEXT NOT NULL,    -- 計上する月（YYYY-MM）
+  amount               INTEGER NOT NULL, -- 円
+  method               TEXT NOT NULL,    -- cash / card / qr
+  received_by_admin_id INTEGER,          -- 受け付けた管理者。移行分は NULL
+  received_at          DATETIME NOT NULL,
+  note                 TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_payments_member_month ON payments(line_user_id, month);
+CREATE INDEX IF NOT EXISTS idx_payments_visit ON payments(visit_id);
+`)(tx); err != nil {
+				return err
+			}
+			// これまでの支払いチェックは金額が分からないので 0 円として台帳に移す
+			_, err := tx.Exec(`
+INSERT INTO payments(line_user_id, visit_id, month, amount, method, received_at, note)
+SELECT line_user_id, id, strftime('%Y-%m', visited_at), 0, 'cash', visited_at, '移行前の支払いチェック'
+  FROM visits
+ WHERE paid = 1
+   AND id NOT IN (SELECT visit_id FROM payments WHERE visit_id IS NOT NULL)
+`)
+			return err
+		},
+	},
+	{
+		version: 15,
+		name:    "create_ticket_packs",
+		up: func(tx *sql.Tx) error {
+			if err := execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS ticket_products (
+  id         INTEGER PRIMARY KEY AUTOINCREMENT,
+  name       TEXT NOT NULL,
+  visits     INTEGER NOT NULL,           -- 1冊の回数
+  price      INTEGER NOT NULL DEFAULT 0, -- 円
+  valid_days INTEGER NOT NULL DEFAULT 0, -- 購入日からの有効日数。0 は無期限
+  active     INTEGER NOT NULL DEFAULT 1, -- 販売中
+  sort_order INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS ticket_packs (
+  id               INTEGER PRIMARY KEY AUTOINCREMENT,
+  line_user_id     TEXT NOT NULL,
+  product_id       INTEGER,          -- 販売時の商品。名前・回数・金額は下にコピーしておく
+  name             TEXT NOT NULL,
+  total            INTEGER NOT NULL,
+  remaining        INTEGER NOT NULL,
+  price            INTEGER NOT NULL, -- 円
+  method           TEXT NOT NULL,    -- cash / card / qr
+  sold_by_admin_id INTEGER,
+  purchased_at     DATETIME NOT NULL,
+  expires_on       TEXT,             -- この日まで使える（YYYY-MM-DD）。NULL は無期限
+  refunded_at      DATETIME,
+  refund_amount    INTEGER,
+  note             TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_ticket_packs_member ON ticket_packs(line_user_id);
+`)(tx); err != nil {
+				return err
+			}
+			return addColumnIfMissing("visits", "ticket_pack_id", "INTEGER")(tx)
+		},
+	},
+	{
+		version: 16,
+		name:    "create_api_tokens",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS api_tokens (
+  id            INTEGER PRIMARY KEY AUTOINCREMENT,
+  name          TEXT NOT NULL,
+  token_hash    TEXT NOT NULL UNIQUE, -- トークンそのものは保存しない（SHA-256）
+  token_prefix  TEXT NOT NULL,        -- 一覧で見分けるための先頭部分
+  scopes        TEXT NOT NULL,        -- read,billing,write をカンマ区切り
+  admin_user_id INTEGER NOT NULL,     -- 発行した管理者。API はこの管理者として動く
+  created_at    DATETIME NOT NULL,
+  expires_at    DATETIME,             -- NULL は無期限
+  last_used_at  DATETIME,
+  revoked_at    DATETIME
+);
+`),
+	},
+	{
+		version: 17,
+		name:    "create_visit_monthly_rollups",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS visit_monthly_rollups (
+  line_user_id  TEXT NOT NULL,
+  month         TEXT NOT NULL,              -- YYYY-MM
+  member_type   TEXT NOT NULL,              -- 移した時点のプラン
+  visit_count   INTEGER NOT NULL,
+  paid_count    INTEGER NOT NULL DEFAULT 0, -- 支払い済みの来店
+  ticket_count  INTEGER NOT NULL DEFAULT 0, -- 回数券で払った来店
+  stay_count    INTEGER NOT NULL DEFAULT 0, -- 滞在時間が分かる来店
+  stay_seconds  INTEGER NOT NULL DEFAULT 0, -- その合計
+  billed_amount INTEGER NOT NULL DEFAULT 0, -- 移した時点の請求額（円）
+  paid_amount   INTEGER NOT NULL DEFAULT 0, -- 移した時点の入金額（円）。入金そのものは payments に残る
+  archived_at   DATETIME NOT NULL,
+  PRIMARY KEY (line_user_id, month)
+);
+CREATE INDEX IF NOT EXISTS idx_visit_monthly_rollups_month ON visit_monthly_rollups(month);
+`),
+	},
+	{
+		version: 18,
+		name:    "create_waitlist_entries",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+  id           INTEGER PRIMARY KEY AUTOINCREMENT,
+  line_user_id TEXT NOT NULL,
+  display_name TEXT NOT NULL DEFAULT '',
+  status       TEXT NOT NULL,  -- waiting / notified / admitted / expired
+  joined_at    DATETIME NOT NULL,
+  notified_at  DATETIME,       -- 空きが出て呼んだ時刻
+  closed_at    DATETIME        -- 順番待ちから外れた時刻
+);
+CREATE INDEX IF NOT EXISTS idx_waitlist_entries_status ON waitlist_entries(status);
+`),
+	},
+	{
+		version: 19,
+		name:    "create_checkin_location_flags",
+		up: execMigrationSQL(`
+CREATE TABLE IF NOT EXISTS checkin_location_flags (
+  id           INTEGER PRIMARY KEY AUTOINCREMENT,
+  line_user_id TEXT NOT NULL,
+  display_name TEXT NOT NULL DEFAULT '',
+  visit_id     INTEGER,        -- 断った場合は NULL
+  checked_at   DATETIME NOT NULL,
+  result       TEXT NOT NULL,  -- flagged（要確認で受付）/ refused（断った）
+  reason       TEXT NOT NULL,  -- no_location / too_far / poor_accuracy / invalid_location
+  latitude     REAL,
+  longitude    REAL,
+  accuracy_m   REAL,
+  distance_m   REAL
+);
+CREATE INDEX IF NOT EXISTS idx_checkin_location_flags_checked_at ON checkin_location_flags(checked_at);
+`),
+	},
+	{
+		// LINE を使わない会員（line_user_id に内部 ID を入れる）とスタッフ端末
+		version: 20,
+		name:    "add_staff_kiosk",
+		up: func(tx *sql.Tx) error {
+			for _, col := range []struct{ table, name, def string }{
+				{"members", "full_name_kana", "TEXT"},
+				{"members", "line_linked", "INTEGER NOT NULL DEFAULT 1"}, // 0 なら内部 ID の会員
+				{"visits", "source", "TEXT"},                             // liff / staff / admin / api（以前の来店は NULL）
+			} {
+				if err := addColumnIfMissing(col.table, col.name, col.def)(tx); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS kiosk_devices (
+  id            INTEGER PRIMARY KEY AUTOINCREMENT,
+  name          TEXT NOT NULL,
+  token_hash    TEXT NOT NULL UNIQUE,
+  token_prefix  TEXT NOT NULL,
+  admin_user_id INTEGER NOT NULL,  -- 登録した管理者
+  created_at    DATETIME NOT NULL,
+  last_used_at  DATETIME,
+  revoked_at    DATETIME
+);
+`)
+			return err
+		},
+	},
+}
+
+type migrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt string
+}
+
+func execMigrationSQL(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// SQLite の ADD COLUMN は IF NOT EXISTS が使えないので、事前に列の有無を確認する
+func addColumnIfMissing(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		exists, err := columnExists(tx, table, column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
+
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(name, column) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func ensureSchemaMigrationsTable() error {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version    INTEGER PRIMARY KEY,
+  name       TEXT NOT NULL,
+  applied_at DATETIME NOT NULL
+);
+`)
+	return err
+}
+
+// 各マイグレーションの適用状況を返す
+func getMigrationStatuses() ([]migrationStatus, error) {
+	if err := ensureSchemaMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+SELECT version, strftime('%Y-%m-%d %H:%M:%S', applied_at)
+FROM schema_migrations
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appliedAt := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var at string
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		at, ok := appliedAt[m.version]
+		statuses = append(statuses, migrationStatus{
+			Version:   m.version,
+			Name:      m.name,
+			Applied:   ok,
+			AppliedAt: at,
+		})
+	}
+	return statuses, nil
+}
+
+// 未適用のマイグレーションを番号順に適用し、適用した件数を返す。
+// 1件ごとにトランザクションを張り、失敗したらそこで止める。
+func runMigrations() (int, error) {
+	statuses, err := getMigrationStatuses()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for i, status := range statuses {
+		if status.Applied {
+			continue
+		}
+		if err := applyMigration(migrations[i]); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", status.Version, status.Name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+func applyMigration(m migration) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err = m.up(tx); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(
+		`INSERT INTO schema_migrations(version, name, applied_at)
+         VALUES(?, ?, ?)`,
+		m.version, m.name, formatJSTDateTime(jstNow()),
+	); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	appLog.info("schema_migration_applied", eventFields{
+		"version": m.version,
+		"name":    m.name,
+	})
+	return nil
+}
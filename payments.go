@@ -0,0 +1,237 @@
+// payments.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// payments.method に入る値
+const (
+	paymentMethodCash = "cash"
+	paymentMethodCard = "card"
+	paymentMethodQR   = "qr"
+)
+
+type paymentMethodOption struct {
+	Value string
+	Label string
+}
+
+var paymentMethodOptions = []paymentMethodOption{
+	{paymentMethodCash, paymentMethodLabel(paymentMethodCash)},
+	{paymentMethodCard, paymentMethodLabel(paymentMethodCard)},
+	{paymentMethodQR, paymentMethodLabel(paymentMethodQR)},
+}
+
+func paymentMethodLabel(method string) string {
+	switch method {
+	case paymentMethodCash:
+		return "現金"
+	case paymentMethodCard:
+		return "カード"
+	case paymentMethodQR:
+		return "QR決済"
+	default:
+		return method
+	}
+}
+
+func isValidPaymentMethod(method string) bool {
+	for _, o := range paymentMethodOptions {
+		if o.Value == method {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errVisitAlreadyPaid = errors.New("visit already paid")
+	errPaymentNotFound  = errors.New("payment not found")
+	errMemberNotFound   = errors.New("member not found")
+)
+
+// 入金1件
+type payment struct {
+	ID         int64
+	LineUserID string
+	VisitID    int64 // 0 なら来店に紐づかない入金（月額など）
+	Month      string
+	Amount     int
+	Method     string
+	ReceivedBy string // 受け付けた管理者のユーザー名。移行分は空
+	ReceivedAt string // 画面用 "2006/01/02 15:04"
+	Note       string
+}
+
+func (p payment) MethodLabel() string {
+	return paymentMethodLabel(p.Method)
+}
+
+// 会員1人・1か月分の明細
+type memberStatement struct {
+	Plan           plan
+	VisitCount     int
+	BillableVisits int // 込み回数を超えた来店の数
+	TicketVisits   int // そのうち回数券で払った数
+	MonthlyFee     int
+	ExtraCharges   int // (BillableVisits - TicketVisits) × 追加1回の料金
+	Expected       int // 請求額（月額 + 追加分）
+	Received       int // 入金の合計
+	Balance        int // 未収（マイナスなら受け取りすぎ）
+	Payments       []payment
+}
+
+// 請求が発生していて、それを払い終えていない
+func (s memberStatement) Outstanding() bool {
+	return s.Expected > 0 && s.Balance > 0
+}
+
+// 請求が発生していて、払い終えている
+func (s memberStatement) Settled() bool {
+	return s.Expected > 0 && s.Balance <= 0
+}
+
+func newMemberStatement(p plan, visitCount, ticketVisits, received int) memberStatement {
+	s := memberStatement{
+		Plan:       p,
+		VisitCount: visitCount,
+		MonthlyFee: p.MonthlyFee,
+		Received:   received,
+	}
+	if p.Metered && visitCount > p.IncludedVisits {
+		s.BillableVisits = visitCount - p.IncludedVisits
+	}
+	// 後からプランを変えた場合などに、回数券の分が追加分を超えないようにする
+	s.TicketVisits = min(ticketVisits, s.BillableVisits)
+	s.ExtraCharges = (s.BillableVisits - s.TicketVisits) * p.ExtraVisitPrice
+	s.Expected = s.MonthlyFee + s.ExtraCharges
+	s.Balance = s.Expected - s.Received
+	return s
+}
+
+// 会員ごとの、ある月の入金合計・回数券で払った来店の数・支払い済みか回数券の来店の数（集計に移した分も含む）。
+// 一覧の集計に LEFT JOIN して使う。プレースホルダは月（"YYYY-MM"）が3つ。
+const memberMonthTotalsSQL = `
+SELECT line_user_id,
+       SUM(received)       AS received,
+       SUM(ticket_visits)  AS ticket_visits,
+       SUM(settled_visits) AS settled_visits
+  FROM (
+    SELECT line_user_id, SUM(amount) AS received, 0 AS ticket_visits, 0 AS settled_visits
+      FROM payments
+     WHERE month = ?
+     GROUP BY line_user_id
+    UNION ALL
+    SELECT line_user_id, 0,
+           SUM(ticket_pack_id IS NOT NULL),
+           SUM(IFNULL(paid, 0) != 0 OR ticket_pack_id IS NOT NULL)
+      FROM visits
+     WHERE strftime('%Y-%m', visited_at) = ?
+     GROUP BY line_user_id
+    UNION ALL
+    SELECT line_user_id, 0, ticket_count, paid_count + ticket_count
+      FROM visit_monthly_rollups
+     WHERE month = ?
+  )
+ GROUP BY line_user_id`
+
+// memberMonthTotalsSQL の1行
+type memberMonthTotals struct {
+	Received      int
+	TicketVisits  int
+	SettledVisits int // 支払いチェック済み（visits.paid）か回数券で払った来店
+}
+
+// 指定月(ym="YYYY-MM") の入金一覧（古い順）
+func listMemberPayments(lineUserID, ym string) ([]payment, error) {
+	rows, err := db.Query(`
+SELECT
+  p.id,
+  p.line_user_id,
+  IFNULL(p.visit_id, 0),
+  p.month,
+  p.amount,
+  p.method,
+  IFNULL(a.username, ''),
+  strftime('%Y/%m/%d %H:%M', p.received_at),
+  p.note
+FROM payments p
+LEFT JOIN admin_users a ON a.id = p.received_by_admin_id
+WHERE p.line_user_id = ?
+  AND p.month = ?
+ORDER BY p.received_at, p.id
+`, lineUserID, ym)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []payment
+	for rows.Next() {
+		var p payment
+		if err := rows.Scan(&p.ID, &p.LineUserID, &p.VisitID, &p.Month, &p.Amount,
+			&p.Method, &p.ReceivedBy, &p.ReceivedAt, &p.Note); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// 入金を記録する。来店に紐づく入金なら visits.paid も立てる（1来店につき1件まで）。
+func insertPayment(tx *sql.Tx, p payment, adminID int64) (int64, error) {
+	var visitID interface{}
+	if p.VisitID != 0 {
+		var paid int
+		if err := tx.QueryRow(`SELECT IFNULL(paid, 0) FROM visits WHERE id = ?`, p.VisitID).Scan(&paid); err != nil {
+			return 0, err
+		}
+		if paid != 0 {
+			return 0, errVisitAlreadyPaid
+		}
+		if _, err := tx.Exec(`UPDATE visits SET paid = 1 WHERE id = ?`, p.VisitID); err != nil {
+			return 0, err
+		}
+		visitID = p.VisitID
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO payments(line_user_id, visit_id, month, amount, method, received_by_admin_id, received_at, note)
+         VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.LineUserID, visitID, p.Month, p.Amount, p.Method, adminID, formatJSTDateTime(jstNow()), p.Note,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// 入金を取り消す。来店に紐づく入金なら、その来店を未払いに戻す。
+func deletePayment(tx *sql.Tx, id int64) (payment, error) {
+	var p payment
+	err := tx.QueryRow(
+		`SELECT id, line_user_id, IFNULL(visit_id, 0), month, amount, method,
+		        strftime('%Y/%m/%d %H:%M', received_at), note
+		   FROM payments
+		  WHERE id = ?`,
+		id,
+	).Scan(&p.ID, &p.LineUserID, &p.VisitID, &p.Month, &p.Amount, &p.Method, &p.ReceivedAt, &p.Note)
+	if err == sql.ErrNoRows {
+		return p, errPaymentNotFound
+	}
+	if err != nil {
+		return p, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM payments WHERE id = ?`, id); err != nil {
+		return p, err
+	}
+	if p.VisitID != 0 {
+		if _, err := tx.Exec(`UPDATE visits SET paid = 0 WHERE id = ?`, p.VisitID); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,270 @@
+// plans.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 会員プラン。members.member_type には plans.code が入る。
+type plan struct {
+	Code            string
+	Name            string
+	MonthlyFee      int  // 月額（円）
+	Metered         bool // 月の込み回数を超えた来店を別料金にする
+	IncludedVisits  int  // 月の込み回数（Metered のときだけ使う）
+	ExtraVisitPrice int  // 込み回数を超えた1回あたり（円）
+	NoticeMessage   string
+	SortOrder       int
+	Selectable      bool // LIFF の登録画面で選べる
+	MemberCount     int  // 一覧表示用
+}
+
+// 新規会員（来店時に自動で作られる会員を含む）のプラン。削除できない。
+const defaultPlanCode = "general"
+
+// SQL の IFNULL に埋め込む用
+const defaultPlanCodeSQL = "'" + defaultPlanCode + "'"
+
+// 入力内容の誤り。管理画面にそのまま表示する。
+type planInputError string
+
+func (e planInputError) Error() string { return string(e) }
+
+var (
+	errPlanNotFound = errors.New("plan not found")
+	planCodePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+)
+
+// その月の nth 回目（1始まり）の来店が追加料金の対象か
+func (p plan) isBillableVisit(nth int) bool {
+	return p.Metered && nth > p.IncludedVisits
+}
+
+// 月額か追加1回の料金が設定されている（未設定なら金額での請求はできない）
+func (p plan) hasPrices() bool {
+	return p.MonthlyFee > 0 || p.ExtraVisitPrice > 0
+}
+
+// 込み回数の表示名
+func (p plan) IncludedLabel() string {
+	if !p.Metered {
+		return "無制限"
+	}
+	return fmt.Sprintf("月%d回まで", p.IncludedVisits)
+}
+
+// 込み回数を超えたチェックインで LIFF に出すメッセージ
+func (p plan) checkinNotice() string {
+	if p.NoticeMessage != "" {
+		return p.NoticeMessage
+	}
+	return fmt.Sprintf("【%s】今月%d回目以降のご来店です。\nスタッフにお声がけください。", p.Name, p.IncludedVisits+1)
+}
+
+// 1リクエストの間に何度も引くので、まとめて読んでおく
+type planCatalog struct {
+	list   []plan
+	byCode map[string]plan
+}
+
+func loadPlanCatalog() (planCatalog, error) {
+	list, err := listPlans()
+	if err != nil {
+		return planCatalog{}, err
+	}
+	c := planCatalog{list: list, byCode: make(map[string]plan, len(list))}
+	for _, p := range list {
+		c.byCode[p.Code] = p
+	}
+	return c, nil
+}
+
+func (c planCatalog) has(code string) bool {
+	_, ok := c.byCode[code]
+	return ok
+}
+
+// 削除済みなど見つからないプランは、コードをそのまま名前にした無制限プランとして扱う
+func (c planCatalog) lookup(code string) plan {
+	if p, ok := c.byCode[code]; ok {
+		return p
+	}
+	return plan{Code: code, Name: code}
+}
+
+func (c planCatalog) all() []plan {
+	return c.list
+}
+
+func (c planCatalog) selectable() []plan {
+	var list []plan
+	for _, p := range c.list {
+		if p.Selectable {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+const planColumns = `
+  p.code,
+  p.name,
+  p.monthly_fee,
+  p.included_visits IS NOT NULL,
+  IFNULL(p.included_visits, 0),
+  p.extra_visit_price,
+  p.notice_message,
+  p.sort_order,
+  p.selectable
+`
+
+func listPlans() ([]plan, error) {
+	rows, err := db.Query(`
+SELECT ` + planColumns + `,
+  (SELECT COUNT(*) FROM members m WHERE m.member_type = p.code)
+FROM plans p
+ORDER BY p.sort_order, p.code
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []plan
+	for rows.Next() {
+		var p plan
+		if err := rows.Scan(
+			&p.Code, &p.Name, &p.MonthlyFee, &p.Metered, &p.IncludedVisits,
+			&p.ExtraVisitPrice, &p.NoticeMessage, &p.SortOrder, &p.Selectable, &p.MemberCount,
+		); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func getPlan(code string) (plan, error) {
+	return queryPlan(db, code)
+}
+
+// *sql.DB と *sql.Tx のどちらからでも引けるように
+type sqlRowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func queryPlan(q sqlRowQueryer, code string) (plan, error) {
+	var p plan
+	err := q.QueryRow(`SELECT `+planColumns+` FROM plans p WHERE p.code = ?`, code).Scan(
+		&p.Code, &p.Name, &p.MonthlyFee, &p.Metered, &p.IncludedVisits,
+		&p.ExtraVisitPrice, &p.NoticeMessage, &p.SortOrder, &p.Selectable,
+	)
+	if err == sql.ErrNoRows {
+		return p, errPlanNotFound
+	}
+	return p, err
+}
+
+func validatePlan(p plan) error {
+	if !planCodePattern.MatchString(p.Code) {
+		return planInputError("コードは英小文字・数字・-・_ で32文字以内にしてください")
+	}
+	if strings.TrimSpace(p.Name) == "" {
+		return planInputError("プラン名を入力してください")
+	}
+	if p.MonthlyFee < 0 || p.ExtraVisitPrice < 0 {
+		return planInputError("金額は0以上にしてください")
+	}
+	if p.Metered && p.IncludedVisits < 0 {
+		return planInputError("込み回数は0以上にしてください")
+	}
+	return nil
+}
+
+func planIncludedVisitsValue(p plan) interface{} {
+	if !p.Metered {
+		return nil
+	}
+	return p.IncludedVisits
+}
+
+func insertPlan(ex sqlExecer, p plan) error {
+	if err := validatePlan(p); err != nil {
+		return err
+	}
+	now := formatJSTDateTime(jstNow())
+	_, err := ex.Exec(
+		`INSERT INTO plans(code, name, monthly_fee, included_visits, extra_visit_price,
+                           notice_message, sort_order, selectable, created_at, updated_at)
+         VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.Code, strings.TrimSpace(p.Name), p.MonthlyFee, planIncludedVisitsValue(p), p.ExtraVisitPrice,
+		p.NoticeMessage, p.SortOrder, p.Selectable, now, now,
+	)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+		return planInputError(fmt.Sprintf("コード「%s」は既に使われています", p.Code))
+	}
+	return err
+}
+
+func updatePlan(ex sqlExecer, p plan) error {
+	if err := validatePlan(p); err != nil {
+		return err
+	}
+	_, err := ex.Exec(
+		`UPDATE plans
+            SET name = ?, monthly_fee = ?, included_visits = ?, extra_visit_price = ?,
+                notice_message = ?, sort_order = ?, selectable = ?, updated_at = ?
+          WHERE code = ?`,
+		strings.TrimSpace(p.Name), p.MonthlyFee, planIncludedVisitsValue(p), p.ExtraVisitPrice,
+		p.NoticeMessage, p.SortOrder, p.Selectable, formatJSTDateTime(jstNow()), p.Code,
+	)
+	return err
+}
+
+// 会員が1人でも使っているプランは消さない（先に別のプランへ移してもらう）
+func deletePlan(tx *sql.Tx, code string) error {
+	if code == defaultPlanCode {
+		return planInputError("既定のプランは削除できません")
+	}
+	var members int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM members WHERE member_type = ?`, code).Scan(&members); err != nil {
+		return err
+	}
+	if members > 0 {
+		return planInputError(fmt.Sprintf("このプランの会員が%d人いるため削除できません", members))
+	}
+	_, err := tx.Exec(`DELETE FROM plans WHERE code = ?`, code)
+	return err
+}
+
+// 会員のプランと今月の来店回数
+func getMemberPlanAndMonthlyCount(lineUserID string) (plan, int, error) {
+	var (
+		memberType   string
+		monthlyCount int
+	)
+	err := db.QueryRow(`
+SELECT
+  IFNULL(m.member_type, `+defaultPlanCodeSQL+`),
+  COUNT(v.id)
+FROM members m
+LEFT JOIN visits v
+  ON v.line_user_id = m.line_user_id
+  AND strftime('%Y-%m', v.visited_at) = ?
+WHERE m.line_user_id = ?
+GROUP BY m.line_user_id, m.member_type
+`, formatJSTMonth(jstNow()), lineUserID).Scan(&memberType, &monthlyCount)
+	if err != nil {
+		return plan{}, 0, err
+	}
+
+	p, err := getPlan(memberType)
+	if err == errPlanNotFound {
+		return plan{Code: memberType, Name: memberType}, monthlyCount, nil
+	}
+	return p, monthlyCount, err
+}
@@ -1,17 +1,24 @@
 let currentUserId = null;
 let currentDisplayName = "";
-const MAX_FALLBACK = 10; // Go側と合わせる
+let currentIdToken = "";
 const host = window.location.hostname;
 const USE_LIFF = host !== "localhost" && host !== "127.0.0.1" && host !== "::1";
 const RESOLVED_LIFF_ID =
   (typeof window !== "undefined" && window.LIFF_ID) ||
   (typeof LIFF_ID !== "undefined" ? LIFF_ID : "");
 
+// ローカル開発時はサーバーを LINE_AUTH_MODE=stub で起動し、
+// "stub:<userId>:<displayName>" をIDトークンの代わりに送る。?devUser=xxx で利用者を切り替えられる。
 const LOCAL_DEV_USER = {
-  userId: "local-dev-user",
+  userId: new URLSearchParams(window.location.search).get("devUser") || "local-dev-user",
   displayName: "Local Dev",
 };
 
+// サーバーは userId ではなく、このIDトークンから利用者を判定する
+function authHeaders(extra = {}) {
+  return { ...extra, Authorization: `Bearer ${currentIdToken}` };
+}
+
 let userGestureed = false;
 
 function setUserGestureed() {
@@ -156,8 +163,9 @@ async function refreshMonthlyVisitCount() {
   }
 
   try {
-    const res = await fetch(`/member/monthly-visits?userId=${encodeURIComponent(currentUserId)}`, {
+    const res = await fetch("/member/monthly-visits", {
       cache: "no-store",
+      headers: authHeaders(),
     });
     if (!res.ok) {
       console.error("monthly visits fetch failed", res.status);
@@ -197,11 +205,9 @@ async function reportClientError(event, detail, stage) {
 
 // プロフィール取得・表示制御 ------------------------------
 
-async function ensureProfile(userId) {
-  currentUserId = userId;
-
+async function ensureProfile() {
   try {
-    const res = await fetch(`/member/profile?userId=${encodeURIComponent(userId)}`);
+    const res = await fetch("/member/profile", { headers: authHeaders() });
     if (!res.ok) {
       console.error("profile get error", res.status);
       await reportClientError("profile_fetch_failed", `status=${res.status}`, "ensureProfile");
@@ -227,10 +233,57 @@ async function ensureProfile(userId) {
   }
 }
 
+// 会員種別の選択肢をサーバーのプラン一覧で作り直す（失敗したら HTML に書いてある既定の選択肢のまま）
+let planOptionsLoaded = false;
+
+async function loadPlanOptions() {
+  const container = document.getElementById("memberTypeOptions");
+  if (!container || planOptionsLoaded) return;
+
+  try {
+    const res = await fetch("/plans", { cache: "no-store" });
+    if (!res.ok) {
+      console.error("plans fetch failed", res.status);
+      return;
+    }
+
+    const data = await res.json();
+    if (!Array.isArray(data.plans) || data.plans.length === 0) return;
+
+    container.textContent = "";
+    data.plans.forEach((plan, i) => {
+      const id = `memberType-${plan.code}`;
+      const wrapper = document.createElement("div");
+      wrapper.className = "form-check form-check-inline";
+
+      const input = document.createElement("input");
+      input.className = "form-check-input";
+      input.type = "radio";
+      input.name = "memberType";
+      input.id = id;
+      input.value = plan.code;
+      input.checked = plan.code === data.default || (i === 0 && !data.plans.some((p) => p.code === data.default));
+
+      const label = document.createElement("label");
+      label.className = "form-check-label";
+      label.htmlFor = id;
+      label.textContent = plan.name;
+
+      wrapper.append(input, label);
+      container.appendChild(wrapper);
+    });
+    planOptionsLoaded = true;
+  } catch (e) {
+    console.error("plans fetch exception", e);
+  }
+}
+
 function showProfileForm() {
   const form = document.getElementById("profileForm");
   const msg = document.getElementById("profileMessage");
 
+  loadPlanOptions();
+
   if (form) form.style.display = "block";
   if (msg) {
     msg.style.display = "block";
@@ -263,9 +316,8 @@ async function submitProfile() {
   try {
     const res = await fetch("/member/profile", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers: authHeaders({ "Content-Type": "application/json" }),
       body: JSON.stringify({
-        userId: currentUserId,
         lastName,
         firstName,
         memberType,
@@ -322,6 +374,10 @@ async function init() {
         const profile = await liff.getProfile();
         currentUserId = profile.userId;
         currentDisplayName = profile.displayName;
+        currentIdToken = liff.getIDToken() || "";
+        if (!currentIdToken) {
+          throw new Error("id_token_missing");
+        }
       } catch (e) {
         console.error("liff.getProfile failed", e);
         await reportClientError("liff_profile_failed", e.message || String(e), "init");
@@ -331,11 +387,12 @@ async function init() {
     } else {
       currentUserId = LOCAL_DEV_USER.userId;
       currentDisplayName = LOCAL_DEV_USER.displayName;
+      currentIdToken = `stub:${LOCAL_DEV_USER.userId}:${LOCAL_DEV_USER.displayName}`;
     }
 
     await refreshMonthlyVisitCount();
 
-    const profileReady = await ensureProfile(currentUserId);
+    const profileReady = await ensureProfile();
     if (!profileReady) {
       return;
     }
@@ -357,16 +414,79 @@ async function init() {
   }
 }
 
+// -------------------------------------------------------
+// 受付の QR コード（CHECKIN_QR_REQUIRED のときだけ使う）
+// -------------------------------------------------------
+
+// QR の中身は、トークンそのものか、?kiosk=トークン 付きの LIFF の URL
+function extractKioskToken(value) {
+  const text = String(value || "").trim();
+  if (!text) return "";
+  try {
+    const fromURL = new URL(text).searchParams.get("kiosk");
+    if (fromURL) return fromURL;
+  } catch (e) {
+    // URL でなければトークンそのもの
+  }
+  return text;
+}
+
+async function obtainKioskToken() {
+  // LINE のカメラで読み取って開いた場合は URL に付いている（使うのは1回だけ）
+  const params = new URLSearchParams(window.location.search);
+  const fromURL = params.get("kiosk");
+  if (fromURL) {
+    params.delete("kiosk");
+    const rest = params.toString();
+    history.replaceState(null, "", window.location.pathname + (rest ? `?${rest}` : ""));
+    return fromURL;
+  }
+
+  if (USE_LIFF && window.liff && typeof liff.scanCodeV2 === "function") {
+    try {
+      const result = await liff.scanCodeV2();
+      return extractKioskToken(result && result.value);
+    } catch (e) {
+      console.error("liff.scanCodeV2 failed", e);
+      await reportClientError("kiosk_scan_failed", e.message || String(e), "obtainKioskToken");
+    }
+  }
+  return "";
+}
+
+// 端末の位置（GEOFENCE_MODE のときだけ使う）。取れなければ null
+function getDevicePosition() {
+  if (!navigator.geolocation) {
+    return Promise.resolve(null);
+  }
+  return new Promise((resolve) => {
+    navigator.geolocation.getCurrentPosition(
+      (pos) =>
+        resolve({
+          latitude: pos.coords.latitude,
+          longitude: pos.coords.longitude,
+          accuracy: pos.coords.accuracy,
+        }),
+      async (err) => {
+        console.error("geolocation failed", err);
+        await reportClientError("geolocation_failed", `code=${err.code} ${err.message || ""}`, "getDevicePosition");
+        resolve(null);
+      },
+      { enableHighAccuracy: true, timeout: 10000, maximumAge: 60000 }
+    );
+  });
+}
+
 async function autoToggleCheckin() {
   try {
-    const statusRes = await fetch(`/status?userId=${encodeURIComponent(currentUserId)}`);
+    const statusRes = await fetch("/status", { headers: authHeaders() });
     if (!statusRes.ok) {
       console.error("status fetch failed", statusRes.status);
       await reportClientError("status_fetch_failed", `status=${statusRes.status}`, "autoToggleCheckin");
       throw new Error(`status failed: ${statusRes.status}`);
     }
     const statusData = await statusRes.json();
-    updateCapacityBar(statusData.count, MAX_FALLBACK);
+    updateCapacityBar(statusData.count, statusData.max);
     if (Object.prototype.hasOwnProperty.call(statusData, "monthlyVisitCount")) {
       updateMonthlyVisitCount(statusData.monthlyVisitCount);
     } else {
@@ -383,10 +503,10 @@ async function autoToggleCheckin() {
 
       const checkoutRes = await fetch("/checkout", {
         method: "POST",
-        headers: { "Content-Type": "application/json" },
+        headers: authHeaders({ "Content-Type": "application/json" }),
         body: JSON.stringify({
-          userId: currentUserId,
           displayName: currentDisplayName,
+          trigger: "auto",
         }),
       });
 
@@ -397,7 +517,7 @@ async function autoToggleCheckin() {
       }
 
       const checkoutData = await checkoutRes.json();
-      updateCapacityBar(checkoutData.count, MAX_FALLBACK);
+      updateCapacityBar(checkoutData.count, checkoutData.max);
       showResultMessage("チェックアウトしました。", false, "checkout");
       return;
     }
@@ -409,12 +529,24 @@ async function autoToggleCheckin() {
       return;
     }
 
+    let kioskToken = "";
+    if (statusData.kioskTokenRequired) {
+      kioskToken = await obtainKioskToken();
+      if (!kioskToken) {
+        showResultMessage("チェックインするには、受付に表示されているQRコードを読み取ってください。");
+        return;
+      }
+    }
+
+    const position = statusData.locationRequested ? await getDevicePosition() : null;
+
     const checkinRes = await fetch("/checkin", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers: authHeaders({ "Content-Type": "application/json" }),
       body: JSON.stringify({
-        userId: currentUserId,
         displayName: currentDisplayName,
+        kioskToken,
+        ...(position || {}),
       }),
     });
 
@@ -425,7 +557,27 @@ async function autoToggleCheckin() {
     }
 
     const checkinData = await checkinRes.json();
-    updateCapacityBar(checkinData.count, MAX_FALLBACK);
+    updateCapacityBar(checkinData.count, checkinData.max);
+    if (checkinData.status === "geofence") {
+      // 店舗から離れている・位置が分からない
+      showResultMessage(checkinData.message || "店舗の近くでチェックインしてください。");
+      return;
+    }
+    if (checkinData.status === "kiosk_token") {
+      // 受付の QR コードが無い・古い
+      showResultMessage(checkinData.message || "受付のQRコードを読み取ってください。");
+      return;
+    }
+    if (checkinData.status === "closed") {
+      // 営業時間外
+      showResultMessage(checkinData.message || "ただいま営業時間外です。");
+      return;
+    }
+    if (checkinData.status === "waitlisted") {
+      // 満員で入れなかった（順番待ちに登録済み）
+      showResultMessage(checkinData.message || "ただいま満員です。");
+      return;
+    }
     if (Object.prototype.hasOwnProperty.call(checkinData, "monthlyVisitCount")) {
       updateMonthlyVisitCount(checkinData.monthlyVisitCount);
     } else {
@@ -443,8 +595,13 @@ async function autoToggleCheckin() {
   }
 }
 
+// max は /status・/checkin・/checkout が返すサーバー側の定員
 function updateCapacityBar(count, max) {
-  const realMax = max;
+  const realMax = Number(max);
+  if (!realMax) {
+    capacityTextEl.textContent = `混雑度：${count}人`;
+    return;
+  }
   const percent = Math.min(100, Math.round((count / realMax) * 100));
   const fill = document.getElementById("capacityFill");
   const text = document.getElementById("capacityText");
@@ -468,9 +625,57 @@ function updateCapacityBar(count, max) {
   text.textContent = `混雑度：${count} / ${realMax}（${percent}%）`;
 }
 
+// 混雑度は /count-stream（SSE）で更新し続ける。
+// 使えない・切れたときは30秒ごとのポーリングに切り替え、1分後にもう一度つなぎ直す。
+const COUNT_POLL_INTERVAL_MS = 30000;
+const COUNT_STREAM_RETRY_MS = 60000;
+let countPollTimer = null;
+
+async function refreshCount() {
+  try {
+    const res = await fetch("/count-json", { cache: "no-store" });
+    if (!res.ok) throw new Error(`/count-json HTTP ${res.status}`);
+    const data = await res.json();
+    updateCapacityBar(data.count, data.max);
+  } catch (e) {
+    console.error("count fetch failed", e);
+  }
+}
+
+function startCountPolling() {
+  if (countPollTimer) return;
+  countPollTimer = setInterval(refreshCount, COUNT_POLL_INTERVAL_MS);
+}
+
+function stopCountPolling() {
+  if (!countPollTimer) return;
+  clearInterval(countPollTimer);
+  countPollTimer = null;
+}
+
+function subscribeCount() {
+  if (!window.EventSource) {
+    startCountPolling();
+    return;
+  }
+
+  const source = new EventSource("/count-stream");
+  source.addEventListener("occupancy", (ev) => {
+    stopCountPolling();
+    const data = JSON.parse(ev.data);
+    updateCapacityBar(data.count, data.max);
+  });
+  source.onerror = () => {
+    source.close();
+    startCountPolling();
+    setTimeout(subscribeCount, COUNT_STREAM_RETRY_MS);
+  };
+}
+
 const profileSubmitBtn = document.getElementById("profileSubmitBtn");
 if (profileSubmitBtn) {
   profileSubmitBtn.addEventListener("click", submitProfile);
 }
 
 init();
+subscribeCount();
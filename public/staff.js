@@ -0,0 +1,193 @@
+// 受付のスタッフ端末。端末トークンは localStorage に保存する（管理画面のログインとは別）
+const STAFF_TOKEN_KEY = "staffKioskToken";
+
+function staffToken() {
+  return localStorage.getItem(STAFF_TOKEN_KEY) || "";
+}
+
+async function staffFetch(path, options = {}) {
+  const res = await fetch(path, {
+    ...options,
+    cache: "no-store",
+    headers: {
+      ...(options.headers || {}),
+      "Authorization": `Bearer ${staffToken()}`,
+      "Content-Type": "application/json",
+    },
+  });
+  if (res.status === 401) {
+    // 取り消された・貼り間違えたトークン
+    localStorage.removeItem(STAFF_TOKEN_KEY);
+    showSetup("端末トークンが無効です。管理画面で登録し直してください。");
+    throw new Error("unauthorized");
+  }
+  const data = await res.json().catch(() => ({}));
+  if (!res.ok) {
+    throw new Error(data.error || `status=${res.status}`);
+  }
+  return data;
+}
+
+function showSetup(message) {
+  document.getElementById("staffPanel").style.display = "none";
+  document.getElementById("setupPanel").style.display = "";
+  document.getElementById("setupError").textContent = message || "";
+}
+
+function showResult(message, level) {
+  const el = document.getElementById("resultMsg");
+  el.className = `alert staff-result py-2 alert-${level}`;
+  el.textContent = message;
+  el.style.display = "";
+}
+
+function updateCount(count, max) {
+  document.getElementById("staffCount").textContent = count;
+  document.getElementById("staffMax").textContent = max;
+}
+
+async function loadMe() {
+  const data = await staffFetch("/staff/api/me");
+  document.getElementById("setupPanel").style.display = "none";
+  document.getElementById("staffPanel").style.display = "";
+  document.getElementById("staffDevice").textContent = data.device;
+  document.getElementById("staffClosed").textContent = data.open ? "" : "営業時間外";
+  updateCount(data.count, data.max);
+}
+
+function renderMembers(members) {
+  const list = document.getElementById("memberList");
+  list.innerHTML = "";
+  document.getElementById("emptyMsg").style.display = members.length ? "none" : "";
+
+  members.forEach((m) => {
+    const tr = document.createElement("tr");
+
+    const nameTd = document.createElement("td");
+    if (m.kana) {
+      const kana = document.createElement("div");
+      kana.className = "staff-member-kana";
+      kana.textContent = m.kana;
+      nameTd.appendChild(kana);
+    }
+    const name = document.createElement("div");
+    name.className = "fw-bold";
+    name.textContent = m.fullName || m.displayName;
+    nameTd.appendChild(name);
+    const sub = document.createElement("div");
+    sub.className = "small text-muted";
+    sub.textContent = [m.planName, m.posterId ? `PosterID: ${m.posterId}` : "", m.lineLinked ? "" : "LINEなし"]
+      .filter(Boolean).join(" ・ ");
+    nameTd.appendChild(sub);
+    tr.appendChild(nameTd);
+
+    const actionTd = document.createElement("td");
+    actionTd.className = "text-end text-nowrap";
+    const button = document.createElement("button");
+    button.type = "button";
+    if (m.insideNow) {
+      button.className = "btn btn-outline-secondary";
+      button.textContent = "チェックアウト";
+      button.addEventListener("click", () => staffAction("/staff/api/checkout", m, button));
+    } else {
+      button.className = "btn btn-primary";
+      button.textContent = "チェックイン";
+      button.addEventListener("click", () => staffAction("/staff/api/checkin", m, button));
+    }
+    actionTd.appendChild(button);
+    tr.appendChild(actionTd);
+
+    list.appendChild(tr);
+  });
+}
+
+async function search() {
+  const q = document.getElementById("searchInput").value.trim();
+  if (!q) {
+    renderMembers([]);
+    document.getElementById("emptyMsg").style.display = "none";
+    return;
+  }
+  try {
+    const data = await staffFetch(`/staff/api/members?q=${encodeURIComponent(q)}`);
+    // 入力が変わっていたら古い結果は捨てる
+    if (q === document.getElementById("searchInput").value.trim()) {
+      renderMembers(data.members);
+    }
+  } catch (e) {
+    if (e.message !== "unauthorized") {
+      showResult("検索できませんでした。", "danger");
+    }
+  }
+}
+
+async function staffAction(path, member, button) {
+  button.disabled = true;
+  try {
+    const data = await staffFetch(path, {
+      method: "POST",
+      body: JSON.stringify({ memberId: member.memberId }),
+    });
+    updateCount(data.count, data.max);
+    let level = "success";
+    if (data.status === "full" || data.status === "closed") {
+      level = "danger";
+    } else if (data.status === "over_capacity" || data.showLightPlanNotice) {
+      level = "warning";
+    }
+    showResult(data.message, level);
+    await search();
+  } catch (e) {
+    if (e.message !== "unauthorized") {
+      showResult("処理できませんでした。もう一度お試しください。", "danger");
+    }
+    button.disabled = false;
+  }
+}
+
+document.addEventListener("DOMContentLoaded", function () {
+  let timer = null;
+  document.getElementById("searchInput").addEventListener("input", function () {
+    clearTimeout(timer);
+    timer = setTimeout(search, 250);
+  });
+
+  document.getElementById("tokenSave").addEventListener("click", async function () {
+    const token = document.getElementById("tokenInput").value.trim();
+    if (!token) {
+      return;
+    }
+    localStorage.setItem(STAFF_TOKEN_KEY, token);
+    try {
+      await loadMe();
+    } catch (e) {
+      if (e.message !== "unauthorized") {
+        showSetup("サーバーに接続できませんでした。");
+      }
+    }
+  });
+
+  document.getElementById("tokenReset").addEventListener("click", function () {
+    if (confirm("この端末の登録を解除しますか？（もう一度使うには端末トークンが必要です）")) {
+      localStorage.removeItem(STAFF_TOKEN_KEY);
+      showSetup("");
+    }
+  });
+
+  if (!staffToken()) {
+    showSetup("");
+  } else {
+    loadMe().catch((e) => {
+      if (e.message !== "unauthorized") {
+        showSetup("サーバーに接続できませんでした。");
+      }
+    });
+  }
+
+  // 人数は他の端末・LINE からも変わるので、ときどき取り直す
+  setInterval(() => {
+    if (staffToken() && document.getElementById("staffPanel").style.display !== "none") {
+      loadMe().catch(() => {});
+    }
+  }, 30000);
+});
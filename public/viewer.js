@@ -1,7 +1,10 @@
-const MAX_FALLBACK = 10;
-
+// max は /count-json が返すサーバー側の定員
 function updateCapacityBar(count, max) {
-  const realMax = MAX_FALLBACK;
+  const realMax = Number(max);
+  if (!realMax) {
+    document.getElementById("capacityText").textContent = `混雑度：${count}人`;
+    return;
+  }
   const percent = Math.min(100, Math.round((count / realMax) * 100));
   const fill = document.getElementById("capacityFill");
   const text = document.getElementById("capacityText");
@@ -25,26 +28,67 @@ function updateCapacityBar(count, max) {
   text.textContent = `混雑度：${count} / ${realMax}（${percent}%）`;
 }
 
+function setUpdatedAt() {
+  const updated = document.getElementById("updatedAt");
+  const d = new Date();
+  const hh = String(d.getHours()).padStart(2, "0");
+  const mm = String(d.getMinutes()).padStart(2, "0");
+  const ss = String(d.getSeconds()).padStart(2, "0");
+  updated.textContent = `最終更新: ${hh}:${mm}:${ss}`;
+}
+
 async function refresh() {
     const err = document.getElementById("errorMsg");
-    const updated = document.getElementById("updatedAt");
     try {
       err.textContent = "";
       const res = await fetch("/count-json", { cache: "no-store" });
       if (!res.ok) throw new Error(`/count-json HTTP ${res.status}`);
       const data = await res.json();
-      updateCapacityBar(data.count, data.max || MAX_FALLBACK);
-  
-      const d = new Date();
-      const hh = String(d.getHours()).padStart(2, "0");
-      const mm = String(d.getMinutes()).padStart(2, "0");
-      const ss = String(d.getSeconds()).padStart(2, "0");
-      updated.textContent = `最終更新: ${hh}:${mm}:${ss}`;
+      updateCapacityBar(data.count, data.max);
+      setUpdatedAt();
     } catch (e) {
       err.textContent = "更新に失敗しました。しばらくしてから再読み込みしてください。";
       console.error(e);
     }
   }
 
-refresh();
-setInterval(refresh, 10000);
+// /count-stream（SSE）で人数の変化を受け取る。
+// 使えない・切れたときは10秒ごとのポーリングに切り替え、1分後にもう一度つなぎ直す。
+const POLL_INTERVAL_MS = 10000;
+const STREAM_RETRY_MS = 60000;
+let pollTimer = null;
+
+function startPolling() {
+  if (pollTimer) return;
+  refresh();
+  pollTimer = setInterval(refresh, POLL_INTERVAL_MS);
+}
+
+function stopPolling() {
+  if (!pollTimer) return;
+  clearInterval(pollTimer);
+  pollTimer = null;
+}
+
+function subscribeCount() {
+  if (!window.EventSource) {
+    startPolling();
+    return;
+  }
+
+  const source = new EventSource("/count-stream");
+  source.addEventListener("occupancy", (ev) => {
+    stopPolling();
+    document.getElementById("errorMsg").textContent = "";
+    const data = JSON.parse(ev.data);
+    updateCapacityBar(data.count, data.max);
+    setUpdatedAt();
+  });
+  source.onerror = () => {
+    source.close();
+    startPolling();
+    setTimeout(subscribeCount, STREAM_RETRY_MS);
+  };
+}
+
+subscribeCount();
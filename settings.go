@@ -0,0 +1,307 @@
+// settings.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 定員・定員に達したときの扱い・期限切れ・自動切替のブロック時間・来店明細を残す日数。
+// 既定値は環境変数から読み、管理画面で変更した値は settings テーブルに保存して優先する。
+type storeSettings struct {
+	MaxPeople            int
+	CapacityPolicy       capacityPolicy
+	WaitlistHoldFor      time.Duration // 順番待ちで呼んだ人のために枠を空けておく時間（waitlist.go）
+	ExpireAfter          time.Duration
+	AutoCheckoutBlockFor time.Duration
+	AutoCheckinBlockFor  time.Duration
+	VisitsRetentionDays  int // これより古い月の来店は月ごとの集計に移す（visit_archive.go）
+}
+
+// settings テーブルのキー
+const (
+	settingKeyMaxPeople            = "max_people"
+	settingKeyExpireAfter          = "expire_after_minutes"
+	settingKeyAutoCheckoutBlockFor = "auto_checkout_block_minutes"
+	settingKeyAutoCheckinBlockFor  = "auto_checkin_block_minutes"
+	settingKeyVisitsRetentionDays  = "visits_retention_days"
+	settingKeyWaitlistHoldFor      = "waitlist_hold_minutes"
+	settingKeyCapacityPolicy       = "capacity_policy"
+)
+
+// 定員に達したときの扱い
+type capacityPolicy string
+
+const (
+	capacityPolicyAllow  capacityPolicy = "allow"  // そのまま入れる
+	capacityPolicyWarn   capacityPolicy = "warn"   // 入れるが、定員を超えていることを伝える
+	capacityPolicyReject capacityPolicy = "reject" // 断って順番待ちに入れる
+)
+
+const capacityPolicyEnvKey = "CAPACITY_POLICY"
+
+type capacityPolicyOption struct {
+	Value capacityPolicy
+	Label string
+}
+
+var capacityPolicyOptions = []capacityPolicyOption{
+	{capacityPolicyAllow, "そのままチェックインできる"},
+	{capacityPolicyWarn, "チェックインできるが、定員超過を知らせる"},
+	{capacityPolicyReject, "チェックインを断り、順番待ちに入れる"},
+}
+
+func parseCapacityPolicy(raw string) (capacityPolicy, error) {
+	for _, o := range capacityPolicyOptions {
+		if string(o.Value) == strings.TrimSpace(raw) {
+			return o.Value, nil
+		}
+	}
+	return "", fmt.Errorf("定員に達したときの扱いは allow / warn / reject のどれかで指定してください")
+}
+
+func (p capacityPolicy) Label() string {
+	for _, o := range capacityPolicyOptions {
+		if o.Value == p {
+			return o.Label
+		}
+	}
+	return string(p)
+}
+
+// 整数で持つ設定の定義（表示名・環境変数・範囲）
+type intSettingDef struct {
+	Key          string
+	EnvKey       string
+	Label        string
+	Unit         string
+	DefaultValue int
+	Min          int
+	Max          int
+}
+
+var intSettingDefs = []intSettingDef{
+	{settingKeyMaxPeople, "MAX_PEOPLE", "定員", "人", 10, 1, 1000},
+	{settingKeyExpireAfter, "CHECKIN_EXPIRE_MINUTES", "チェックインの有効時間", "分", 90, 1, 24 * 60},
+	{settingKeyAutoCheckoutBlockFor, "AUTO_CHECKOUT_BLOCK_MINUTES", "チェックイン後、自動チェックアウトしない時間", "分", 10, 0, 24 * 60},
+	{settingKeyAutoCheckinBlockFor, "AUTO_CHECKIN_BLOCK_MINUTES", "チェックアウト後、自動チェックインしない時間", "分", 30, 0, 24 * 60},
+	// 前月の一覧・カレンダーは明細を使うので、31日より短くはできない
+	{settingKeyVisitsRetentionDays, "VISITS_RETENTION_DAYS", "来店明細を残す期間", "日", 90, 31, 3650},
+	{settingKeyWaitlistHoldFor, "WAITLIST_HOLD_MINUTES", "順番待ちで呼んだ人のために枠を空けておく時間", "分", 10, 1, 120},
+}
+
+// 環境変数（なければ組み込みの既定値）から作った値。DB の値が無いときに使う。
+func envSettingValues() (map[string]int, error) {
+	values := make(map[string]int, len(intSettingDefs))
+	for _, def := range intSettingDefs {
+		values[def.Key] = def.DefaultValue
+
+		raw := strings.TrimSpace(os.Getenv(def.EnvKey))
+		if raw == "" {
+			continue
+		}
+		v, err := def.parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", def.EnvKey, err)
+		}
+		values[def.Key] = v
+	}
+	return values, nil
+}
+
+func (def intSettingDef) parse(raw string) (int, error) {
+	v, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, fmt.Errorf("%sは整数で指定してください", def.Label)
+	}
+	if v < def.Min || v > def.Max {
+		return 0, fmt.Errorf("%sは%d〜%dの範囲で指定してください", def.Label, def.Min, def.Max)
+	}
+	return v, nil
+}
+
+// settings テーブルに保存されている値
+func getStoredSettingValues() (map[string]string, error) {
+	rows, err := db.Query(`SELECT key, value FROM settings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+func storeSettingsFromValues(values map[string]int, policy capacityPolicy) storeSettings {
+	return storeSettings{
+		MaxPeople:            values[settingKeyMaxPeople],
+		CapacityPolicy:       policy,
+		WaitlistHoldFor:      time.Duration(values[settingKeyWaitlistHoldFor]) * time.Minute,
+		ExpireAfter:          time.Duration(values[settingKeyExpireAfter]) * time.Minute,
+		AutoCheckoutBlockFor: time.Duration(values[settingKeyAutoCheckoutBlockFor]) * time.Minute,
+		AutoCheckinBlockFor:  time.Duration(values[settingKeyAutoCheckinBlockFor]) * time.Minute,
+		VisitsRetentionDays:  values[settingKeyVisitsRetentionDays],
+	}
+}
+
+// 環境変数の既定値に DB の値を重ねて、有効な設定値を作る
+func resolveSettingValues() (map[string]int, error) {
+	values, err := envSettingValues()
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := getStoredSettingValues()
+	if err != nil {
+		return nil, err
+	}
+	for _, def := range intSettingDefs {
+		raw, ok := stored[def.Key]
+		if !ok {
+			continue
+		}
+		v, err := def.parse(raw)
+		if err != nil {
+			// 壊れた値で起動できなくなるよりは既定値で動かす
+			appLog.error("setting_invalid", eventFields{
+				"key":   def.Key,
+				"value": raw,
+				"error": err.Error(),
+			})
+			continue
+		}
+		values[def.Key] = v
+	}
+	return values, nil
+}
+
+// CAPACITY_POLICY（なければ allow）
+func envCapacityPolicy() (capacityPolicy, error) {
+	raw := strings.TrimSpace(os.Getenv(capacityPolicyEnvKey))
+	if raw == "" {
+		return capacityPolicyAllow, nil
+	}
+	policy, err := parseCapacityPolicy(raw)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", capacityPolicyEnvKey, err)
+	}
+	return policy, nil
+}
+
+// 環境変数の既定値に DB の値を重ねて、定員に達したときの扱いを決める
+func resolveCapacityPolicy() (capacityPolicy, error) {
+	policy, err := envCapacityPolicy()
+	if err != nil {
+		return "", err
+	}
+
+	stored, err := getStoredSettingValues()
+	if err != nil {
+		return "", err
+	}
+	raw, ok := stored[settingKeyCapacityPolicy]
+	if !ok {
+		return policy, nil
+	}
+	storedPolicy, err := parseCapacityPolicy(raw)
+	if err != nil {
+		appLog.error("setting_invalid", eventFields{
+			"key":   settingKeyCapacityPolicy,
+			"value": raw,
+			"error": err.Error(),
+		})
+		return policy, nil
+	}
+	return storedPolicy, nil
+}
+
+// 起動時に呼び出す
+func loadStoreSettings() error {
+	values, err := resolveSettingValues()
+	if err != nil {
+		return err
+	}
+	policy, err := resolveCapacityPolicy()
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	previousMax := currentSettings.MaxPeople
+	currentSettings = storeSettingsFromValues(values, policy)
+	if currentSettings.MaxPeople != previousMax {
+		notifyOccupancyLocked()
+		// 定員を増やしたら、空いた分だけ順番待ちの人を呼ぶ
+		promoteWaitlistLocked(jstNow())
+	}
+	return nil
+}
+
+// 管理画面から保存する。values は intSettingDefs の全キーを含むこと。
+func saveStoreSettings(values map[string]int, policy capacityPolicy) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	updatedAt := formatJSTDateTime(jstNow())
+	for _, def := range intSettingDefs {
+		if _, err = tx.Exec(
+			`INSERT INTO settings(key, value, updated_at)
+             VALUES(?, ?, ?)
+             ON CONFLICT(key)
+             DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+			def.Key, strconv.Itoa(values[def.Key]), updatedAt,
+		); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(
+		`INSERT INTO settings(key, value, updated_at)
+         VALUES(?, ?, ?)
+         ON CONFLICT(key)
+         DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		settingKeyCapacityPolicy, string(policy), updatedAt,
+	); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return loadStoreSettings()
+}
+
+// 管理画面で保存した値を消して、環境変数の既定値に戻す
+func resetStoreSettings() error {
+	keys := []interface{}{settingKeyCapacityPolicy}
+	placeholders := []string{"?"}
+	for _, def := range intSettingDefs {
+		keys = append(keys, def.Key)
+		placeholders = append(placeholders, "?")
+	}
+
+	if _, err := db.Exec(
+		`DELETE FROM settings WHERE key IN (`+strings.Join(placeholders, ", ")+`)`,
+		keys...,
+	); err != nil {
+		return err
+	}
+	return loadStoreSettings()
+}
@@ -0,0 +1,340 @@
+// staff_kiosk.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 受付のスタッフ端末（public/staff.html）から使う API（/staff/api/...）。
+// スタッフが会員を名前・ふりがな・PosterID で探し、代わりにチェックイン・チェックアウトする。
+// LINE を使わない会員（local_members.go）はここからしか受付できない。
+// 認証は管理画面で登録した端末トークン（kiosk_devices.go）。来店は visits.source = staff で残す。
+// 営業時間と定員は /checkin と同じく守るが、受付の QR コードと位置の確認は端末がお店にあるので要らない。
+
+const kioskDeviceContextKey contextKey = "kiosk_device"
+
+// 一度に返す検索結果の上限
+const staffMemberSearchLimit = 30
+
+// requireKioskDevice を通ったリクエストの端末
+func kioskDeviceFromContext(ctx context.Context) *kioskDevice {
+	d, _ := ctx.Value(kioskDeviceContextKey).(*kioskDevice)
+	return d
+}
+
+// Authorization: Bearer <端末トークン> を確かめる
+func requireKioskDevice(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields := eventFieldsFromRequest(r)
+		raw, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || raw == "" {
+			fields["reason"] = "missing_token"
+			appLog.warn("kiosk_auth_failed", fields)
+			writeAPIError(w, http.StatusUnauthorized, "missing device token")
+			return
+		}
+
+		device, err := authenticateKioskDevice(raw, jstNow())
+		if err == errKioskDeviceInvalid {
+			fields["reason"] = "invalid_token"
+			appLog.warn("kiosk_auth_failed", fields)
+			writeAPIError(w, http.StatusUnauthorized, "invalid device token")
+			return
+		}
+		if err != nil {
+			log.Println("authenticateKioskDevice error:", err)
+			writeAPIError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), kioskDeviceContextKey, device)))
+	}
+}
+
+func staffEventFields(r *http.Request) eventFields {
+	fields := eventFieldsFromRequest(r)
+	if d := kioskDeviceFromContext(r.Context()); d != nil {
+		fields["kiosk_device"] = d.Name
+		fields["kiosk_device_id"] = d.ID
+	}
+	return fields
+}
+
+// 検索結果の1件
+type staffMember struct {
+	MemberID    string `json:"memberId"` // line_user_id（LINE なしの会員は内部 ID）
+	FullName    string `json:"fullName"`
+	Kana        string `json:"kana"`
+	DisplayName string `json:"displayName"`
+	PosterID    string `json:"posterId"`
+	PlanName    string `json:"planName"`
+	LineLinked  bool   `json:"lineLinked"`
+	InsideNow   bool   `json:"insideNow"`
+
+	memberType string
+}
+
+// 画面に出す名前（氏名が無ければ LINE の表示名）
+func (m staffMember) name() string {
+	if m.FullName != "" {
+		return m.FullName
+	}
+	return m.DisplayName
+}
+
+const staffMemberColumns = `
+  line_user_id,
+  IFNULL(full_name, ''),
+  IFNULL(full_name_kana, ''),
+  IFNULL(display_name, ''),
+  IFNULL(poster_id, ''),
+  IFNULL(member_type, ` + defaultPlanCodeSQL + `),
+  line_linked
+`
+
+func scanStaffMember(scan func(dest ...interface{}) error) (staffMember, error) {
+	var m staffMember
+	err := scan(&m.MemberID, &m.FullName, &m.Kana, &m.DisplayName, &m.PosterID, &m.memberType, &m.LineLinked)
+	return m, err
+}
+
+// 氏名・ふりがな・LINE の表示名の部分一致と、PosterID の前方一致で探す
+func searchStaffMembers(q string) ([]staffMember, error) {
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	like := "%" + q + "%"
+	rows, err := db.Query(`SELECT `+staffMemberColumns+`
+FROM members
+WHERE IFNULL(full_name, '') LIKE ?
+   OR IFNULL(full_name_kana, '') LIKE ?
+   OR IFNULL(display_name, '') LIKE ?
+   OR IFNULL(poster_id, '') LIKE ?
+ORDER BY IFNULL(NULLIF(full_name_kana, ''), IFNULL(full_name, display_name)), line_user_id
+LIMIT ?`,
+		like, "%"+toHiragana(q)+"%", like, q+"%", staffMemberSearchLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inside := getCheckedInSnapshot()
+	list := []staffMember{}
+	for rows.Next() {
+		m, err := scanStaffMember(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		m.PlanName = plans.lookup(m.memberType).Name
+		_, m.InsideNow = inside[m.MemberID]
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func getStaffMember(memberID string) (staffMember, error) {
+	return scanStaffMember(db.QueryRow(`SELECT `+staffMemberColumns+`
+FROM members
+WHERE line_user_id = ?`, memberID).Scan)
+}
+
+// GET /staff/api/me
+// 端末の名前と今の人数（画面の上に出す）
+func handleStaffMe(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"device": kioskDeviceFromContext(r.Context()).Name,
+		"count":  getCurrentCount(),
+		"max":    getMaxPeople(),
+		"open":   isBusinessOpen(jstNow()),
+	})
+}
+
+// GET /staff/api/members?q=...
+func handleStaffMembers(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeAPIJSON(w, http.StatusOK, map[string]interface{}{"members": []staffMember{}})
+		return
+	}
+
+	members, err := searchStaffMembers(q)
+	if err != nil {
+		writeAPIInternalError(w, "searchStaffMembers", err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"members": members})
+}
+
+type staffMemberRequest struct {
+	MemberID string `json:"memberId"`
+}
+
+// リクエストの会員を引く。見つからなければ 404 を返して false
+func decodeStaffMember(w http.ResponseWriter, r *http.Request) (staffMember, bool) {
+	var req staffMemberRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return staffMember{}, false
+	}
+	if req.MemberID == "" {
+		writeAPIError(w, http.StatusBadRequest, "memberId is required")
+		return staffMember{}, false
+	}
+	m, err := getStaffMember(req.MemberID)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "member not found")
+		return staffMember{}, false
+	}
+	if err != nil {
+		writeAPIInternalError(w, "getStaffMember", err)
+		return staffMember{}, false
+	}
+	return m, true
+}
+
+// POST /staff/api/checkin  {"memberId": "..."}
+// 結果は /checkin と同じ形（checkinResponse）で返す
+func handleStaffCheckin(w http.ResponseWriter, r *http.Request) {
+	m, ok := decodeStaffMember(w, r)
+	if !ok {
+		return
+	}
+	fields := staffEventFields(r)
+	fields["line_user_id"] = m.MemberID
+	fields["line_linked"] = m.LineLinked
+
+	if now := jstNow(); !isBusinessOpen(now) {
+		appLog.info("staff_checkin_refused_closed", fields)
+		writeAPIJSON(w, http.StatusOK, checkinResponse{
+			Count:   getCurrentCount(),
+			Max:     getMaxPeople(),
+			Status:  checkinStatusClosed,
+			Message: businessHours.closedMessage(now),
+		})
+		return
+	}
+
+	// 判定から addCheckin までは /checkin と同じく1人ずつ。
+	// LINE の呼び出しを受け取れない会員もいるので、順番待ちには入れず満員なら断る
+	checkinGate.Lock()
+
+	// 二度押しで来店が2件にならないよう、入館中なら何もしない（同時に届いても片方だけが通るようゲートの中で見る）
+	if isCheckedIn(m.MemberID) {
+		checkinGate.Unlock()
+		writeAPIJSON(w, http.StatusOK, checkinResponse{
+			Count:   getCurrentCount(),
+			Max:     getMaxPeople(),
+			Status:  checkinStatusCheckedIn,
+			Message: m.name() + " さんはすでにチェックイン済みです。",
+		})
+		return
+	}
+
+	admission, err := admitCheckin(m.MemberID, m.DisplayName, false)
+	if err != nil {
+		checkinGate.Unlock()
+		writeAPIInternalError(w, "admitCheckin", err)
+		return
+	}
+	if admission.Status == checkinStatusFull {
+		checkinGate.Unlock()
+		count, maxPeople := getCurrentCount(), getMaxPeople()
+		fields["count"] = count
+		fields["max"] = maxPeople
+		appLog.info("staff_checkin_refused_full", fields)
+		writeAPIJSON(w, http.StatusOK, checkinResponse{
+			Count:   count,
+			Max:     maxPeople,
+			Status:  checkinStatusFull,
+			Message: "ただいま満員のため、チェックインできません。",
+		})
+		return
+	}
+
+	visitID, ticketPackID, err := recordVisit(m.MemberID, m.DisplayName, visitSourceStaff)
+	if err != nil {
+		checkinGate.Unlock()
+		writeAPIInternalError(w, "recordVisit", err)
+		return
+	}
+	count, err := addCheckin(m.MemberID, visitID)
+	checkinGate.Unlock()
+	if err != nil {
+		writeAPIInternalError(w, "addCheckin", err)
+		return
+	}
+
+	// ここから先は案内を作るだけなので、失敗してもチェックインは成功として返す
+	monthlyVisitCount, err := getMonthlyVisitCount(m.MemberID)
+	if err != nil {
+		log.Println("getMonthlyVisitCount error:", err)
+	}
+	planNotice, err := planCheckinNotice(m.MemberID)
+	if err != nil {
+		log.Println("planCheckinNotice error:", err)
+	}
+	ticketsRemaining, err := memberTicketBalance(m.MemberID)
+	if err != nil {
+		log.Println("memberTicketBalance error:", err)
+	}
+
+	resp := checkinResponse{
+		Count:             count,
+		Max:               getMaxPeople(),
+		MonthlyVisitCount: monthlyVisitCount,
+		Status:            admission.Status,
+	}
+	resp.setCompletionMessage(ticketPackID, ticketsRemaining, planNotice)
+	if resp.Message == "" {
+		resp.Message = "チェックインが完了しました。"
+	}
+	resp.Message = m.name() + " さん: " + resp.Message
+	writeAPIJSON(w, http.StatusOK, resp)
+
+	fields["visit_id"] = visitID
+	fields["count_after"] = count
+	fields["monthly_visit_count"] = monthlyVisitCount
+	fields["checkin_status"] = admission.Status
+	if ticketPackID != 0 {
+		fields["ticket_pack_id"] = ticketPackID
+	}
+	appLog.info("staff_checkin", fields)
+}
+
+// POST /staff/api/checkout  {"memberId": "..."}
+func handleStaffCheckout(w http.ResponseWriter, r *http.Request) {
+	m, ok := decodeStaffMember(w, r)
+	if !ok {
+		return
+	}
+	fields := staffEventFields(r)
+	fields["line_user_id"] = m.MemberID
+
+	if !isCheckedIn(m.MemberID) {
+		writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+			"count":   getCurrentCount(),
+			"max":     getMaxPeople(),
+			"message": m.name() + " さんはチェックインしていません。",
+		})
+		return
+	}
+
+	count, err := removeCheckin(m.MemberID, checkoutReasonStaff)
+	if err != nil {
+		writeAPIInternalError(w, "removeCheckin", err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"count":   count,
+		"max":     getMaxPeople(),
+		"message": m.name() + " さんのチェックアウトが完了しました。",
+	})
+
+	fields["count_after"] = count
+	appLog.info("staff_checkout", fields)
+}
@@ -9,70 +9,163 @@ import (
 
 // フロントから来るJSONの形
 type checkinRequest struct {
-	UserID      string `json:"userId"`
+	UserID      string `json:"-"` // ID トークンの sub を入れる
 	DisplayName string `json:"displayName"`
+	Trigger     string `json:"trigger"`    // チェックアウト時のみ: "auto"（自動切替）or ""（手動）
+	KioskToken  string `json:"kioskToken"` // チェックイン時のみ: 受付の QR コードの中身（kiosk_qr.go）
+
+	// チェックイン時のみ: 端末の位置（geofence.go）。取れなければ省略される
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Accuracy  *float64 `json:"accuracy"` // 誤差（メートル）
 }
 
 // チェックインしたときの情報
 type checkinInfo struct {
-	At time.Time // いつチェックインしたか
+	At      time.Time // いつチェックインしたか
+	VisitID int64     // 対応する visits.id（記録に失敗した場合は 0）
 }
 
-// メモリ上でチェックインを管理する
+// メモリ上でチェックインを管理する（永続化は checkin_sessions テーブル）
 var (
 	mu                   sync.Mutex
 	checkedInUsers       = make(map[string]checkinInfo)
 	lastCheckoutAtByUser = make(map[string]time.Time)
-	maxPeople            = 10 // Max定員10人（Jsと合わせる）
-	expireAfter          = 90 * time.Minute
-	autoCheckoutBlockFor = 10 * time.Minute
-	autoCheckinBlockFor  = 30 * time.Minute
+	currentSettings      storeSettings // loadStoreSettings で読み込む（settings.go）
+	occupancyListeners   []func(count, max int)
+
+	// /checkin の「空きの確認（admitCheckin）→ 在館への追加（addCheckin）」を1人ずつ行う
+	checkinGate sync.Mutex
 )
 
-// 期限切れの人を消す共通処理
+// 人数（または定員）が変わったときに呼ばれる関数を登録する。
+// mu を持ったまま呼ぶので、登録する関数はブロックしないこと。
+func onOccupancyChange(fn func(count, max int)) {
+	mu.Lock()
+	defer mu.Unlock()
+	occupancyListeners = append(occupancyListeners, fn)
+}
+
+func notifyOccupancyLocked() {
+	count := len(checkedInUsers)
+	for _, fn := range occupancyListeners {
+		fn(count, currentSettings.MaxPeople)
+	}
+}
+
+// 期限切れ・閉店時刻を過ぎた人を消す共通処理
 func cleanupExpiredLocked(now time.Time) {
+	expireAfter := currentSettings.ExpireAfter
+	expired := make(map[string]time.Time)
+	closed := make(map[string]time.Time)
 	for id, info := range checkedInUsers {
-		if now.Sub(info.At) > expireAfter {
-			delete(checkedInUsers, id)
-			appLog.info("checkin_expired_cleanup", eventFields{
-				"line_user_id":        id,
-				"checked_in_at":       info.At.Format(time.RFC3339),
-				"expired_after_min":   int(expireAfter / time.Minute),
-				"cleaned_up_at":       now.Format(time.RFC3339),
-				"cleanup_reason":      "expired_session",
-				"remaining_checkedin": len(checkedInUsers),
-			})
+		deadline := info.At.Add(expireAfter)
+		if businessHours != nil {
+			// 営業時間内に入った人は、期限より先に閉店が来ればそこで終わり
+			if closing, ok := businessHours.closingAfter(info.At); ok && closing.Before(deadline) {
+				if !now.Before(closing) {
+					closed[id] = closing
+				}
+				continue
+			}
 		}
+		if now.After(deadline) {
+			// 滞在時間が実態より伸びないよう、期限の時刻でチェックアウト扱いにする
+			expired[id] = deadline
+		}
+	}
+	if len(expired) == 0 && len(closed) == 0 {
+		// 呼び出した人の枠の確保が切れていないかは、誰も期限切れでなくても見る
+		promoteWaitlistLocked(now)
+		return
+	}
+
+	changed := false
+	if removeSessionsLocked(expired, checkoutReasonExpired, now) {
+		changed = true
+	}
+	if removeSessionsLocked(closed, checkoutReasonClosing, now) {
+		changed = true
+	}
+	if changed {
+		notifyOccupancyLocked()
+	}
+	promoteWaitlistLocked(now)
+}
+
+// cleanupExpiredLocked の下請け。セッションを閉じてメモリからも消す。消せたら true
+func removeSessionsLocked(ends map[string]time.Time, reason string, now time.Time) bool {
+	if len(ends) == 0 {
+		return false
+	}
+	if err := closeCheckinSessions(ends, reason); err != nil {
+		// DBに残せなかった場合はメモリも消さず、次回の掃除で再試行する
+		appLog.error("db_error", eventFields{
+			"operation":     "close_" + reason + "_sessions",
+			"expired_count": len(ends),
+			"error":         err.Error(),
+		})
+		return false
+	}
+
+	cleanupReason := "expired_session"
+	if reason == checkoutReasonClosing {
+		cleanupReason = "closing_time"
+	}
+	for id, endAt := range ends {
+		info := checkedInUsers[id]
+		delete(checkedInUsers, id)
+		appLog.info("checkin_expired_cleanup", eventFields{
+			"line_user_id":        id,
+			"checked_in_at":       info.At.Format(time.RFC3339),
+			"checked_out_at":      endAt.Format(time.RFC3339),
+			"expired_after_min":   int(currentSettings.ExpireAfter / time.Minute),
+			"cleaned_up_at":       now.Format(time.RFC3339),
+			"cleanup_reason":      cleanupReason,
+			"remaining_checkedin": len(checkedInUsers),
+		})
 	}
+	return true
 }
 
 // ユーザーを追加して現在の人数を返す
-func addCheckin(userID string) int {
+func addCheckin(userID string, visitID int64) (int, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
 	now := jstNow()
 	cleanupExpiredLocked(now)
 
-	checkedInUsers[userID] = checkinInfo{At: now}
+	if err := insertCheckinSession(userID, visitID, now); err != nil {
+		return len(checkedInUsers), err
+	}
+
+	checkedInUsers[userID] = checkinInfo{At: now, VisitID: visitID}
 	delete(lastCheckoutAtByUser, userID)
-	return len(checkedInUsers)
+	notifyOccupancyLocked()
+	return len(checkedInUsers), nil
 }
 
-// チェックアウトして現在の人数を返す
-func removeCheckin(userID string) int {
+// チェックアウトして現在の人数を返す。reason は checkoutReason* のいずれか。
+func removeCheckin(userID, reason string) (int, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
 	if _, ok := checkedInUsers[userID]; ok {
+		now := jstNow()
+		if err := closeCheckinSessions(map[string]time.Time{userID: now}, reason); err != nil {
+			return len(checkedInUsers), err
+		}
 		delete(checkedInUsers, userID)
-		lastCheckoutAtByUser[userID] = jstNow()
+		lastCheckoutAtByUser[userID] = now
+		notifyOccupancyLocked()
+		promoteWaitlistLocked(now)
 	} else {
 		appLog.info("checkout_without_active_checkin", eventFields{
 			"line_user_id": userID,
 		})
 	}
-	return len(checkedInUsers)
+	return len(checkedInUsers), nil
 }
 
 // 現在の人数を取得（ついでに期限切れも掃除する）
@@ -86,7 +179,23 @@ func getCurrentCount() int {
 
 // 定員を取得
 func getMaxPeople() int {
-	return maxPeople
+	mu.Lock()
+	defer mu.Unlock()
+	return currentSettings.MaxPeople
+}
+
+// 今いる人の line_user_id → チェックイン時刻
+func getCheckedInSnapshot() map[string]time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+
+	cleanupExpiredLocked(jstNow())
+
+	snapshot := make(map[string]time.Time, len(checkedInUsers))
+	for id, info := range checkedInUsers {
+		snapshot[id] = info.At
+	}
+	return snapshot
 }
 
 // 指定のユーザーがまだ中にいるかどうか
@@ -119,9 +228,12 @@ func getAutoToggleStatus(userID string) autoToggleStatus {
 	now := jstNow()
 	cleanupExpiredLocked(now)
 
+	autoCheckoutBlockFor := currentSettings.AutoCheckoutBlockFor
+	autoCheckinBlockFor := currentSettings.AutoCheckinBlockFor
+
 	status := autoToggleStatus{
 		Count: len(checkedInUsers),
-		Max:   maxPeople,
+		Max:   currentSettings.MaxPeople,
 	}
 
 	info, checkedIn := checkedInUsers[userID]
@@ -162,10 +274,34 @@ func getAutoToggleStatus(userID string) autoToggleStatus {
 	return status
 }
 
-// visitを記録する（チェックイン時に呼ぶ）
-func recordVisit(lineUserID, displayName string) (err error) {
+// visits.source に入る値（どこからの来店か）
+const (
+	visitSourceLIFF  = "liff"  // 会員の LINE から
+	visitSourceStaff = "staff" // 受付のスタッフ端末から（staff_kiosk.go）
+	visitSourceAdmin = "admin" // 管理画面から
+	visitSourceAPI   = "api"   // 管理 API から
+)
+
+func visitSourceLabel(source string) string {
+	switch source {
+	case visitSourceLIFF:
+		return "LINE"
+	case visitSourceStaff:
+		return "スタッフ端末"
+	case visitSourceAdmin:
+		return "管理画面"
+	case visitSourceAPI:
+		return "API"
+	default:
+		return source
+	}
+}
+
+// visitを記録する（チェックイン時に呼ぶ）。作成した visits.id を返す。
+// プランの込み回数を超えた来店で回数券を持っていれば1枚使い、その回数券の id も返す（使わなければ 0）。
+func recordVisit(lineUserID, displayName, source string) (visitID, ticketPackID int64, err error) {
 	if lineUserID == "" {
-		return nil
+		return 0, 0, nil
 	}
 
 	// 日本時間で「今」
@@ -174,7 +310,7 @@ func recordVisit(lineUserID, displayName string) (err error) {
 
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	defer func() {
 		if err != nil {
@@ -185,34 +321,75 @@ func recordVisit(lineUserID, displayName string) (err error) {
 	// members にユーザーを登録（なければ INSERT、あれば display_name を更新）
 	if _, err = tx.Exec(
 		`INSERT INTO members(line_user_id, display_name, member_type, created_at)
-         VALUES(?, ?, 'general', ?)
+         VALUES(?, ?, ?, ?)
          ON CONFLICT(line_user_id)
          DO UPDATE SET display_name = excluded.display_name`,
-		lineUserID, displayName, visitedAt,
+		lineUserID, displayName, defaultPlanCode, visitedAt,
 	); err != nil {
 		appLog.error("db_error", eventFields{
 			"line_user_id": lineUserID,
 			"operation":    "upsert_member_on_visit",
 			"error":        err.Error(),
 		})
-		return err
+		return 0, 0, err
 	}
 
 	// visits に1件挿入（paid は 0）
-	if _, err = tx.Exec(
-		`INSERT INTO visits(line_user_id, visited_at, paid)
-         VALUES(?, ?, 0)`,
-		lineUserID, visitedAt,
-	); err != nil {
+	res, err := tx.Exec(
+		`INSERT INTO visits(line_user_id, visited_at, paid, source)
+         VALUES(?, ?, 0, ?)`,
+		lineUserID, visitedAt, source,
+	)
+	if err != nil {
 		appLog.error("db_error", eventFields{
 			"line_user_id": lineUserID,
 			"operation":    "insert_visit",
 			"error":        err.Error(),
 		})
-		return err
+		return 0, 0, err
+	}
+	if visitID, err = res.LastInsertId(); err != nil {
+		return 0, 0, err
+	}
+
+	if ticketPackID, err = consumeTicketIfBillable(tx, lineUserID, visitID, now); err != nil {
+		appLog.error("db_error", eventFields{
+			"line_user_id": lineUserID,
+			"operation":    "consume_ticket",
+			"error":        err.Error(),
+		})
+		return 0, 0, err
 	}
 
-	return tx.Commit()
+	return visitID, ticketPackID, tx.Commit()
+}
+
+// 今入れた来店がその月の込み回数を超えていれば回数券を1枚使う
+func consumeTicketIfBillable(tx *sql.Tx, lineUserID string, visitID int64, now time.Time) (int64, error) {
+	var (
+		memberType string
+		nth        int
+	)
+	if err := tx.QueryRow(`
+SELECT
+  IFNULL(m.member_type, `+defaultPlanCodeSQL+`),
+  (SELECT COUNT(*) FROM visits v WHERE v.line_user_id = m.line_user_id AND strftime('%Y-%m', v.visited_at) = ?)
+FROM members m
+WHERE m.line_user_id = ?`, formatJSTMonth(now), lineUserID).Scan(&memberType, &nth); err != nil {
+		return 0, err
+	}
+
+	p, err := queryPlan(tx, memberType)
+	if err == errPlanNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !p.isBillableVisit(nth) {
+		return 0, nil
+	}
+	return consumeTicketForVisit(tx, lineUserID, visitID, formatJSTDate(now))
 }
 
 func getMonthlyVisitCount(lineUserID string) (int, error) {
@@ -235,29 +412,17 @@ WHERE line_user_id = ?
 	return count, nil
 }
 
-func shouldShowLightPlanCheckinNotice(lineUserID string) (bool, error) {
-	now := jstNow()
-	monthKey := formatJSTMonth(now)
-
-	var memberType string
-	var monthlyCount int
-	err := db.QueryRow(`
-SELECT
-  IFNULL(m.member_type, 'general'),
-  COUNT(v.id)
-FROM members m
-LEFT JOIN visits v
-  ON v.line_user_id = m.line_user_id
-  AND strftime('%Y-%m', v.visited_at) = ?
-WHERE m.line_user_id = ?
-GROUP BY m.line_user_id, m.member_type
-`, monthKey, lineUserID).Scan(&memberType, &monthlyCount)
+// 今月の来店がプランの込み回数を超えていれば、チェックイン時に出す案内を返す（無ければ空文字）
+func planCheckinNotice(lineUserID string) (string, error) {
+	p, monthlyCount, err := getMemberPlanAndMonthlyCount(lineUserID)
 	if err == sql.ErrNoRows {
-		return false, nil
+		return "", nil
 	}
 	if err != nil {
-		return false, err
+		return "", err
 	}
-
-	return memberType == "1day" && monthlyCount >= 5, nil
+	if !p.isBillableVisit(monthlyCount) {
+		return "", nil
+	}
+	return p.checkinNotice(), nil
 }
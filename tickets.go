@@ -0,0 +1,377 @@
+// tickets.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 回数券の商品（10回券など）
+type ticketProduct struct {
+	ID        int64
+	Name      string
+	Visits    int
+	Price     int
+	ValidDays int // 0 は無期限
+	Active    bool
+	SortOrder int
+}
+
+func (p ticketProduct) ValidLabel() string {
+	if p.ValidDays <= 0 {
+		return "無期限"
+	}
+	return fmt.Sprintf("%d日", p.ValidDays)
+}
+
+// 会員が持っている回数券1冊
+type ticketPack struct {
+	ID           int64
+	LineUserID   string
+	MemberName   string // 一覧表示用
+	Name         string
+	Total        int
+	Remaining    int
+	Price        int
+	Method       string
+	SoldBy       string
+	PurchasedAt  string // 画面用 "2006/01/02 15:04"
+	ExpiresOn    string // "2006-01-02"。空なら無期限
+	RefundedAt   string // 画面用。空なら未返金
+	RefundAmount int
+	Note         string
+	Expired      bool // 今日の時点で期限切れ
+}
+
+func (p ticketPack) MethodLabel() string {
+	return paymentMethodLabel(p.Method)
+}
+
+// 来店で使える状態か
+func (p ticketPack) Usable() bool {
+	return p.RefundedAt == "" && !p.Expired && p.Remaining > 0
+}
+
+func (p ticketPack) StatusLabel() string {
+	switch {
+	case p.RefundedAt != "":
+		return "返金済み"
+	case p.Expired:
+		return "期限切れ"
+	case p.Remaining <= 0:
+		return "使い切り"
+	default:
+		return "利用中"
+	}
+}
+
+// 未使用分を回数で按分した返金額の目安
+func (p ticketPack) SuggestedRefund() int {
+	if p.Total <= 0 {
+		return 0
+	}
+	return p.Price * p.Remaining / p.Total
+}
+
+var (
+	errTicketProductNotFound = errors.New("ticket product not found")
+	errTicketPackNotFound    = errors.New("ticket pack not found")
+	errTicketPackRefunded    = errors.New("ticket pack already refunded")
+)
+
+// 入力内容の誤り。管理画面にそのまま表示する。
+type ticketInputError string
+
+func (e ticketInputError) Error() string { return string(e) }
+
+func validateTicketProduct(p ticketProduct) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return ticketInputError("商品名を入力してください")
+	}
+	if p.Visits <= 0 {
+		return ticketInputError("回数は1以上にしてください")
+	}
+	if p.Price < 0 {
+		return ticketInputError("金額は0以上にしてください")
+	}
+	if p.ValidDays < 0 {
+		return ticketInputError("有効日数は0以上にしてください（0 は無期限）")
+	}
+	return nil
+}
+
+func listTicketProducts(activeOnly bool) ([]ticketProduct, error) {
+	query := `SELECT id, name, visits, price, valid_days, active, sort_order FROM ticket_products`
+	if activeOnly {
+		query += ` WHERE active = 1`
+	}
+	query += ` ORDER BY sort_order, id`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []ticketProduct
+	for rows.Next() {
+		var p ticketProduct
+		if err := rows.Scan(&p.ID, &p.Name, &p.Visits, &p.Price, &p.ValidDays, &p.Active, &p.SortOrder); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func getTicketProduct(id int64) (ticketProduct, error) {
+	var p ticketProduct
+	err := db.QueryRow(
+		`SELECT id, name, visits, price, valid_days, active, sort_order FROM ticket_products WHERE id = ?`,
+		id,
+	).Scan(&p.ID, &p.Name, &p.Visits, &p.Price, &p.ValidDays, &p.Active, &p.SortOrder)
+	if err == sql.ErrNoRows {
+		return p, errTicketProductNotFound
+	}
+	return p, err
+}
+
+func insertTicketProduct(ex sqlExecer, p ticketProduct) (int64, error) {
+	if err := validateTicketProduct(p); err != nil {
+		return 0, err
+	}
+	now := formatJSTDateTime(jstNow())
+	res, err := ex.Exec(
+		`INSERT INTO ticket_products(name, visits, price, valid_days, active, sort_order, created_at, updated_at)
+         VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		strings.TrimSpace(p.Name), p.Visits, p.Price, p.ValidDays, p.Active, p.SortOrder, now, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func updateTicketProduct(ex sqlExecer, p ticketProduct) error {
+	if err := validateTicketProduct(p); err != nil {
+		return err
+	}
+	res, err := ex.Exec(
+		`UPDATE ticket_products
+            SET name = ?, visits = ?, price = ?, valid_days = ?, active = ?, sort_order = ?, updated_at = ?
+          WHERE id = ?`,
+		strings.TrimSpace(p.Name), p.Visits, p.Price, p.ValidDays, p.Active, p.SortOrder,
+		formatJSTDateTime(jstNow()), p.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTicketProductNotFound
+	}
+	return nil
+}
+
+const ticketPackColumns = `
+  t.id,
+  t.line_user_id,
+  IFNULL(NULLIF(m.full_name, ''), IFNULL(m.display_name, '')),
+  t.name,
+  t.total,
+  t.remaining,
+  t.price,
+  t.method,
+  IFNULL(a.username, ''),
+  strftime('%Y/%m/%d %H:%M', t.purchased_at),
+  IFNULL(t.expires_on, ''),
+  IFNULL(strftime('%Y/%m/%d %H:%M', t.refunded_at), ''),
+  IFNULL(t.refund_amount, 0),
+  t.note
+`
+
+const ticketPackJoins = `
+FROM ticket_packs t
+LEFT JOIN members m ON m.line_user_id = t.line_user_id
+LEFT JOIN admin_users a ON a.id = t.sold_by_admin_id
+`
+
+func scanTicketPacks(rows *sql.Rows, today string) ([]ticketPack, error) {
+	defer rows.Close()
+
+	var list []ticketPack
+	for rows.Next() {
+		var p ticketPack
+		if err := rows.Scan(
+			&p.ID, &p.LineUserID, &p.MemberName, &p.Name, &p.Total, &p.Remaining, &p.Price, &p.Method,
+			&p.SoldBy, &p.PurchasedAt, &p.ExpiresOn, &p.RefundedAt, &p.RefundAmount, &p.Note,
+		); err != nil {
+			return nil, err
+		}
+		p.Expired = p.ExpiresOn != "" && p.ExpiresOn < today
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// 会員の回数券（新しい順）
+func listMemberTicketPacks(lineUserID string) ([]ticketPack, error) {
+	rows, err := db.Query(`SELECT `+ticketPackColumns+ticketPackJoins+`
+WHERE t.line_user_id = ?
+ORDER BY t.purchased_at DESC, t.id DESC`, lineUserID)
+	if err != nil {
+		return nil, err
+	}
+	return scanTicketPacks(rows, formatJSTDate(jstNow()))
+}
+
+// 使える残りがある回数券（期限の近い順）
+func listUsableTicketPacks() ([]ticketPack, error) {
+	today := formatJSTDate(jstNow())
+	rows, err := db.Query(`SELECT `+ticketPackColumns+ticketPackJoins+`
+WHERE t.refunded_at IS NULL
+  AND t.remaining > 0
+  AND (t.expires_on IS NULL OR t.expires_on >= ?)
+ORDER BY IFNULL(t.expires_on, '9999-12-31'), t.purchased_at`, today)
+	if err != nil {
+		return nil, err
+	}
+	return scanTicketPacks(rows, today)
+}
+
+func getTicketPack(tx *sql.Tx, id int64) (ticketPack, error) {
+	rows, err := tx.Query(`SELECT `+ticketPackColumns+ticketPackJoins+` WHERE t.id = ?`, id)
+	if err != nil {
+		return ticketPack{}, err
+	}
+	list, err := scanTicketPacks(rows, formatJSTDate(jstNow()))
+	if err != nil {
+		return ticketPack{}, err
+	}
+	if len(list) == 0 {
+		return ticketPack{}, errTicketPackNotFound
+	}
+	return list[0], nil
+}
+
+// 今日使える残り回数の合計
+func memberTicketBalance(lineUserID string) (int, error) {
+	var remaining int
+	err := db.QueryRow(`
+SELECT IFNULL(SUM(remaining), 0)
+  FROM ticket_packs
+ WHERE line_user_id = ?
+   AND refunded_at IS NULL
+   AND (expires_on IS NULL OR expires_on >= ?)`,
+		lineUserID, formatJSTDate(jstNow()),
+	).Scan(&remaining)
+	return remaining, err
+}
+
+// 商品を会員に販売する。有効期限は購入日から数えて valid_days 日目まで。
+func sellTicketPack(tx *sql.Tx, lineUserID string, product ticketProduct, price int, method, note string, adminID int64) (int64, error) {
+	now := jstNow()
+	var expiresOn interface{}
+	if product.ValidDays > 0 {
+		expiresOn = formatJSTDate(now.AddDate(0, 0, product.ValidDays-1))
+	}
+	res, err := tx.Exec(
+		`INSERT INTO ticket_packs(line_user_id, product_id, name, total, remaining, price, method,
+                                  sold_by_admin_id, purchased_at, expires_on, note)
+         VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		lineUserID, product.ID, product.Name, product.Visits, product.Visits, price, method,
+		adminID, formatJSTDateTime(now), expiresOn, note,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// 返金する。返金した回数券は残りがあっても使えなくなる。
+func refundTicketPack(tx *sql.Tx, id int64, amount int) error {
+	res, err := tx.Exec(
+		`UPDATE ticket_packs SET refunded_at = ?, refund_amount = ? WHERE id = ? AND refunded_at IS NULL`,
+		formatJSTDateTime(jstNow()), amount, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTicketPackRefunded
+	}
+	return nil
+}
+
+// 残り回数と有効期限を直す（expiresOn が空なら無期限）
+func adjustTicketPack(tx *sql.Tx, id int64, remaining int, expiresOn string) error {
+	if remaining < 0 {
+		return ticketInputError("残り回数は0以上にしてください")
+	}
+	var expires interface{}
+	if expiresOn != "" {
+		if _, err := time.ParseInLocation("2006-01-02", expiresOn, jst); err != nil {
+			return ticketInputError("有効期限の日付が正しくありません")
+		}
+		expires = expiresOn
+	}
+	res, err := tx.Exec(
+		`UPDATE ticket_packs SET remaining = ?, expires_on = ? WHERE id = ? AND refunded_at IS NULL`,
+		remaining, expires, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTicketPackRefunded
+	}
+	return nil
+}
+
+// 来店1回分として回数券を1枚使う。期限の近いものから使う。使える回数券が無ければ 0 を返す。
+func consumeTicketForVisit(tx *sql.Tx, lineUserID string, visitID int64, today string) (int64, error) {
+	var packID int64
+	err := tx.QueryRow(`
+SELECT id
+  FROM ticket_packs
+ WHERE line_user_id = ?
+   AND refunded_at IS NULL
+   AND remaining > 0
+   AND (expires_on IS NULL OR expires_on >= ?)
+ ORDER BY IFNULL(expires_on, '9999-12-31'), purchased_at, id
+ LIMIT 1`, lineUserID, today).Scan(&packID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`UPDATE ticket_packs SET remaining = remaining - 1 WHERE id = ?`, packID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE visits SET ticket_pack_id = ? WHERE id = ?`, packID, visitID); err != nil {
+		return 0, err
+	}
+	return packID, nil
+}
+
+// 来店を消すときに、その来店で使った回数券を1枚戻す（返金済みの回数券には戻さない）
+func restoreTicketForVisit(tx *sql.Tx, visitID int64) (int64, error) {
+	var packID sql.NullInt64
+	if err := tx.QueryRow(`SELECT ticket_pack_id FROM visits WHERE id = ?`, visitID).Scan(&packID); err != nil {
+		return 0, err
+	}
+	if !packID.Valid {
+		return 0, nil
+	}
+	if _, err := tx.Exec(
+		`UPDATE ticket_packs SET remaining = remaining + 1 WHERE id = ? AND refunded_at IS NULL`,
+		packID.Int64,
+	); err != nil {
+		return 0, err
+	}
+	return packID.Int64, nil
+}
@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 func jstNow() time.Time {
 	return time.Now().In(jst)
@@ -17,3 +20,16 @@ func formatJSTMonth(t time.Time) string {
 func formatJSTDateTime(t time.Time) string {
 	return t.In(jst).Format("2006-01-02 15:04:05")
 }
+
+func parseJSTDateTime(s string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02 15:04:05", s, jst)
+}
+
+// 滞在時間の表示用（例: "1時間05分" / "45分"）
+func formatStayDuration(seconds int) string {
+	minutes := seconds / 60
+	if minutes < 60 {
+		return fmt.Sprintf("%d分", minutes)
+	}
+	return fmt.Sprintf("%d時間%02d分", minutes/60, minutes%60)
+}
@@ -0,0 +1,173 @@
+// visit_archive.go
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// 古い来店は1件ずつの明細を消し、会員ごと・月ごとの集計（visit_monthly_rollups）だけ残す。
+// 月の途中で明細と集計が混ざらないよう、保存期間を過ぎた日を含む月より前の月をまとめて移す。
+// 入金（payments）と回数券（ticket_packs）は消さない。
+
+// 会員1人・1か月分の集計
+type visitRollup struct {
+	LineUserID   string
+	Month        string // "YYYY-MM"
+	MemberType   string
+	VisitCount   int
+	PaidCount    int
+	TicketCount  int
+	StayCount    int
+	StaySeconds  int
+	BilledAmount int
+	PaidAmount   int
+	ArchivedAt   string // 画面用 "2006/01/02 15:04"
+}
+
+// 平均滞在秒数。滞在時間が分かる来店が無ければ 0
+func (r visitRollup) AverageStaySeconds() int {
+	if r.StayCount == 0 {
+		return 0
+	}
+	return r.StaySeconds / r.StayCount
+}
+
+// now の時点で集計に移す来店の境目（この日時より前の来店を移す）
+func visitsArchiveCutoff(now time.Time, retentionDays int) time.Time {
+	return monthStart(now.AddDate(0, 0, -retentionDays))
+}
+
+// 指定月に会員の集計があれば返す（無ければ nil）
+func getVisitRollup(q sqlRowQueryer, lineUserID, ym string) (*visitRollup, error) {
+	var r visitRollup
+	err := q.QueryRow(`
+SELECT line_user_id, month, member_type, visit_count, paid_count, ticket_count,
+       stay_count, stay_seconds, billed_amount, paid_amount,
+       strftime('%Y/%m/%d %H:%M', archived_at)
+  FROM visit_monthly_rollups
+ WHERE line_user_id = ? AND month = ?`, lineUserID, ym).Scan(
+		&r.LineUserID, &r.Month, &r.MemberType, &r.VisitCount, &r.PaidCount, &r.TicketCount,
+		&r.StayCount, &r.StaySeconds, &r.BilledAmount, &r.PaidAmount, &r.ArchivedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// cutoff より前の来店を集計に移して明細を消す。戻り値は消した来店の数と、書き込んだ集計の数。
+func archiveVisitsBefore(cutoff time.Time) (archived int64, rollups int, err error) {
+	plans, err := loadPlanCatalog()
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoffStr := formatJSTDateTime(cutoff)
+	archivedAt := formatJSTDateTime(jstNow())
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`
+SELECT
+  v.line_user_id,
+  strftime('%Y-%m', v.visited_at) AS ym,
+  IFNULL(m.member_type, `+defaultPlanCodeSQL+`),
+  COUNT(*),
+  SUM(IFNULL(v.paid, 0) != 0),
+  SUM(v.ticket_pack_id IS NOT NULL),
+  SUM(v.duration_seconds IS NOT NULL AND v.checkout_reason IN `+measuredCheckoutReasonsSQL+`),
+  IFNULL(SUM(CASE WHEN v.checkout_reason IN `+measuredCheckoutReasonsSQL+` THEN v.duration_seconds END), 0)
+FROM visits v
+LEFT JOIN members m ON m.line_user_id = v.line_user_id
+WHERE v.visited_at < ?
+GROUP BY v.line_user_id, ym
+`, cutoffStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	var groups []visitRollup
+	for rows.Next() {
+		var g visitRollup
+		if err = rows.Scan(&g.LineUserID, &g.Month, &g.MemberType, &g.VisitCount, &g.PaidCount,
+			&g.TicketCount, &g.StayCount, &g.StaySeconds); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, g := range groups {
+		// 前回移した後にその月の来店が残っていた場合は足し合わせる
+		var prev *visitRollup
+		prev, err = getVisitRollup(tx, g.LineUserID, g.Month)
+		if err != nil {
+			return 0, 0, err
+		}
+		if prev != nil {
+			g.MemberType = prev.MemberType
+			g.VisitCount += prev.VisitCount
+			g.PaidCount += prev.PaidCount
+			g.TicketCount += prev.TicketCount
+			g.StayCount += prev.StayCount
+			g.StaySeconds += prev.StaySeconds
+		}
+
+		if err = tx.QueryRow(
+			`SELECT IFNULL(SUM(amount), 0) FROM payments WHERE line_user_id = ? AND month = ?`,
+			g.LineUserID, g.Month,
+		).Scan(&g.PaidAmount); err != nil {
+			return 0, 0, err
+		}
+		st := newMemberStatement(plans.lookup(g.MemberType), g.VisitCount, g.TicketCount, g.PaidAmount)
+		g.BilledAmount = st.Expected
+
+		if _, err = tx.Exec(`
+INSERT INTO visit_monthly_rollups(
+  line_user_id, month, member_type, visit_count, paid_count, ticket_count,
+  stay_count, stay_seconds, billed_amount, paid_amount, archived_at
+) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(line_user_id, month) DO UPDATE SET
+  member_type   = excluded.member_type,
+  visit_count   = excluded.visit_count,
+  paid_count    = excluded.paid_count,
+  ticket_count  = excluded.ticket_count,
+  stay_count    = excluded.stay_count,
+  stay_seconds  = excluded.stay_seconds,
+  billed_amount = excluded.billed_amount,
+  paid_amount   = excluded.paid_amount,
+  archived_at   = excluded.archived_at`,
+			g.LineUserID, g.Month, g.MemberType, g.VisitCount, g.PaidCount, g.TicketCount,
+			g.StayCount, g.StaySeconds, g.BilledAmount, g.PaidAmount, archivedAt,
+		); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	res, err := tx.Exec(`DELETE FROM visits WHERE visited_at < ?`, cutoffStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	archived, err = res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return archived, len(groups), nil
+}
@@ -0,0 +1,284 @@
+// waitlist.go
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// 定員に達したときの順番待ち（capacityPolicyReject のとき）。
+// 状態はメモリで持ち、waitlist_entries テーブルに残す（checkedInUsers と同じく mu で守る）。
+// 空きが出たら先頭の人を呼び（waitlistNotifier）、その人のために WaitlistHoldFor の間だけ枠を空けておく。
+
+// waitlist_entries.status に入る値
+const (
+	waitlistStatusWaiting  = "waiting"  // 順番待ち中
+	waitlistStatusNotified = "notified" // 呼び出し済み。枠を確保している
+	waitlistStatusAdmitted = "admitted" // チェックインした
+	waitlistStatusExpired  = "expired"  // 呼んでも来なかった・待ちすぎた
+)
+
+// 呼ばれないまま待てる時間。これを過ぎたら順番待ちから外す
+const waitlistWaitingExpiry = 3 * time.Hour
+
+type waitlistEntry struct {
+	ID          int64
+	LineUserID  string
+	DisplayName string
+	Status      string
+	JoinedAt    time.Time
+	NotifiedAt  time.Time // 呼び出す前はゼロ値
+}
+
+func (e waitlistEntry) StatusLabel() string {
+	switch e.Status {
+	case waitlistStatusWaiting:
+		return "待機中"
+	case waitlistStatusNotified:
+		return "呼び出し済み"
+	default:
+		return e.Status
+	}
+}
+
+// 並び順（先頭が次に呼ばれる人）。mu で守る
+var waitlist []waitlistEntry
+
+// 起動時に呼び出す（loadCheckinSessions の後）
+func loadWaitlist() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query(`
+SELECT id, line_user_id, display_name, status,
+       strftime('%Y-%m-%d %H:%M:%S', joined_at),
+       IFNULL(strftime('%Y-%m-%d %H:%M:%S', notified_at), '')
+FROM waitlist_entries
+WHERE status IN ('waiting', 'notified')
+ORDER BY id
+`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	waitlist = nil
+	for rows.Next() {
+		var (
+			e                    waitlistEntry
+			joinedAt, notifiedAt string
+		)
+		if err := rows.Scan(&e.ID, &e.LineUserID, &e.DisplayName, &e.Status, &joinedAt, &notifiedAt); err != nil {
+			return err
+		}
+		if e.JoinedAt, err = parseJSTDateTime(joinedAt); err != nil {
+			return err
+		}
+		if notifiedAt != "" {
+			if e.NotifiedAt, err = parseJSTDateTime(notifiedAt); err != nil {
+				return err
+			}
+		}
+		waitlist = append(waitlist, e)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// 停止中に時間切れになった人を外し、空いていれば呼ぶ
+	promoteWaitlistLocked(jstNow())
+	if len(waitlist) > 0 {
+		log.Printf("✅ 順番待ちを復元: %d人\n", len(waitlist))
+	}
+	return nil
+}
+
+// 今の順番待ち（画面用のコピー）
+func getWaitlistSnapshot() []waitlistEntry {
+	mu.Lock()
+	defer mu.Unlock()
+
+	cleanupExpiredLocked(jstNow())
+	return append([]waitlistEntry(nil), waitlist...)
+}
+
+func waitlistIndexLocked(userID string) int {
+	for i, e := range waitlist {
+		if e.LineUserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// userID 以外の人のために確保している枠の数
+func heldSlotsLocked(exceptUserID string) int {
+	held := 0
+	for _, e := range waitlist {
+		if e.Status == waitlistStatusNotified && e.LineUserID != exceptUserID {
+			held++
+		}
+	}
+	return held
+}
+
+// 何番目に呼ばれるか（1始まり）。呼び出し済みの人は数えない
+func waitlistPositionLocked(userID string) int {
+	position := 0
+	for _, e := range waitlist {
+		if e.Status == waitlistStatusWaiting {
+			position++
+		}
+		if e.LineUserID == userID {
+			return position
+		}
+	}
+	return 0
+}
+
+// 順番待ちから外して、DB の状態を status にする
+func closeWaitlistEntryLocked(i int, status string, now time.Time) error {
+	e := waitlist[i]
+	if _, err := db.Exec(
+		`UPDATE waitlist_entries SET status = ?, closed_at = ? WHERE id = ?`,
+		status, formatJSTDateTime(now), e.ID,
+	); err != nil {
+		return err
+	}
+	waitlist = append(waitlist[:i], waitlist[i+1:]...)
+	appLog.info("waitlist_closed", eventFields{
+		"line_user_id": e.LineUserID,
+		"status":       status,
+		"waited_sec":   int(now.Sub(e.JoinedAt).Seconds()),
+	})
+	return nil
+}
+
+// 時間切れの人を外してから、空いている枠の数だけ先頭から呼ぶ。
+// removeCheckin・期限切れ掃除（毎分の startCheckinExpiryJob を含む）・定員の変更など、空きが出うるところで呼ぶ。
+func promoteWaitlistLocked(now time.Time) {
+	if len(waitlist) == 0 {
+		return
+	}
+
+	holdFor := currentSettings.WaitlistHoldFor
+	open := isBusinessOpen(now) // 閉店したら順番待ちは全員終わり
+	for i := len(waitlist) - 1; i >= 0; i-- {
+		e := waitlist[i]
+		timedOut := !open ||
+			(e.Status == waitlistStatusNotified && now.Sub(e.NotifiedAt) > holdFor) ||
+			(e.Status == waitlistStatusWaiting && now.Sub(e.JoinedAt) > waitlistWaitingExpiry)
+		if !timedOut {
+			continue
+		}
+		if err := closeWaitlistEntryLocked(i, waitlistStatusExpired, now); err != nil {
+			appLog.error("db_error", eventFields{
+				"operation":    "expire_waitlist_entry",
+				"line_user_id": e.LineUserID,
+				"error":        err.Error(),
+			})
+			return
+		}
+	}
+
+	free := currentSettings.MaxPeople - len(checkedInUsers) - heldSlotsLocked("")
+	for i := range waitlist {
+		if free <= 0 {
+			break
+		}
+		if waitlist[i].Status != waitlistStatusWaiting {
+			continue
+		}
+		if _, err := db.Exec(
+			`UPDATE waitlist_entries SET status = ?, notified_at = ? WHERE id = ?`,
+			waitlistStatusNotified, formatJSTDateTime(now), waitlist[i].ID,
+		); err != nil {
+			appLog.error("db_error", eventFields{
+				"operation":    "notify_waitlist_entry",
+				"line_user_id": waitlist[i].LineUserID,
+				"error":        err.Error(),
+			})
+			return
+		}
+		waitlist[i].Status = waitlistStatusNotified
+		waitlist[i].NotifiedAt = now
+		free--
+
+		// 通知は外部への送信を含むので、mu を持ったまま待たない
+		go sendWaitlistNotice(waitlistNotice, waitlist[i], holdFor)
+	}
+}
+
+// チェックインしてよいかの判定結果
+type checkinAdmission struct {
+	Status   string // checkinStatus*
+	Position int    // 順番待ちの何番目か（checkinStatusWaitlisted のとき）
+}
+
+// /checkin の最初に呼ぶ。定員と設定に応じて、入れるか・順番待ちに入れるかを決める。
+// canWait が false（呼び出しを受け取れない会員）なら順番待ちには入れず checkinStatusFull で断る。
+// 判定から addCheckin までの間に他の人が入らないよう、呼び出し側は checkinGate を持っておく。
+func admitCheckin(userID, displayName string, canWait bool) (checkinAdmission, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := jstNow()
+	cleanupExpiredLocked(now) // 時間切れの順番待ちもここで外れる
+
+	admitted := checkinAdmission{Status: checkinStatusCheckedIn}
+	if _, inside := checkedInUsers[userID]; inside {
+		// 再チェックインは人数が増えないので断らない
+		return admitted, nil
+	}
+
+	// 呼び出し済みの本人の枠は、本人にとっては空きとして扱う
+	full := len(checkedInUsers)+heldSlotsLocked(userID) >= currentSettings.MaxPeople
+	idx := waitlistIndexLocked(userID)
+
+	if full && currentSettings.CapacityPolicy == capacityPolicyReject &&
+		(idx < 0 || waitlist[idx].Status == waitlistStatusWaiting) {
+		if !canWait {
+			return checkinAdmission{Status: checkinStatusFull}, nil
+		}
+		if idx < 0 {
+			res, err := db.Exec(
+				`INSERT INTO waitlist_entries(line_user_id, display_name, status, joined_at)
+                 VALUES(?, ?, ?, ?)`,
+				userID, displayName, waitlistStatusWaiting, formatJSTDateTime(now),
+			)
+			if err != nil {
+				return checkinAdmission{}, err
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return checkinAdmission{}, err
+			}
+			waitlist = append(waitlist, waitlistEntry{
+				ID:          id,
+				LineUserID:  userID,
+				DisplayName: displayName,
+				Status:      waitlistStatusWaiting,
+				JoinedAt:    now,
+			})
+			appLog.info("waitlist_joined", eventFields{
+				"line_user_id": userID,
+				"count":        len(checkedInUsers),
+				"max":          currentSettings.MaxPeople,
+			})
+		}
+		return checkinAdmission{
+			Status:   checkinStatusWaitlisted,
+			Position: waitlistPositionLocked(userID),
+		}, nil
+	}
+
+	if idx >= 0 {
+		if err := closeWaitlistEntryLocked(idx, waitlistStatusAdmitted, now); err != nil {
+			return checkinAdmission{}, err
+		}
+	}
+	if full && currentSettings.CapacityPolicy == capacityPolicyWarn {
+		admitted.Status = checkinStatusOverCapacity
+	}
+	return admitted, nil
+}
@@ -0,0 +1,116 @@
+// waitlist_notifier.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const linePushURL = "https://api.line.me/v2/bot/message/push"
+
+// 順番待ちの人に「空きが出た」と知らせる
+type waitlistNotifier interface {
+	notifySlotAvailable(ctx context.Context, e waitlistEntry, holdFor time.Duration) error
+}
+
+// main で設定する（loadCheckinSessions・loadWaitlist より前。以降は書き換えない）
+var waitlistNotice waitlistNotifier = logWaitlistNotifier{}
+
+// WAITLIST_NOTIFIER=log（既定）: ログに残すだけ（スタッフが順番待ちの一覧を見て声をかける）
+// WAITLIST_NOTIFIER=line       : Messaging API のプッシュメッセージで本人に送る
+func newWaitlistNotifierFromEnv() (waitlistNotifier, error) {
+	switch mode := strings.TrimSpace(os.Getenv("WAITLIST_NOTIFIER")); mode {
+	case "", "log":
+		return logWaitlistNotifier{}, nil
+	case "line":
+		token := strings.TrimSpace(os.Getenv("LINE_CHANNEL_ACCESS_TOKEN"))
+		if token == "" {
+			return nil, errors.New("LINE_CHANNEL_ACCESS_TOKEN must be set for WAITLIST_NOTIFIER=line")
+		}
+		return &linePushNotifier{
+			accessToken: token,
+			pushURL:     linePushURL,
+			client:      &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown WAITLIST_NOTIFIER: %s", mode)
+	}
+}
+
+func waitlistNoticeMessage(holdFor time.Duration) string {
+	return fmt.Sprintf("お待たせしました。空きが出ました。\n%d分以内にチェックインしてください（過ぎると次の方の順番になります）。",
+		int(holdFor/time.Minute))
+}
+
+// promoteWaitlistLocked から goroutine で呼ばれる。通知先は呼び出し側（mu の中）で渡す
+func sendWaitlistNotice(notifier waitlistNotifier, e waitlistEntry, holdFor time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	fields := eventFields{
+		"line_user_id": e.LineUserID,
+		"hold_min":     int(holdFor / time.Minute),
+	}
+	if err := notifier.notifySlotAvailable(ctx, e, holdFor); err != nil {
+		fields["error"] = err.Error()
+		appLog.error("waitlist_notify_failed", fields)
+		return
+	}
+	appLog.info("waitlist_notified", fields)
+}
+
+type logWaitlistNotifier struct{}
+
+func (logWaitlistNotifier) notifySlotAvailable(ctx context.Context, e waitlistEntry, holdFor time.Duration) error {
+	appLog.info("waitlist_slot_available", eventFields{
+		"line_user_id": e.LineUserID,
+		"display_name": e.DisplayName,
+		"message":      waitlistNoticeMessage(holdFor),
+	})
+	return nil
+}
+
+// LIFF と同じプロバイダーの Messaging API チャネルから送る（友だち追加済みの人にだけ届く）
+type linePushNotifier struct {
+	accessToken string
+	pushURL     string
+	client      *http.Client
+}
+
+func (n *linePushNotifier) notifySlotAvailable(ctx context.Context, e waitlistEntry, holdFor time.Duration) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"to": e.LineUserID,
+		"messages": []map[string]string{
+			{"type": "text", "text": waitlistNoticeMessage(holdFor)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+n.accessToken)
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("line push: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}